@@ -0,0 +1,316 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminJailRequest the body of a POST to the jail admin route.
+type adminJailRequest struct {
+	ClientIP     string `json:"clientIP"`
+	DurationSecs int    `json:"durationSecs"`
+}
+
+// serveAdmin answers the admin API mounted under adminPath. Every call must carry adminToken as a bearer token.
+func (a *Modsecurity) serveAdmin(rw http.ResponseWriter, req *http.Request) {
+	if !a.requireAdminToken(rw, req) {
+		return
+	}
+
+	switch strings.TrimPrefix(req.URL.Path, a.adminPath) {
+	case "/jail":
+		a.serveAdminJail(rw, req)
+	case "/cache":
+		a.serveAdminCache(rw, req)
+	case "/debug":
+		a.serveAdminDebug(rw, req)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// serveMetrics answers metricsPath with the Prometheus metrics, which require adminToken too.
+func (a *Modsecurity) serveMetrics(rw http.ResponseWriter, req *http.Request) {
+	if !a.requireAdminToken(rw, req) {
+		return
+	}
+	a.metrics.ServeHTTP(rw, req)
+}
+
+// requireAdminToken answers 401 to a request without adminToken, and reports whether it carried it.
+func (a *Modsecurity) requireAdminToken(rw http.ResponseWriter, req *http.Request) bool {
+	if a.isAdminAuthorized(req) {
+		return true
+	}
+	rw.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (a *Modsecurity) isAdminAuthorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1
+}
+
+// serveAdminJail lists the jailed clients on GET, jails a client on POST and releases one on DELETE.
+func (a *Modsecurity) serveAdminJail(rw http.ResponseWriter, req *http.Request) {
+	if a.jail == nil {
+		http.Error(rw, "jail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		bans, err := a.jail.bans()
+		if err != nil {
+			a.logger.Error("fail to list jail", "error", err)
+			http.Error(rw, "", http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, bans)
+
+	case http.MethodPost:
+		var body adminJailRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(rw, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		clientIP, ok := parseJailKey(body.ClientIP)
+		if !ok {
+			http.Error(rw, "invalid clientIP", http.StatusBadRequest)
+			return
+		}
+		// A subnet ban is only enforced when it matches the subnets aggregated by subnet jailing
+		if ip, _, err := net.ParseCIDR(clientIP); err == nil && a.jail.subnet(ip.String()) != clientIP {
+			http.Error(rw, "subnet does not match the subnet jailing prefixes", http.StatusBadRequest)
+			return
+		}
+		duration := a.jail.duration
+		if body.DurationSecs > 0 {
+			duration = time.Duration(body.DurationSecs) * time.Second
+		}
+		ban, err := a.jail.ban(clientIP, duration)
+		if err != nil {
+			a.logger.Error("fail to jail client", "clientIP", body.ClientIP, "error", err)
+			http.Error(rw, "", http.StatusInternalServerError)
+			return
+		}
+		// Clients jailed by session or on a single router are not banned by address
+		if a.banLog != nil && isAddressJailKey(ban.ClientIP) {
+			a.banLog.write(ban.ClientIP, ban.ReleasedAt)
+		}
+		writeAdminJSON(rw, http.StatusCreated, ban)
+
+	case http.MethodDelete:
+		clientIP, ok := parseJailKey(req.URL.Query().Get("clientIP"))
+		if !ok {
+			http.Error(rw, "invalid clientIP", http.StatusBadRequest)
+			return
+		}
+		if err := a.jail.release(clientIP); err != nil {
+			a.logger.Error("fail to release client from jail", "clientIP", clientIP, "error", err)
+			http.Error(rw, "", http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAdminCache reports the cache statistics on GET, and purges the cache on DELETE, only the verdicts of the URLs
+// matching the pattern query parameter when there is one.
+func (a *Modsecurity) serveAdminCache(rw http.ResponseWriter, req *http.Request) {
+	if a.cache == nil {
+		http.Error(rw, "cache is not enabled", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAdminJSON(rw, http.StatusOK, a.cacheStats())
+
+	case http.MethodDelete:
+		var match func(v *verdict) bool
+		if pattern := req.URL.Query().Get("pattern"); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				http.Error(rw, "invalid pattern: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			match = func(v *verdict) bool { return re.MatchString(v.URL) }
+		}
+		purged, err := a.cache.Purge(match)
+		if err != nil {
+			a.logger.Error("fail to purge cache", "error", err)
+			http.Error(rw, "", http.StatusInternalServerError)
+			return
+		}
+		a.logger.Info("verdict cache purged", "pattern", req.URL.Query().Get("pattern"), "purged", purged)
+		writeAdminJSON(rw, http.StatusOK, map[string]int{"purged": purged})
+
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminDebug the state of the plugin reported by the debug admin route.
+type adminDebug struct {
+	Config         adminDebugConfig    `json:"config"`
+	Cache          *cacheStats         `json:"cache,omitempty"`
+	Jail           *adminDebugJail     `json:"jail,omitempty"`
+	CircuitBreaker string              `json:"circuitBreaker,omitempty"`
+	Backends       []adminDebugBackend `json:"backends"`
+}
+
+// adminDebugConfig a summary of the settings deciding whether requests are inspected and blocked.
+type adminDebugConfig struct {
+	Middleware       string `json:"middleware"`
+	DetectionOnly    bool   `json:"detectionOnly"`
+	FailOpen         bool   `json:"failOpen"`
+	TimeoutMillis    int64  `json:"timeoutMillis"`
+	HeadersOnly      bool   `json:"headersOnly"`
+	InspectResponses bool   `json:"inspectResponses"`
+	Scope            string `json:"scope"`
+	ExcludedPaths    int    `json:"excludedPaths"`
+	LocalDenyRules   int    `json:"localDenyRules"`
+	BypassRanges     int    `json:"bypassSourceRanges"`
+	DenyRanges       int    `json:"denySourceRanges"`
+}
+
+// adminDebugJail the number of jailed clients, and of the clients tracked by the memory jail.
+type adminDebugJail struct {
+	Jailed  int    `json:"jailed"`
+	Entries *int   `json:"entries,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// adminDebugBackend the health of a modsecurity instance, Host is set for those of hostBackendMap.
+type adminDebugBackend struct {
+	URL         string `json:"url"`
+	Host        string `json:"host,omitempty"`
+	Healthy     bool   `json:"healthy"`
+	Failures    int    `json:"failures"`
+	InFlight    int64  `json:"inFlight"`
+	Unreachable string `json:"unreachable,omitempty"`
+	HealthCheck string `json:"healthCheck,omitempty"`
+}
+
+// serveAdminDebug reports on GET the state of the plugin, to diagnose why a request was blocked or allowed.
+func (a *Modsecurity) serveAdminDebug(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	debug := adminDebug{
+		Config: adminDebugConfig{
+			Middleware:       a.name,
+			DetectionOnly:    a.detectionOnly,
+			FailOpen:         a.failOpen,
+			TimeoutMillis:    a.timeout.Milliseconds(),
+			HeadersOnly:      a.headersOnly,
+			InspectResponses: a.inspectResponses,
+			Scope:            a.scope,
+			ExcludedPaths:    len(a.excludedPaths),
+			LocalDenyRules:   len(a.localDenyRules),
+			BypassRanges:     len(a.bypassSourceRanges),
+			DenyRanges:       len(a.denySourceRanges),
+		},
+		Backends: debugBackends("", a.backends),
+	}
+	if a.cache != nil {
+		stats := a.cacheStats()
+		debug.Cache = &stats
+	}
+	if a.jail != nil {
+		debug.Jail = &adminDebugJail{}
+		if bans, err := a.jail.bans(); err != nil {
+			debug.Jail.Error = err.Error()
+		} else {
+			debug.Jail.Jailed = len(bans)
+		}
+		if memory, ok := a.jail.store.(*memoryJailStore); ok {
+			entries := memory.entries()
+			debug.Jail.Entries = &entries
+		}
+	}
+	if a.breaker != nil {
+		debug.CircuitBreaker = a.breaker.status()
+	}
+	hosts := make([]string, 0, len(a.hostBackends))
+	for host := range a.hostBackends {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		debug.Backends = append(debug.Backends, debugBackends(host, a.hostBackends[host])...)
+	}
+	writeAdminJSON(rw, http.StatusOK, debug)
+}
+
+// debugBackends reports the health of the instances of a pool, without the credentials of their URLs.
+func debugBackends(host string, p *backendPool) []adminDebugBackend {
+	now := p.nowFn()
+	var res []adminDebugBackend
+	for _, b := range p.backends {
+		status := adminDebugBackend{URL: b.url, Host: host, InFlight: atomic.LoadInt64(&b.inFlight)}
+		if u, err := url.Parse(b.url); err == nil {
+			status.URL = u.Redacted()
+		}
+		b.mu.Lock()
+		status.Healthy = !now.Before(b.downUntil) && b.probeErr == nil
+		status.Failures = b.failures
+		if now.Before(b.unreachableUntil) && b.unreachableErr != nil {
+			status.Unreachable = b.unreachableErr.Error()
+		}
+		if b.probeErr != nil {
+			status.HealthCheck = b.probeErr.Error()
+		}
+		b.mu.Unlock()
+		res = append(res, status)
+	}
+	return res
+}
+
+func writeAdminJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(value)
+}
+
+// parseJailKey normalizes a client IP, a subnet jailed by subnet jailing, or the session key of a client jailed
+// by jailKeyCookie or jailKeyHeader, as keyed in the jail. With the perRouter scope, they are prefixed with the
+// request host.
+func parseJailKey(value string) (string, bool) {
+	if host, key, ok := strings.Cut(value, jailScopeSeparator); ok {
+		key, ok = parseJailKey(key)
+		return strings.ToLower(host) + jailScopeSeparator + key, ok && host != ""
+	}
+	if hash, ok := strings.CutPrefix(value, jailSessionPrefix); ok {
+		if _, err := hex.DecodeString(hash); err != nil || hash == "" {
+			return "", false
+		}
+		return jailSessionPrefix + strings.ToLower(hash), true
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String(), true
+	}
+	if _, ipNet, err := net.ParseCIDR(value); err == nil {
+		return ipNet.String(), true
+	}
+	return "", false
+}
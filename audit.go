@@ -0,0 +1,102 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecord a blocked request or a jailed client, written to the audit log as a line of JSON.
+type auditRecord struct {
+	Time       string            `json:"time"`
+	Type       string            `json:"type"`
+	Middleware string            `json:"middleware"`
+	RequestID  string            `json:"requestID,omitempty"`
+	ClientIP   string            `json:"clientIP"`
+	Country    string            `json:"country,omitempty"`
+	Method     string            `json:"method"`
+	Host       string            `json:"host"`
+	URI        string            `json:"uri"`
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	WafHeaders map[string]string `json:"wafHeaders,omitempty"`
+}
+
+// auditLog writes security events for SIEM ingestion, to stdout or to a file of its own.
+type auditLog struct {
+	mu      sync.Mutex
+	out     io.Writer
+	headers []string
+	nowFn   func() time.Time
+}
+
+// newAuditLog opens the audit log, appending to the file at path or writing to stdout when path is empty.
+// The file is closed once ctx is done.
+func newAuditLog(ctx context.Context, path string, headers []string) (*auditLog, error) {
+	l := &auditLog{out: os.Stdout, headers: headers, nowFn: time.Now}
+	if path == "" {
+		return l, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	l.out = f
+	return l, nil
+}
+
+// write records an event about the request. The matched rules are in the X- headers of the modsecurity response,
+// whatever the names the rules give them, hence all of them are kept.
+func (l *auditLog) write(eventType, middleware, requestID string, req *http.Request, clientIP, country string, v *verdict) {
+	record := auditRecord{
+		Time:       l.nowFn().UTC().Format(time.RFC3339Nano),
+		Type:       eventType,
+		Middleware: middleware,
+		RequestID:  requestID,
+		ClientIP:   clientIP,
+		Country:    country,
+		Method:     req.Method,
+		Host:       req.Host,
+		URI:        req.RequestURI,
+		Status:     v.StatusCode,
+	}
+	for _, name := range l.headers {
+		if values := req.Header.Values(name); len(values) > 0 {
+			if record.Headers == nil {
+				record.Headers = make(map[string]string)
+			}
+			record.Headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+		}
+	}
+	for _, header := range []http.Header{v.Header, v.WafHeader} {
+		for name, values := range header {
+			if !strings.HasPrefix(name, "X-") {
+				continue
+			}
+			if record.WafHeaders == nil {
+				record.WafHeaders = make(map[string]string)
+			}
+			record.WafHeaders[name] = strings.Join(values, ", ")
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
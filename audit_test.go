@@ -0,0 +1,84 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_AuditLog(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Modsec-Rule-Id", "942100")
+		w.Header().Set("Server", "Apache")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.AuditLog = true
+	config.AuditLogPath = path
+	config.AuditLogHeaders = []string{"user-agent", "Referer"}
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	middleware, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/search?q=1'or'1", nil)
+	req.Header.Set("User-Agent", "sqlmap")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record auditRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		assert.NotEmpty(t, record.Time)
+		record.Time = ""
+		records = append(records, record)
+	}
+
+	expected := auditRecord{
+		Type:       eventBlocked,
+		Middleware: "modsecurity-middleware",
+		ClientIP:   "192.0.2.1",
+		Method:     http.MethodGet,
+		Host:       "example.com",
+		URI:        "/search?q=1'or'1",
+		Status:     http.StatusForbidden,
+		Headers:    map[string]string{"User-Agent": "sqlmap"},
+		WafHeaders: map[string]string{"X-Modsec-Rule-Id": "942100"},
+	}
+	jailed := expected
+	jailed.Type = eventJailed
+	assert.Equal(t, []auditRecord{expected, jailed}, records)
+}
+
+func TestNew_AuditLogInvalidPath(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.AuditLog = true
+	config.AuditLogPath = filepath.Join(t.TempDir(), "missing", "audit.log")
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
@@ -0,0 +1,312 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies across modsecurity instances.
+const (
+	loadBalancingFailover   = "failover"
+	loadBalancingRoundRobin = "roundRobin"
+	loadBalancingLeastConn  = "leastConn"
+)
+
+// verdictBackend asks a WAF for its verdict on a request, whatever the protocol it speaks. The request body,
+// if any, is read from body.
+type verdictBackend interface {
+	check(req *http.Request, body *bodyBuffer) (*verdict, error)
+}
+
+// httpReplay replays requests to a modsecurity instance over HTTP. url is the base URL of its requests,
+// without a trailing slash, which differs from the configured one for unix sockets.
+type httpReplay struct {
+	m   *Modsecurity
+	url string
+}
+
+func (r *httpReplay) check(req *http.Request, body *bodyBuffer) (*verdict, error) {
+	return r.m.checkBackend(req, body, r.url)
+}
+
+// newVerdictBackend returns the verdict backend of a modsecurity URL: a SPOP agent for spoe:// URLs,
+// an HTTP replay of the request otherwise.
+func (a *Modsecurity) newVerdictBackend(rawUrl string, sockets unixSockets, config *Config) (verdictBackend, error) {
+	if address, ok := strings.CutPrefix(rawUrl, spoeScheme); ok {
+		if address == "" {
+			return nil, fmt.Errorf("invalid modsecurity URL %q, the agent address is missing", rawUrl)
+		}
+		idleConns := config.MaxIdleConnsPerHost
+		if idleConns <= 0 {
+			idleConns = http.DefaultMaxIdleConnsPerHost
+		}
+		application := config.SpoeApplication
+		if application == "" {
+			application = "default"
+		}
+		client := newSpoeClient(address, millisOrDefault(config.DialTimeoutMillis, 30*time.Second), idleConns)
+		client.resolver = a.resolver
+		return &spoeBackend{m: a, client: client, application: application}, nil
+	}
+
+	target, err := sockets.target(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if target, err = replayBaseUrl(target); err != nil {
+		return nil, err
+	}
+	return &httpReplay{m: a, url: target}, nil
+}
+
+// replayBaseUrl returns the URL the request paths are appended to, so that a modsecurity URL such as
+// http://waf:8080/waf-check/ replays /login as /waf-check/login.
+func replayBaseUrl(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid modsecurity URL %q: %s", rawUrl, err.Error())
+	}
+	if u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", fmt.Errorf("invalid modsecurity URL %q, it cannot have a query or a fragment", rawUrl)
+	}
+	return strings.TrimRight(rawUrl, "/"), nil
+}
+
+// backendPools returns the default modsecurity instances and those of the hosts in hostBackendMap.
+func (a *Modsecurity) backendPools() []*backendPool {
+	pools := []*backendPool{a.backends}
+	for _, pool := range a.hostBackends {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// backendsFor returns the modsecurity instances checking a request: those of its host in hostBackendMap, matched
+// exactly or by a *.domain wildcard, or the default ones.
+func (a *Modsecurity) backendsFor(req *http.Request) *backendPool {
+	if len(a.hostBackends) == 0 {
+		return a.backends
+	}
+
+	host := requestHost(req)
+	if pool, ok := a.hostBackends[host]; ok {
+		return pool
+	}
+	for domain := host; ; {
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return a.backends
+		}
+		if pool, ok := a.hostBackends["*."+parent]; ok {
+			return pool
+		}
+		domain = parent
+	}
+}
+
+// requestHost returns the host of a request, lowercased and without its port.
+func requestHost(req *http.Request) string {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// backend a modsecurity instance the plugin forwards requests to, through its verdict backend.
+type backend struct {
+	url      string
+	verdicts verdictBackend
+	inFlight int64
+
+	mu               sync.Mutex
+	failures         int
+	downUntil        time.Time
+	unreachableUntil time.Time
+	unreachableErr   error
+	// probeErr the error of the last failed health check, nil once one passes
+	probeErr error
+}
+
+func (b *backend) isHealthy(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !now.Before(b.downUntil) && b.probeErr == nil
+}
+
+// begin and end track the requests in flight to the backend, for least-connections balancing.
+func (b *backend) begin() { atomic.AddInt64(&b.inFlight, 1) }
+func (b *backend) end()   { atomic.AddInt64(&b.inFlight, -1) }
+
+// backendPool the modsecurity instances requests are sent to. Requests are spread over the healthy instances
+// according to the load balancing strategy, and an instance that fails maxFailures times in a row is ejected
+// for the cooldown period while the others take over.
+type backendPool struct {
+	backends      []*backend
+	strategy      string
+	maxFailures   int
+	cooldown      time.Duration
+	nowFn         func() time.Time
+	roundRobinIdx uint64
+}
+
+func newBackendPool(urls []string, strategy string, maxFailures int, cooldown time.Duration) (*backendPool, error) {
+	switch strategy {
+	case "":
+		strategy = loadBalancingFailover
+	case loadBalancingFailover, loadBalancingRoundRobin, loadBalancingLeastConn:
+	default:
+		return nil, fmt.Errorf("invalid backendLoadBalancing %q, must be failover, roundRobin or leastConn", strategy)
+	}
+	if maxFailures <= 0 {
+		maxFailures = 1
+	}
+
+	pool := &backendPool{strategy: strategy, maxFailures: maxFailures, cooldown: cooldown, nowFn: time.Now}
+	for _, url := range urls {
+		pool.backends = append(pool.backends, &backend{url: url})
+	}
+	return pool, nil
+}
+
+// candidates returns the backends in the order they should be tried: healthy ones first, in the order of the
+// load balancing strategy, then the ejected ones as a last resort so that a request is never refused without trying.
+func (p *backendPool) candidates() []*backend {
+	now := p.nowFn()
+	healthy := make([]*backend, 0, len(p.backends))
+	var unhealthy []*backend
+	for _, b := range p.backends {
+		if b.isHealthy(now) {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	switch p.strategy {
+	case loadBalancingRoundRobin:
+		if n := len(healthy); n > 1 {
+			start := int((atomic.AddUint64(&p.roundRobinIdx, 1) - 1) % uint64(n))
+			healthy = append(healthy[start:], healthy[:start]...)
+		}
+	case loadBalancingLeastConn:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return atomic.LoadInt64(&healthy[i].inFlight) < atomic.LoadInt64(&healthy[j].inFlight)
+		})
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// reportFailure counts a failure of the backend, and ejects it for the cooldown period once it failed
+// maxFailures times in a row.
+func (p *backendPool) reportFailure(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= p.maxFailures {
+		b.downUntil = p.nowFn().Add(p.cooldown)
+	}
+}
+
+// reportSuccess marks a backend as healthy again.
+func (p *backendPool) reportSuccess(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.downUntil = time.Time{}
+}
+
+// reportUnreachable remembers for ttl that the backend could not be connected to.
+func (p *backendPool) reportUnreachable(b *backend, err error, ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.unreachableUntil = p.nowFn().Add(ttl)
+	b.unreachableErr = err
+}
+
+// unreachable returns the error the backend could not be connected to with, while it is remembered, nil otherwise.
+func (p *backendPool) unreachable(b *backend) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p.nowFn().Before(b.unreachableUntil) {
+		return b.unreachableErr
+	}
+	return nil
+}
+
+// isConnectFailure reports whether err is a failure to connect to a backend, as opposed to one met once connected.
+func isConnectFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// modSecurityUrls merges modSecurityUrl, which may hold a comma-separated list, and modSecurityUrls.
+func modSecurityUrls(config *Config) []string {
+	return splitUrls(append([]string{config.ModSecurityUrl}, config.ModSecurityUrls...))
+}
+
+// splitUrls returns the URLs of comma-separated lists, leaving out blank ones.
+func splitUrls(values []string) []string {
+	var urls []string
+	for _, value := range values {
+		for _, url := range strings.Split(value, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// wafAuthHeader returns the header carrying the credentials attached to the requests to modsecurity, from
+// wafAuthHeader, wafBearerToken or wafBasicAuth, of which at most one can be set. name is empty when none is.
+func wafAuthHeader(config *Config) (name, value string, err error) {
+	set := 0
+	for _, v := range []string{config.WafAuthHeader, config.WafBearerToken, config.WafBasicAuth} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", "", fmt.Errorf("only one of wafAuthHeader, wafBearerToken and wafBasicAuth can be set")
+	}
+
+	switch {
+	case config.WafAuthHeader != "":
+		name, value, ok := strings.Cut(config.WafAuthHeader, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return "", "", fmt.Errorf("invalid wafAuthHeader, must be Name: value")
+		}
+		return http.CanonicalHeaderKey(name), strings.TrimSpace(value), nil
+	case config.WafBearerToken != "":
+		return "Authorization", "Bearer " + config.WafBearerToken, nil
+	case config.WafBasicAuth != "":
+		if !strings.Contains(config.WafBasicAuth, ":") {
+			return "", "", fmt.Errorf("invalid wafBasicAuth, must be user:password")
+		}
+		return "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(config.WafBasicAuth)), nil
+	}
+	return "", "", nil
+}
+
+// setWafAuth attaches the modsecurity credentials to a request, replacing the header of the same name, if any.
+func (a *Modsecurity) setWafAuth(h http.Header) {
+	if a.wafAuthName != "" {
+		h.Set(a.wafAuthName, a.wafAuthValue)
+	}
+}
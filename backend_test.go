@@ -0,0 +1,484 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModSecurityUrls(t *testing.T) {
+	assert.Equal(t, []string{"http://waf1:8080", "http://waf2:8080", "http://waf3:8080"}, modSecurityUrls(&Config{
+		ModSecurityUrl:  "http://waf1:8080, http://waf2:8080",
+		ModSecurityUrls: []string{"http://waf3:8080", ""},
+	}))
+	assert.Empty(t, modSecurityUrls(&Config{}))
+}
+
+func TestBackendPool_Candidates(t *testing.T) {
+	now := time.Now()
+	pool, err := newBackendPool([]string{"http://waf1", "http://waf2", "http://waf3"}, "failover", 1, 10*time.Second)
+	assert.NoError(t, err)
+	pool.nowFn = func() time.Time { return now }
+	urls := func() []string { return candidateUrls(pool) }
+
+	assert.Equal(t, []string{"http://waf1", "http://waf2", "http://waf3"}, urls())
+
+	pool.reportFailure(pool.backends[0])
+	assert.Equal(t, []string{"http://waf2", "http://waf3", "http://waf1"}, urls())
+
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, []string{"http://waf1", "http://waf2", "http://waf3"}, urls())
+
+	pool.reportFailure(pool.backends[1])
+	pool.reportSuccess(pool.backends[1])
+	assert.Equal(t, []string{"http://waf1", "http://waf2", "http://waf3"}, urls())
+}
+
+func TestBackendPool_RoundRobin(t *testing.T) {
+	pool, err := newBackendPool([]string{"http://waf1", "http://waf2", "http://waf3"}, "roundRobin", 1, 10*time.Second)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"http://waf1", "http://waf2", "http://waf3"}, candidateUrls(pool))
+	assert.Equal(t, []string{"http://waf2", "http://waf3", "http://waf1"}, candidateUrls(pool))
+	assert.Equal(t, []string{"http://waf3", "http://waf1", "http://waf2"}, candidateUrls(pool))
+
+	// Ejected backends are left out of the rotation
+	pool.reportFailure(pool.backends[1])
+	assert.Equal(t, []string{"http://waf3", "http://waf1", "http://waf2"}, candidateUrls(pool))
+	assert.Equal(t, []string{"http://waf1", "http://waf3", "http://waf2"}, candidateUrls(pool))
+}
+
+func TestBackendPool_LeastConn(t *testing.T) {
+	pool, err := newBackendPool([]string{"http://waf1", "http://waf2", "http://waf3"}, "leastConn", 1, 10*time.Second)
+	assert.NoError(t, err)
+
+	pool.backends[0].begin()
+	pool.backends[0].begin()
+	pool.backends[1].begin()
+	assert.Equal(t, []string{"http://waf3", "http://waf2", "http://waf1"}, candidateUrls(pool))
+
+	pool.backends[0].end()
+	pool.backends[0].end()
+	assert.Equal(t, []string{"http://waf1", "http://waf3", "http://waf2"}, candidateUrls(pool))
+}
+
+func TestBackendPool_MaxFailures(t *testing.T) {
+	pool, err := newBackendPool([]string{"http://waf1", "http://waf2"}, "failover", 3, 10*time.Second)
+	assert.NoError(t, err)
+
+	pool.reportFailure(pool.backends[0])
+	pool.reportFailure(pool.backends[0])
+	assert.Equal(t, []string{"http://waf1", "http://waf2"}, candidateUrls(pool))
+
+	// A success in between resets the count
+	pool.reportSuccess(pool.backends[0])
+	pool.reportFailure(pool.backends[0])
+	pool.reportFailure(pool.backends[0])
+	assert.Equal(t, []string{"http://waf1", "http://waf2"}, candidateUrls(pool))
+
+	pool.reportFailure(pool.backends[0])
+	assert.Equal(t, []string{"http://waf2", "http://waf1"}, candidateUrls(pool))
+}
+
+func TestBackendPool_InvalidStrategy(t *testing.T) {
+	_, err := newBackendPool([]string{"http://waf1"}, "random", 1, 10*time.Second)
+	assert.Error(t, err)
+}
+
+func candidateUrls(pool *backendPool) []string {
+	var urls []string
+	for _, b := range pool.candidates() {
+		urls = append(urls, b.url)
+	}
+	return urls
+}
+
+func TestModsecurity_Failover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	var upCalls int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upCalls, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer up.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = down.URL
+	config.ModSecurityUrls = []string{up.URL}
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+		assert.Equal(t, http.StatusForbidden, rw.Result().StatusCode)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&upCalls))
+
+	// The failing backend is now skipped
+	a := middleware.(*Modsecurity)
+	assert.Equal(t, up.URL, a.backends.candidates()[0].url)
+}
+
+func TestModsecurity_ConnectFailureCache(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = down.URL
+	config.ConnectFailureCacheMillis = 2000
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+	now := time.Now()
+	a.backends.nowFn = func() time.Time { return now }
+
+	serve := func() {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+		assert.Equal(t, http.StatusBadGateway, rw.Code)
+	}
+
+	// The connection failure is remembered, the next requests fail without trying to connect
+	serve()
+	assert.True(t, isConnectFailure(a.backends.unreachable(a.backends.backends[0])))
+	serve()
+	serve()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&a.metrics.modsecRequests))
+
+	now = now.Add(2 * time.Second)
+	assert.NoError(t, a.backends.unreachable(a.backends.backends[0]))
+	serve()
+	assert.Equal(t, int64(2), atomic.LoadInt64(&a.metrics.modsecRequests))
+}
+
+func TestIsConnectFailure(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	_, err := http.Get(down.URL)
+	assert.True(t, isConnectFailure(fmt.Errorf("fail to send HTTP request to modsec: %w", err)))
+
+	assert.False(t, isConnectFailure(context.DeadlineExceeded))
+	assert.False(t, isConnectFailure(errors.New("modsec returned 502")))
+}
+
+// verdictBackendStub answers every request with the same verdict or error.
+type verdictBackendStub struct {
+	v     *verdict
+	err   error
+	calls int32
+}
+
+func (s *verdictBackendStub) check(req *http.Request, body *bodyBuffer) (*verdict, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return s.v, s.err
+}
+
+func TestModsecurity_VerdictBackends(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrls = []string{"http://waf1", "spoe://waf2:9000", "unix:///var/run/modsec.sock"}
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+
+	assert.Equal(t, &httpReplay{m: a, url: "http://waf1"}, a.backends.backends[0].verdicts)
+	assert.IsType(t, &spoeBackend{}, a.backends.backends[1].verdicts)
+	assert.Equal(t, "default", a.backends.backends[1].verdicts.(*spoeBackend).application)
+	assert.Equal(t, &httpReplay{m: a, url: "http://modsecurity-unix-0"}, a.backends.backends[2].verdicts)
+
+	// Verdicts come from whatever backend answers first
+	failing := &verdictBackendStub{err: errors.New("unreachable")}
+	blocking := &verdictBackendStub{v: &verdict{StatusCode: http.StatusForbidden}}
+	a.backends.backends[0].verdicts = failing
+	a.backends.backends[1].verdicts = blocking
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failing.calls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&blocking.calls))
+}
+
+func TestModsecurity_HostBackendMap(t *testing.T) {
+	newWaf := func(status int, calls *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			w.WriteHeader(status)
+		}))
+	}
+	var defaultCalls, app1Calls, tenantCalls int32
+	defaultWaf := newWaf(http.StatusOK, &defaultCalls)
+	defer defaultWaf.Close()
+	app1Waf := newWaf(http.StatusForbidden, &app1Calls)
+	defer app1Waf.Close()
+	tenantWaf := newWaf(http.StatusNotAcceptable, &tenantCalls)
+	defer tenantWaf.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = defaultWaf.URL
+	config.HostBackendMap = map[string]string{
+		"App1.example.com": app1Waf.URL,
+		"*.tenant.example": tenantWaf.URL + ", " + defaultWaf.URL,
+	}
+	config.CacheEnabled = true
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		host         string
+		expectStatus int
+		expectCalls  *int32
+	}{
+		{host: "app1.example.com", expectStatus: http.StatusForbidden, expectCalls: &app1Calls},
+		{host: "APP1.example.com:8443", expectStatus: http.StatusForbidden, expectCalls: &app1Calls},
+		{host: "a.tenant.example", expectStatus: http.StatusNotAcceptable, expectCalls: &tenantCalls},
+		{host: "b.a.tenant.example", expectStatus: http.StatusNotAcceptable, expectCalls: &tenantCalls},
+		{host: "tenant.example", expectStatus: http.StatusOK, expectCalls: &defaultCalls},
+		{host: "app2.example.com", expectStatus: http.StatusOK, expectCalls: &defaultCalls},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			before := atomic.LoadInt32(tt.expectCalls)
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.Host = tt.host
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, before+1, atomic.LoadInt32(tt.expectCalls))
+		})
+	}
+}
+
+func TestNew_HostBackendMapWithoutUrl(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.HostBackendMap = map[string]string{"app1.example.com": " , "}
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestReplayBaseUrl(t *testing.T) {
+	tests := []struct {
+		url       string
+		expectUrl string
+		expectErr bool
+	}{
+		{url: "http://waf:8080", expectUrl: "http://waf:8080"},
+		{url: "http://waf:8080/", expectUrl: "http://waf:8080"},
+		{url: "http://waf:8080/waf-check", expectUrl: "http://waf:8080/waf-check"},
+		{url: "http://waf:8080/waf-check/", expectUrl: "http://waf:8080/waf-check"},
+		{url: "http://waf:8080/waf%20check/", expectUrl: "http://waf:8080/waf%20check"},
+		{url: "http://waf:8080/waf-check?tenant=a", expectErr: true},
+		{url: "http://waf:8080/waf-check?", expectErr: true},
+		{url: "http://waf:8080/#check", expectErr: true},
+		{url: "http://waf:8080/%zz", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		url, err := replayBaseUrl(tt.url)
+		if tt.expectErr {
+			assert.Error(t, err, tt.url)
+			continue
+		}
+		assert.NoError(t, err, tt.url)
+		assert.Equal(t, tt.expectUrl, url, tt.url)
+	}
+}
+
+func TestModsecurity_UrlPathPrefix(t *testing.T) {
+	var requestURI string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL + "/waf-check/"
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	for target, expectURI := range map[string]string{
+		"/":               "/waf-check/",
+		"/login?next=%2F": "/waf-check/login?next=%2F",
+		"/a%2Fb;c":        "/waf-check/a%2Fb;c",
+	} {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, expectURI, requestURI, target)
+	}
+
+	config.ModSecurityUrl = modsecurityMockServer.URL + "/waf-check?tenant=a"
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestWafAuthHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		expectName  string
+		expectValue string
+		expectErr   bool
+	}{
+		{name: "none"},
+		{name: "header", config: Config{WafAuthHeader: "x-api-key: secret"}, expectName: "X-Api-Key", expectValue: "secret"},
+		{name: "bearer", config: Config{WafBearerToken: "secret"}, expectName: "Authorization", expectValue: "Bearer secret"},
+		{name: "basic", config: Config{WafBasicAuth: "waf:secret"}, expectName: "Authorization", expectValue: "Basic d2FmOnNlY3JldA=="},
+		{name: "header without value", config: Config{WafAuthHeader: "X-Api-Key"}, expectErr: true},
+		{name: "basic without password", config: Config{WafBasicAuth: "waf"}, expectErr: true},
+		{name: "several", config: Config{WafBearerToken: "secret", WafBasicAuth: "waf:secret"}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, value, err := wafAuthHeader(&tt.config)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectName, name)
+			assert.Equal(t, tt.expectValue, value)
+		})
+	}
+}
+
+func TestModsecurity_WafAuth(t *testing.T) {
+	var auths []string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.WafBearerToken = "secret"
+
+	var upstreamAuth string
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = r.Header.Get("Authorization")
+	}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// The credentials replace the client's on the request to modsecurity only
+	req := httptest.NewRequest(http.MethodGet, "/website", nil)
+	req.Header.Set("Authorization", "Basic Y2xpZW50OnBhc3M=")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{"Bearer secret"}, auths)
+	assert.Equal(t, "Basic Y2xpZW50OnBhc3M=", upstreamAuth)
+}
+
+func TestModsecurity_WafExtraHeaders(t *testing.T) {
+	var wafHeader http.Header
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafHeader = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.WafExtraHeaders = map[string]string{"X-Tenant-ID": "acme", "x-paranoia-level": "2"}
+	config.ForwardOnlyHeaders = []string{"User-Agent"}
+
+	var nextHeader http.Header
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextHeader = r.Header
+	}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// The client can't choose the values modsecurity gets
+	req := httptest.NewRequest(http.MethodGet, "/website", nil)
+	req.Header.Set("X-Tenant-ID", "other")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{"acme"}, wafHeader.Values("X-Tenant-Id"))
+	assert.Equal(t, "2", wafHeader.Get("X-Paranoia-Level"))
+	assert.Equal(t, "other", nextHeader.Get("X-Tenant-ID"))
+	assert.Empty(t, nextHeader.Get("X-Paranoia-Level"))
+}
+
+func TestModsecurity_WafMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		value         string
+		detectionOnly bool
+		expectMode    string
+		expectErr     bool
+	}{
+		{name: "disabled"},
+		{name: "default", header: "X-Waf-Mode", expectMode: "On"},
+		{name: "plugin in detection only", header: "X-Waf-Mode", detectionOnly: true, expectMode: "DetectionOnly"},
+		{name: "explicit", header: "X-Waf-Mode", value: "detectiononly", expectMode: "DetectionOnly"},
+		{name: "invalid value", header: "X-Waf-Mode", value: "Off", expectErr: true},
+		{name: "value without header", value: "On", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafHeader http.Header
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafHeader = r.Header
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.WafModeHeader = tt.header
+			config.WafModeValue = tt.value
+			config.DetectionOnly = tt.detectionOnly
+
+			middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/website", nil)
+			req.Header.Set("X-Waf-Mode", "Off")
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+			if tt.expectMode == "" {
+				assert.Equal(t, "Off", wafHeader.Get("X-Waf-Mode"))
+			} else {
+				assert.Equal(t, []string{tt.expectMode}, wafHeader.Values("X-Waf-Mode"))
+			}
+		})
+	}
+}
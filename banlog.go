@@ -0,0 +1,45 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// banLog appends a line for every client put in jail, in a format fail2ban filters can parse, so that host
+// firewalls drop jailed clients before they reach Traefik.
+type banLog struct {
+	mu         sync.Mutex
+	out        io.Writer
+	middleware string
+	nowFn      func() time.Time
+}
+
+// newBanLog opens the ban log, appending to the file at path. The file is closed once ctx is done.
+func newBanLog(ctx context.Context, path, middleware string) (*banLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	return &banLog{out: f, middleware: middleware, nowFn: time.Now}, nil
+}
+
+// write records the ban of a client, or of a subnet, until the given time. The date is local time, as fail2ban
+// expects it by default.
+func (l *banLog) write(clientIP string, until time.Time) {
+	now := l.nowFn()
+	secs := int64(math.Ceil(until.Sub(now).Seconds()))
+	line := fmt.Sprintf("%s traefik-modsecurity[%s]: Ban %s for %ds\n", now.Format("2006-01-02 15:04:05"), l.middleware, clientIP, secs)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
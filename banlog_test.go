@@ -0,0 +1,91 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanLog_Write(t *testing.T) {
+	var out strings.Builder
+	now := time.Date(2026, 10, 15, 14, 3, 12, 0, time.Local)
+	l := &banLog{out: &out, middleware: "waf@file", nowFn: func() time.Time { return now }}
+
+	l.write("198.51.100.7", now.Add(600*time.Second))
+	l.write("2001:db8::/64", now.Add(1500*time.Millisecond))
+
+	assert.Equal(t, "2026-10-15 14:03:12 traefik-modsecurity[waf@file]: Ban 198.51.100.7 for 600s\n"+
+		"2026-10-15 14:03:12 traefik-modsecurity[waf@file]: Ban 2001:db8::/64 for 2s\n", out.String())
+}
+
+func TestModsecurity_BanLog(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	path := filepath.Join(t.TempDir(), "bans.log")
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.BanLogPath = path
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 2
+	config.JailSubnetThresholdCount = 3
+	config.JailTimeDurationSecs = 600
+	config.AdminPath = "/admin"
+	config.AdminToken = "secret"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	middleware, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "waf@file")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func(remoteAddr string) {
+		req := httptest.NewRequest(http.MethodGet, "/attack", nil)
+		req.RemoteAddr = remoteAddr
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// The first client is jailed on its second offense, its subnet on the third one of the subnet
+	serve("198.51.100.1:1234")
+	serve("198.51.100.1:1234")
+	serve("198.51.100.2:1234")
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/jail", strings.NewReader(`{"clientIP":"203.0.113.9","durationSecs":60}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read ban log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} traefik-modsecurity\[waf@file\]: Ban 198\.51\.100\.1 for 600s$`),
+		regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} traefik-modsecurity\[waf@file\]: Ban 198\.51\.100\.0/24 for 600s$`),
+		regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} traefik-modsecurity\[waf@file\]: Ban 203\.0\.113\.9 for 60s$`),
+	}
+	if assert.Len(t, lines, len(expected)) {
+		for i, re := range expected {
+			assert.Regexp(t, re, lines[i])
+		}
+	}
+}
+
+func TestNew_BanLogWithoutJail(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.BanLogPath = filepath.Join(t.TempDir(), "bans.log")
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
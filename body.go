@@ -0,0 +1,330 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// maxPooledBufferSize buffers that grew bigger than this are left to the garbage collector
+// instead of going back to the pool, so a single large upload doesn't pin memory forever.
+const maxPooledBufferSize = 1 << 20
+
+// errBodyTooLarge the request body is bigger than maxBodySize.
+var errBodyTooLarge = errors.New("request body too large")
+
+// errReleasedBody a bodyBuffer is read after it was released.
+var errReleasedBody = errors.New("read on a released body")
+
+// bodyBufferTiers capacities of the pooled buffers. A body of known size gets a buffer from the smallest tier it
+// fits in, so that it is captured without the buffer growing, a body of unknown size the smallest pooled one.
+var bodyBufferTiers = []int{4 << 10, 32 << 10, 256 << 10, maxPooledBufferSize}
+
+// bodyBufferPools a pool of buffers for every tier.
+var bodyBufferPools = newBodyBufferPools()
+
+func newBodyBufferPools() []*sync.Pool {
+	pools := make([]*sync.Pool, len(bodyBufferTiers))
+	for i := range pools {
+		pools[i] = &sync.Pool{}
+	}
+	return pools
+}
+
+// getBodyBuffer returns an empty buffer able to hold size bytes without growing, as long as the size fits in a tier.
+func getBodyBuffer(size int64) *bytes.Buffer {
+	if size < 0 {
+		for _, pool := range bodyBufferPools {
+			if buf, ok := pool.Get().(*bytes.Buffer); ok {
+				buf.Reset()
+				return buf
+			}
+		}
+		return bytes.NewBuffer(make([]byte, 0, bodyBufferTiers[0]))
+	}
+
+	tier := len(bodyBufferTiers) - 1
+	for i, capacity := range bodyBufferTiers {
+		if size <= int64(capacity) {
+			tier = i
+			break
+		}
+	}
+	if buf, ok := bodyBufferPools[tier].Get().(*bytes.Buffer); ok {
+		buf.Reset()
+		return buf
+	}
+	return bytes.NewBuffer(make([]byte, 0, bodyBufferTiers[tier]))
+}
+
+// putBodyBuffer recycles a buffer into the largest tier it can hold.
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	for i := len(bodyBufferTiers) - 1; i >= 0; i-- {
+		if buf.Cap() >= bodyBufferTiers[i] {
+			bodyBufferPools[i].Put(buf)
+			return
+		}
+	}
+}
+
+// bodyBuffer captures a request body while it is streamed to modsecurity, so the very same bytes can be
+// replayed to the next handler once the verdict is known. The body is read a single time, into a single
+// pooled buffer, and reading stops with errBodyTooLarge as soon as the limit is exceeded.
+//
+// Every reader created by NewReader starts from the beginning of the body: bytes that were already captured
+// are served from memory, the rest is pulled from the source and captured on the way. Readers are safe to use
+// concurrently, which matters because the http.Transport may still be writing the body to modsecurity after
+// the response has been received.
+//
+// The buffer goes back to the pool once the owner called release and every reader has been closed.
+// With spillAbove, bodies bigger than a memory limit are captured to a temporary file instead, which is
+// removed at that same time.
+type bodyBuffer struct {
+	mu sync.Mutex
+	// readMu serializes the reads from src, which happen without mu held so that a stalled client doesn't
+	// block the readers of what was already captured, nor Close
+	readMu   sync.Mutex
+	src      io.Reader
+	limit    int64
+	buf      *bytes.Buffer
+	err      error
+	refs     int
+	size     int64
+	memLimit int64
+	tempDir  string
+	file     *os.File
+}
+
+// newBodyBuffer creates a bodyBuffer over src, limit is the maximum body size in bytes, 0 means no limit.
+func newBodyBuffer(src io.Reader, limit int64) *bodyBuffer {
+	return newSizedBodyBuffer(src, limit, -1)
+}
+
+// newSizedBodyBuffer creates a bodyBuffer over a body of size bytes, -1 when unknown, captured in a pooled buffer
+// of the matching tier.
+func newSizedBodyBuffer(src io.Reader, limit int64, size int64) *bodyBuffer {
+	if limit > 0 && size > limit {
+		size = limit
+	}
+	return &bodyBuffer{src: src, limit: limit, buf: getBodyBuffer(size), refs: 1}
+}
+
+// spillAbove captures the body to a temporary file in dir, the default temporary directory when empty,
+// as soon as it gets bigger than memLimit bytes.
+func (b *bodyBuffer) spillAbove(memLimit int64, dir string) {
+	b.memLimit = memLimit
+	b.tempDir = dir
+}
+
+// NewReader returns a reader replaying the body from its start.
+func (b *bodyBuffer) NewReader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refs++
+	return &bodyReader{buffer: b}
+}
+
+// newReaderUpTo returns a reader replaying the first n bytes of the body, the whole body when n is 0.
+func (b *bodyBuffer) newReaderUpTo(n int64) io.ReadCloser {
+	r := b.NewReader()
+	if n <= 0 {
+		return r
+	}
+	return &limitedBodyReader{Reader: io.LimitReader(r, n), Closer: r}
+}
+
+// limitedBodyReader a bodyReader stopping before the end of the body.
+type limitedBodyReader struct {
+	io.Reader
+	io.Closer
+}
+
+// retain takes another owner reference, for an owner outliving the request, given up with release too.
+func (b *bodyBuffer) retain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refs++
+}
+
+// release gives up the owner reference, the buffer is recycled once every reader is closed too.
+func (b *bodyBuffer) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.unref()
+}
+
+func (b *bodyBuffer) unref() {
+	b.refs--
+	if b.refs > 0 || b.buf == nil {
+		return
+	}
+	putBodyBuffer(b.buf)
+	b.buf = nil
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
+
+// fill reads the whole source, so that the body length is known before the body is sent, and returns that length.
+func (b *bodyBuffer) fill() (int64, error) {
+	r := b.NewReader()
+	defer r.Close()
+
+	return io.Copy(io.Discard, r)
+}
+
+// overflowReader returns a reader over the whole body once it exceeded the limit: the bytes captured so far, then
+// the rest of the source without any limit. It must not be used after release.
+func (b *bodyBuffer) overflowReader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var captured io.Reader = bytes.NewReader(b.buf.Bytes())
+	if b.file != nil {
+		captured = io.NewSectionReader(b.file, 0, b.size)
+	}
+	return io.NopCloser(io.MultiReader(captured, b.src))
+}
+
+// readErr returns the error met while reading the source, if it is anything else than the end of the body.
+func (b *bodyBuffer) readErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err == nil || errors.Is(b.err, io.EOF) {
+		return nil
+	}
+	return b.err
+}
+
+func (b *bodyBuffer) readAt(p []byte, off int) (int, error) {
+	if n, done, err := b.readKnown(p, off); done {
+		return n, err
+	}
+
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+
+	// Another reader may have read from the source while this one waited
+	if n, done, err := b.readKnown(p, off); done {
+		return n, err
+	}
+	n, err := b.src.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.buf == nil {
+		return 0, errReleasedBody
+	}
+	// The bytes read past the limit are kept all the same, overflowReader replays them
+	if captureErr := b.capture(p[:n]); captureErr != nil {
+		b.err = captureErr
+		return 0, b.err
+	}
+	if b.limit > 0 && b.size > b.limit {
+		b.err = errBodyTooLarge
+		return 0, b.err
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// readKnown reads bytes that were already captured, or returns the error the source ended with. done is false
+// when the source must be read further.
+func (b *bodyBuffer) readKnown(p []byte, off int) (n int, done bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.buf == nil {
+		return 0, true, errReleasedBody
+	}
+	if int64(off) < b.size {
+		n, err = b.readCaptured(p, int64(off))
+		return n, true, err
+	}
+	if b.err != nil {
+		return 0, true, b.err
+	}
+	return 0, false, nil
+}
+
+// readCaptured reads bytes that were already captured, from memory or from the temporary file.
+func (b *bodyBuffer) readCaptured(p []byte, off int64) (int, error) {
+	if b.file == nil {
+		return copy(p, b.buf.Bytes()[off:]), nil
+	}
+	if remaining := b.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.file.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// capture appends bytes read from the source, moving the body to a temporary file once it gets bigger than memLimit.
+func (b *bodyBuffer) capture(p []byte) error {
+	if b.file == nil && b.memLimit > 0 && int64(b.buf.Len()+len(p)) > b.memLimit {
+		f, err := os.CreateTemp(b.tempDir, "traefik-modsecurity-body-")
+		if err != nil {
+			return fmt.Errorf("fail to spill body to disk: %w", err)
+		}
+		if _, err := f.Write(b.buf.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("fail to spill body to disk: %w", err)
+		}
+		b.file = f
+		b.buf.Reset()
+	}
+
+	if b.file != nil {
+		if _, err := b.file.Write(p); err != nil {
+			return fmt.Errorf("fail to spill body to disk: %w", err)
+		}
+	} else {
+		b.buf.Write(p)
+	}
+	b.size += int64(len(p))
+	return nil
+}
+
+// bodyReader a reader over a bodyBuffer with its own offset.
+type bodyReader struct {
+	buffer *bodyBuffer
+	off    int
+	closed bool
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.buffer.readAt(p, r.off)
+	r.off += n
+	return n, err
+}
+
+// Close releases the reader reference, the source body is owned and closed by the http.Server.
+func (r *bodyReader) Close() error {
+	r.buffer.mu.Lock()
+	defer r.buffer.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		r.buffer.unref()
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package traefik_modsecurity_plugin
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen modsecurity is not called because the circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker states.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops calling modsecurity once it failed threshold times in a row, so that requests are answered
+// right away instead of each waiting for the timeout. After openDuration a single probe request is let through:
+// its success closes the circuit, its failure opens it again for another openDuration.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	openDuration time.Duration
+	nowFn        func() time.Time
+	logger       *logger
+
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration, logger *logger) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, openDuration: openDuration, nowFn: time.Now, logger: logger}
+}
+
+// allow reports whether a request may be sent to modsecurity.
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		if c.nowFn().Sub(c.openedAt) < c.openDuration {
+			return false
+		}
+		c.state = circuitHalfOpen
+		c.probing = true
+		c.logger.Info("circuit breaker half-open, probing modsec")
+		return true
+	case circuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+	return true
+}
+
+// success records a successful call, closing the circuit.
+func (c *circuitBreaker) success() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != circuitClosed {
+		c.logger.Info("circuit breaker closed")
+	}
+	c.state = circuitClosed
+	c.failures = 0
+	c.probing = false
+}
+
+// failure records a failed call, opening the circuit once threshold failures happened in a row or when the probe failed.
+func (c *circuitBreaker) failure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.threshold {
+		if c.state != circuitOpen {
+			c.logger.Warn("circuit breaker opened", "failures", c.failures, "openFor", c.openDuration.String())
+		}
+		c.state = circuitOpen
+		c.openedAt = c.nowFn()
+		c.probing = false
+	}
+}
+
+// status returns the state of the circuit: closed, open or halfOpen.
+func (c *circuitBreaker) status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "halfOpen"
+	}
+	return "closed"
+}
+
+// abort records a call that ended without telling anything about modsecurity health, e.g. the client went away,
+// so another probe can be let through.
+func (c *circuitBreaker) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probing = false
+}
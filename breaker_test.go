@@ -0,0 +1,90 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker_States(t *testing.T) {
+	now := time.Now()
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	breaker := newCircuitBreaker(2, 30*time.Second, l)
+	breaker.nowFn = func() time.Time { return now }
+
+	assert.True(t, breaker.allow())
+	breaker.failure()
+	assert.True(t, breaker.allow())
+	breaker.failure()
+	assert.False(t, breaker.allow())
+
+	// A single probe is let through once the circuit was open long enough
+	now = now.Add(30 * time.Second)
+	assert.True(t, breaker.allow())
+	assert.False(t, breaker.allow())
+
+	// A failed probe opens the circuit again
+	breaker.failure()
+	assert.False(t, breaker.allow())
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, breaker.allow())
+	breaker.abort()
+	assert.True(t, breaker.allow())
+	breaker.success()
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.allow())
+}
+
+func TestModsecurity_CircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name         string
+		failOpen     bool
+		expectStatus int
+	}{
+		{name: "Answers service unavailable while the circuit is open", failOpen: false, expectStatus: http.StatusServiceUnavailable},
+		{name: "Fails open while the circuit is open", failOpen: true, expectStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafCalls int32
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&wafCalls, 1)
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer modsecurityMockServer.Close()
+
+			httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.FailOpen = tt.failOpen
+			config.CircuitBreakerEnabled = true
+			config.CircuitBreakerThreshold = 2
+			config.BlockStatusCodes = []int{http.StatusForbidden}
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			assert.Equal(t, tt.expectStatus, rw.Result().StatusCode)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&wafCalls))
+		})
+	}
+}
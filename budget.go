@@ -0,0 +1,84 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bufferBudget bounds the bytes of the request bodies buffered across the requests in flight. A request reserves
+// the size of its body before buffering it, and gives it back once it is done with it.
+type bufferBudget struct {
+	mu      sync.Mutex
+	used    int64
+	limit   int64
+	maxWait time.Duration
+	freed   chan struct{}
+}
+
+// newBufferBudget bounds the buffered bodies to limit bytes. Requests over the budget wait up to maxWait for
+// others to give theirs back, 0 turns them away straight away.
+func newBufferBudget(limit int64, maxWait time.Duration) *bufferBudget {
+	return &bufferBudget{limit: limit, maxWait: maxWait, freed: make(chan struct{})}
+}
+
+// reserve takes n bytes of the budget, waiting for them when they are given back within maxWait. A body bigger
+// than the whole budget is let through when nothing else is buffered. It reports false when the bytes could not
+// be taken in time or ctx is done first; otherwise release must be called with n once the body is done with.
+func (b *bufferBudget) reserve(ctx context.Context, n int64) bool {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return true
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		if b.maxWait <= 0 {
+			return false
+		}
+		if timer == nil {
+			timer = time.NewTimer(b.maxWait)
+		}
+		select {
+		case <-freed:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release gives back n bytes, waking up the requests waiting for some.
+func (b *bufferBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// bufferedSize returns how many bytes of the request body may be buffered in memory, a body of unknown length
+// being assumed as big as maxBodySize.
+func (a *Modsecurity) bufferedSize(req *http.Request) int64 {
+	size := req.ContentLength
+	if size < 0 || (a.maxBodySize > 0 && size > a.maxBodySize) {
+		size = a.maxBodySize
+	}
+	if a.bodyMemoryLimit > 0 && (size <= 0 || size > a.bodyMemoryLimit) {
+		size = a.bodyMemoryLimit
+	}
+	return size
+}
@@ -0,0 +1,137 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferBudget(t *testing.T) {
+	b := newBufferBudget(100, 0)
+
+	// A body bigger than the whole budget goes through alone
+	assert.True(t, b.reserve(context.Background(), 150))
+	assert.False(t, b.reserve(context.Background(), 1))
+	b.release(150)
+
+	assert.True(t, b.reserve(context.Background(), 60))
+	assert.True(t, b.reserve(context.Background(), 40))
+	assert.False(t, b.reserve(context.Background(), 1))
+	b.release(40)
+	assert.True(t, b.reserve(context.Background(), 40))
+}
+
+func TestBufferBudget_Queue(t *testing.T) {
+	b := newBufferBudget(100, time.Second)
+	assert.True(t, b.reserve(context.Background(), 100))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.release(100)
+	}()
+	start := time.Now()
+	assert.True(t, b.reserve(context.Background(), 100))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, b.reserve(ctx, 100))
+
+	b.maxWait = 50 * time.Millisecond
+	assert.False(t, b.reserve(context.Background(), 100))
+}
+
+func TestModsecurity_MaxTotalBufferedBytes(t *testing.T) {
+	tests := []struct {
+		action       string
+		expectStatus int
+	}{
+		{action: "reject", expectStatus: http.StatusServiceUnavailable},
+		{action: "queue", expectStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			release := make(chan struct{})
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					<-release
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.MaxTotalBufferedBytes = 10
+			config.BufferBudgetAction = tt.action
+
+			middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slow", strings.NewReader("0123456789")))
+			}()
+			// Wait for the slow request to hold the whole budget
+			budget := middleware.(*Modsecurity).bufferBudget
+			assert.Eventually(t, func() bool {
+				budget.mu.Lock()
+				defer budget.mu.Unlock()
+				return budget.used == 10
+			}, time.Second, 5*time.Millisecond)
+
+			// Requests without a body need no budget
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, http.StatusOK, rw.Code)
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(release)
+			}()
+			rw = httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("abc")))
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			<-done
+		})
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.MaxTotalBufferedBytes = 10
+	config.BufferBudgetAction = "bypass"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_BufferedSize(t *testing.T) {
+	tests := []struct {
+		contentLength   int64
+		maxBodySize     int64
+		bodyMemoryLimit int64
+		expectSize      int64
+	}{
+		{contentLength: 100, expectSize: 100},
+		{contentLength: 100, maxBodySize: 50, expectSize: 50},
+		{contentLength: -1, maxBodySize: 50, expectSize: 50},
+		{contentLength: 100, bodyMemoryLimit: 30, expectSize: 30},
+		{contentLength: -1, bodyMemoryLimit: 30, expectSize: 30},
+		{contentLength: -1, expectSize: 0},
+	}
+
+	for _, tt := range tests {
+		a := &Modsecurity{maxBodySize: tt.maxBodySize, bodyMemoryLimit: tt.bodyMemoryLimit}
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.ContentLength = tt.contentLength
+		assert.Equal(t, tt.expectSize, a.bufferedSize(req))
+	}
+}
@@ -0,0 +1,483 @@
+package traefik_modsecurity_plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryCachePurgeInterval how often expired entries are swept from the in-memory cache.
+const memoryCachePurgeInterval = time.Minute
+
+// cacheStatsInterval how often the cache size and hit ratio are logged.
+const cacheStatsInterval = 5 * time.Minute
+
+// verdict the outcome of a modsecurity check, what gets cached.
+// Header and Body are only kept for blocked requests, to replay the modsecurity response.
+// AnomalyScore is only parsed when anomalyScoreThreshold is set, and WafHeader holds the modsecurity
+// response headers selected by forwardWafHeaders. URL, the host and URI of the cache key, is only set on
+// cached verdicts, for the admin API to purge them by URL, and StaleAt, in Unix milliseconds, on the verdicts
+// cached with cacheStaleWhileRevalidateSecs.
+type verdict struct {
+	StatusCode   int         `json:"statusCode"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         []byte      `json:"body,omitempty"`
+	AnomalyScore int         `json:"anomalyScore,omitempty"`
+	WafHeader    http.Header `json:"wafHeader,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	StaleAt      int64       `json:"staleAt,omitempty"`
+}
+
+// verdictCache stores verdicts by cache key. A miss returns a nil verdict and no error. A verdict may be shared
+// by every request it is returned to, callers must not modify it.
+// Purge removes the verdicts match reports true for, every verdict when match is nil, and returns how many.
+type verdictCache interface {
+	Get(key string) (*verdict, error)
+	Set(key string, v *verdict, ttl time.Duration) error
+	Purge(match func(v *verdict) bool) (int, error)
+}
+
+// memoryCache a verdictCache local to the Traefik process, holding up to maxEntries verdicts. Once full,
+// the least recently used verdict makes room for a new one, so that a scanner requesting random URLs can't
+// grow it without bound.
+type memoryCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	maxEntries int
+	nextPurge  time.Time
+	nowFn      func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key     string
+	verdict *verdict
+	expires time.Time
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		nowFn:      time.Now,
+	}
+}
+
+func (c *memoryCache) Get(key string) (*verdict, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if !c.nowFn().Before(entry.expires) {
+		c.remove(elem)
+		return nil, nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.verdict, nil
+}
+
+func (c *memoryCache) Set(key string, v *verdict, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.nowFn()
+	if now.After(c.nextPurge) {
+		for elem := c.lru.Front(); elem != nil; {
+			next := elem.Next()
+			if !now.Before(elem.Value.(*memoryCacheEntry).expires) {
+				c.remove(elem)
+			}
+			elem = next
+		}
+		c.nextPurge = now.Add(memoryCachePurgeInterval)
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*memoryCacheEntry)
+		entry.verdict = v
+		entry.expires = now.Add(ttl)
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, verdict: v, expires: now.Add(ttl)})
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) Purge(match func(v *verdict) bool) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match == nil || match(elem.Value.(*memoryCacheEntry).verdict) {
+			c.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	return purged, nil
+}
+
+// len returns the number of cached verdicts, expired ones included until they are purged.
+func (c *memoryCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *memoryCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*memoryCacheEntry).key)
+}
+
+// redisCache a verdictCache shared by every Traefik replica using the same redis server.
+type redisCache struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisCache(client *redisClient, prefix string) *redisCache {
+	return &redisCache{client: client, prefix: prefix + "verdict:"}
+}
+
+func (c *redisCache) Get(key string) (*verdict, error) {
+	reply, err := c.client.Do("GET", c.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	v := &verdict{}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *redisCache) Set(key string, v *verdict, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Do("SET", c.prefix+key, string(data), "PX", fmt.Sprint(ttl.Milliseconds()))
+	return err
+}
+
+// Purge walks the verdict keys with SCAN, which unlike KEYS doesn't block the redis server.
+func (c *redisCache) Purge(match func(v *verdict) bool) (int, error) {
+	purged := 0
+	cursor := "0"
+	for {
+		reply, err := c.client.Do("SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", "100")
+		if err != nil {
+			return purged, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return purged, fmt.Errorf("redis: unexpected SCAN reply %T", reply)
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			key := strings.TrimPrefix(fmt.Sprint(key), c.prefix)
+			if match != nil {
+				v, err := c.Get(key)
+				if err != nil {
+					return purged, err
+				}
+				if v == nil || !match(v) {
+					continue
+				}
+			}
+			if _, err := c.client.Do("DEL", c.prefix+key); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+		if cursor == "0" || cursor == "" {
+			return purged, nil
+		}
+	}
+}
+
+// isCacheable reports whether the verdict of a request can be cached. Requests with a body never are,
+// since the body is not part of the cache key.
+func (a *Modsecurity) isCacheable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	for _, method := range a.cacheConditionsMethods {
+		if strings.EqualFold(method, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey hashes the parts of the request that identify a verdict.
+func (a *Modsecurity) cacheKey(req *http.Request, clientIP string) string {
+	h := sha256.New()
+	write := func(value string) {
+		io.WriteString(h, value)
+		h.Write([]byte{0})
+	}
+
+	write(req.Method)
+	if a.cacheKeyIncludeHost {
+		write(req.Host)
+	}
+	write(a.cacheKeyURI(req))
+	for _, name := range a.cacheKeyHeaders {
+		write(http.CanonicalHeaderKey(name))
+		write(strings.Join(req.Header.Values(name), ","))
+	}
+	for _, name := range a.cacheKeyCookies {
+		write(name)
+		for _, cookie := range req.Cookies() {
+			if cookie.Name == name {
+				write(cookie.Value)
+			}
+		}
+	}
+	if a.cacheKeyIncludeRemoteAddress {
+		write(a.cacheKeyAddress(clientIP))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheKeyAddress returns the client address of the cache key, without any port, or the subnet of the client
+// when cacheKeyIPv4Prefix or cacheKeyIPv6Prefix is shorter than a whole address.
+func (a *Modsecurity) cacheKeyAddress(clientIP string) string {
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	if a.cacheKeyIPv4Prefix == 0 && a.cacheKeyIPv6Prefix == 0 {
+		return clientIP
+	}
+	ipv4Prefix, ipv6Prefix := a.cacheKeyIPv4Prefix, a.cacheKeyIPv6Prefix
+	if ipv4Prefix == 0 {
+		ipv4Prefix = 8 * net.IPv4len
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = 8 * net.IPv6len
+	}
+	if subnet := ipSubnet(clientIP, ipv4Prefix, ipv6Prefix); subnet != "" {
+		return subnet
+	}
+	return clientIP
+}
+
+// cacheKeyURI returns the request URI of the cache key, normalized according to cacheKeyIgnoredParams,
+// cacheKeySortParams and cacheKeyLowercasePath so that semantically identical URLs share a cache entry.
+func (a *Modsecurity) cacheKeyURI(req *http.Request) string {
+	if len(a.cacheKeyIgnoredParams) == 0 && !a.cacheKeySortParams && !a.cacheKeyLowercasePath {
+		return escapedRequestURI(req)
+	}
+
+	path := req.URL.EscapedPath()
+	if a.cacheKeyLowercasePath {
+		path = strings.ToLower(path)
+	}
+	var params []string
+	for _, param := range strings.Split(req.URL.RawQuery, "&") {
+		if param != "" && !a.isIgnoredParam(queryParamName(param)) {
+			params = append(params, param)
+		}
+	}
+	if a.cacheKeySortParams {
+		// The values of a repeated parameter keep their order, which applications may rely on
+		sort.SliceStable(params, func(i, k int) bool { return queryParamName(params[i]) < queryParamName(params[k]) })
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// isIgnoredParam reports whether a query parameter is one of cacheKeyIgnoredParams, which may end with a * wildcard.
+func (a *Modsecurity) isIgnoredParam(name string) bool {
+	for _, ignored := range a.cacheKeyIgnoredParams {
+		if prefix, ok := strings.CutSuffix(ignored, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// queryParamName returns the unescaped name of a raw name=value query parameter.
+func queryParamName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
+
+// cacheControl returns bypass or refresh when a client of cacheControlSourceRanges asks, with cacheControlHeader,
+// for a fresh verdict that is either not cached or overwrites the cached one, "" otherwise.
+func (a *Modsecurity) cacheControl(req *http.Request, clientIP string) string {
+	if a.cacheControlHeader == "" {
+		return ""
+	}
+	control := strings.ToLower(strings.TrimSpace(req.Header.Get(a.cacheControlHeader)))
+	if control != "bypass" && control != "refresh" {
+		return ""
+	}
+	if !ipInRanges(net.ParseIP(clientIP), a.cacheControlSourceRanges) {
+		return ""
+	}
+	return control
+}
+
+// shouldCacheVerdict reports whether a verdict is of a kind selected by cacheWhichVerdicts. A 5xx answer is
+// most likely a transient modsecurity failure, it is only cached with cacheServerErrors.
+func (a *Modsecurity) shouldCacheVerdict(v *verdict) bool {
+	if v.StatusCode >= http.StatusInternalServerError && !a.cacheServerErrors {
+		return false
+	}
+	switch a.cacheWhichVerdicts {
+	case "blocks":
+		return a.isBlocked(v)
+	case "allows":
+		return !a.isBlocked(v)
+	}
+	return true
+}
+
+// jitteredCacheTTL returns cacheTtlSecs shortened by up to cacheTtlJitterPercent, so that the verdicts cached
+// during a burst don't all expire at once.
+func (a *Modsecurity) jitteredCacheTTL() time.Duration {
+	if a.cacheTTLJitter <= 0 {
+		return a.cacheTTL
+	}
+	return a.cacheTTL - time.Duration(rand.Float64()*a.cacheTTLJitter*float64(a.cacheTTL))
+}
+
+// isStale reports whether a cached verdict outlived cacheTtlSecs, and is only served while it is revalidated.
+func isStale(v *verdict) bool {
+	return v.StaleAt > 0 && time.Now().UnixMilli() >= v.StaleAt
+}
+
+// revalidate refreshes a stale cached verdict in the background, with a single modsecurity call per cache key.
+// The request has no body, since its verdict was cacheable. While the circuit breaker is open, the stale verdict
+// keeps being served instead.
+func (a *Modsecurity) revalidate(req *http.Request, cacheKey string) {
+	refreshReq := req.Clone(context.Background())
+	a.flights.goDo(cacheKey, func() (*verdict, error) {
+		if a.breaker != nil && !a.breaker.allow() {
+			return nil, errCircuitOpen
+		}
+		v, err := a.fetchVerdict(refreshReq, nil, cacheKey)
+		if err != nil {
+			a.log(refreshReq).Warn("fail to revalidate stale cached verdict", "uri", refreshReq.RequestURI, "error", err)
+		}
+		return v, err
+	})
+}
+
+// getCachedVerdict returns the cached verdict for a key, or nil on a miss or a cache failure.
+func (a *Modsecurity) getCachedVerdict(key string) *verdict {
+	v, err := a.cache.Get(key)
+	if err != nil {
+		a.logger.Warn("fail to read verdict from cache", "error", err)
+	}
+	if v == nil {
+		a.metrics.incCacheMisses()
+		return nil
+	}
+	a.metrics.incCacheHits()
+	return v
+}
+
+// runCacheStats logs the cache hit ratio, and the number of entries of an in-memory cache, every
+// cacheStatsInterval until ctx is done.
+func (a *Modsecurity) runCacheStats(ctx context.Context) {
+	ticker := time.NewTicker(cacheStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.logCacheStats()
+		}
+	}
+}
+
+func (a *Modsecurity) logCacheStats() {
+	stats := a.cacheStats()
+	args := []interface{}{"hits", stats.Hits, "misses", stats.Misses, "hitRatio", strconv.FormatFloat(stats.HitRatio, 'f', 3, 64)}
+	if stats.Entries != nil {
+		args = append(args, "entries", *stats.Entries)
+	}
+	a.logger.Info("verdict cache stats", args...)
+}
+
+// cacheStats the cache statistics, Entries is only known for an in-memory cache.
+type cacheStats struct {
+	Entries  *int    `json:"entries,omitempty"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+func (a *Modsecurity) cacheStats() cacheStats {
+	stats := cacheStats{
+		Hits:   atomic.LoadInt64(&a.metrics.cacheHits),
+		Misses: atomic.LoadInt64(&a.metrics.cacheMisses),
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+	if c, ok := a.cache.(*memoryCache); ok {
+		entries := c.len()
+		stats.Entries = &entries
+	}
+	return stats
+}
+
+func (a *Modsecurity) setCachedVerdict(key string, req *http.Request, v *verdict) {
+	cached := *v
+	cached.URL = req.Host + a.cacheKeyURI(req)
+	ttl := a.jitteredCacheTTL()
+	if a.cacheStaleTTL > 0 {
+		cached.StaleAt = time.Now().Add(ttl).UnixMilli()
+		ttl += a.cacheStaleTTL
+	}
+	if err := a.cache.Set(key, &cached, ttl); err != nil {
+		a.logger.Warn("fail to write verdict to cache", "error", err)
+	}
+}
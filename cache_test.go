@@ -0,0 +1,593 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache_Expiry(t *testing.T) {
+	now := time.Now()
+	cache := newMemoryCache(100)
+	cache.nowFn = func() time.Time { return now }
+
+	assert.NoError(t, cache.Set("key", &verdict{StatusCode: 403}, time.Minute))
+
+	v, err := cache.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, 403, v.StatusCode)
+
+	now = now.Add(time.Minute)
+	v, err = cache.Get("key")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestMemoryCache_PurgesExpiredEntries(t *testing.T) {
+	now := time.Now()
+	cache := newMemoryCache(100)
+	cache.nowFn = func() time.Time { return now }
+
+	cache.Set("old", &verdict{StatusCode: 200}, time.Second)
+	now = now.Add(2 * memoryCachePurgeInterval)
+	cache.Set("new", &verdict{StatusCode: 200}, time.Second)
+
+	assert.Len(t, cache.entries, 1)
+}
+
+func TestMemoryCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newMemoryCache(2)
+
+	cache.Set("a", &verdict{StatusCode: 200}, time.Minute)
+	cache.Set("b", &verdict{StatusCode: 200}, time.Minute)
+	// Reading a makes b the least recently used
+	v, _ := cache.Get("a")
+	assert.NotNil(t, v)
+	cache.Set("c", &verdict{StatusCode: 403}, time.Minute)
+
+	assert.Equal(t, 2, cache.len())
+	v, _ = cache.Get("b")
+	assert.Nil(t, v)
+	v, _ = cache.Get("a")
+	assert.NotNil(t, v)
+	v, _ = cache.Get("c")
+	assert.Equal(t, 403, v.StatusCode)
+
+	// Overwriting a verdict doesn't take more room
+	cache.Set("c", &verdict{StatusCode: 200}, time.Minute)
+	assert.Equal(t, 2, cache.len())
+	v, _ = cache.Get("c")
+	assert.Equal(t, 200, v.StatusCode)
+}
+
+func TestModsecurity_LogCacheStats(t *testing.T) {
+	var logs bytes.Buffer
+	l, _ := newLogger(&logs, "info", "text", "waf")
+	cache := newMemoryCache(10)
+	cache.Set("a", &verdict{StatusCode: 200}, time.Minute)
+	a := &Modsecurity{cache: cache, metrics: newMetrics("waf"), logger: l}
+	a.metrics.incCacheHits()
+	a.metrics.incCacheHits()
+	a.metrics.incCacheHits()
+	a.metrics.incCacheMisses()
+
+	a.logCacheStats()
+	assert.Contains(t, logs.String(), "verdict cache stats")
+	assert.Contains(t, logs.String(), "hitRatio=0.750")
+	assert.Contains(t, logs.String(), "entries=1")
+}
+
+func TestRedisCache_RoundTrip(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cache := newRedisCache(newRedisClient(server.Addr(), "", 0, time.Second), "test:")
+
+	v, err := cache.Get("key")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	blocked := &verdict{
+		StatusCode: 403,
+		Header:     http.Header{"Content-Type": []string{"text/html"}},
+		Body:       []byte("<html>Forbidden</html>"),
+	}
+	assert.NoError(t, cache.Set("key", blocked, time.Minute))
+
+	v, err = cache.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, blocked, v)
+
+	_, ok := server.strings["test:verdict:key"]
+	assert.True(t, ok)
+}
+
+func TestVerdictCache_Purge(t *testing.T) {
+	caches := map[string]verdictCache{
+		"memory": newMemoryCache(100),
+		"redis":  newRedisCache(newRedisClient(newFakeRedis(t, "").Addr(), "", 0, time.Second), "test:"),
+	}
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Set("a", &verdict{StatusCode: 200, URL: "example.com/shop?id=1"}, time.Minute)
+			cache.Set("b", &verdict{StatusCode: 200, URL: "example.com/shop?id=2"}, time.Minute)
+			cache.Set("c", &verdict{StatusCode: 403, URL: "example.com/login"}, time.Minute)
+
+			purged, err := cache.Purge(func(v *verdict) bool { return strings.HasPrefix(v.URL, "example.com/shop") })
+			assert.NoError(t, err)
+			assert.Equal(t, 2, purged)
+			v, _ := cache.Get("a")
+			assert.Nil(t, v)
+			v, _ = cache.Get("c")
+			assert.NotNil(t, v)
+
+			purged, err = cache.Purge(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, purged)
+			v, _ = cache.Get("c")
+			assert.Nil(t, v)
+		})
+	}
+}
+
+func TestModsecurity_CacheKey(t *testing.T) {
+	a := &Modsecurity{cacheKeyIncludeHost: true, cacheKeyHeaders: []string{"accept-language"}}
+
+	newRequest := func(target, language string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Language", language)
+		return req
+	}
+
+	key := a.cacheKey(newRequest("http://example.com/test?a=1", "en"), "10.0.0.1")
+	assert.Equal(t, key, a.cacheKey(newRequest("http://example.com/test?a=1", "en"), "10.0.0.2"))
+	assert.NotEqual(t, key, a.cacheKey(newRequest("http://example.com/test?a=2", "en"), "10.0.0.1"))
+	assert.NotEqual(t, key, a.cacheKey(newRequest("http://example.org/test?a=1", "en"), "10.0.0.1"))
+	assert.NotEqual(t, key, a.cacheKey(newRequest("http://example.com/test?a=1", "fr"), "10.0.0.1"))
+
+	a.cacheKeyIncludeRemoteAddress = true
+	assert.NotEqual(t, a.cacheKey(newRequest("http://example.com/test", "en"), "10.0.0.1"), a.cacheKey(newRequest("http://example.com/test", "en"), "10.0.0.2"))
+}
+
+func TestModsecurity_CacheKeyCookies(t *testing.T) {
+	a := &Modsecurity{cacheKeyCookies: []string{"tenant", "session"}}
+
+	newRequest := func(cookie string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		return req
+	}
+
+	key := a.cacheKey(newRequest("tenant=a; session=1; theme=dark"), "10.0.0.1")
+	assert.Equal(t, key, a.cacheKey(newRequest("theme=light; session=1; tenant=a"), "10.0.0.1"))
+	assert.NotEqual(t, key, a.cacheKey(newRequest("tenant=b; session=1"), "10.0.0.1"))
+	assert.NotEqual(t, key, a.cacheKey(newRequest("tenant=a; session=2"), "10.0.0.1"))
+	assert.NotEqual(t, key, a.cacheKey(newRequest("tenant=a"), "10.0.0.1"))
+	assert.NotEqual(t, a.cacheKey(newRequest("tenant=a"), "10.0.0.1"), a.cacheKey(newRequest("session=a"), "10.0.0.1"))
+	assert.NotEqual(t, a.cacheKey(newRequest(""), "10.0.0.1"), a.cacheKey(newRequest("tenant="), "10.0.0.1"))
+}
+
+func TestModsecurity_CacheKeyAddress(t *testing.T) {
+	tests := []struct {
+		ipv4Prefix    int
+		ipv6Prefix    int
+		clientIP      string
+		expectAddress string
+	}{
+		{clientIP: "192.0.2.1", expectAddress: "192.0.2.1"},
+		{clientIP: "192.0.2.1:51234", expectAddress: "192.0.2.1"},
+		{clientIP: "[2001:db8::1]:51234", expectAddress: "2001:db8::1"},
+		{ipv4Prefix: 24, clientIP: "192.0.2.77", expectAddress: "192.0.2.0/24"},
+		{ipv4Prefix: 16, clientIP: "192.0.2.77:51234", expectAddress: "192.0.0.0/16"},
+		{ipv4Prefix: 24, clientIP: "2001:db8::1", expectAddress: "2001:db8::1/128"},
+		{ipv6Prefix: 64, clientIP: "2001:db8::1", expectAddress: "2001:db8::/64"},
+		{ipv6Prefix: 64, clientIP: "192.0.2.77", expectAddress: "192.0.2.77/32"},
+		{ipv4Prefix: 24, clientIP: "unknown", expectAddress: "unknown"},
+	}
+
+	for _, tt := range tests {
+		a := &Modsecurity{cacheKeyIPv4Prefix: tt.ipv4Prefix, cacheKeyIPv6Prefix: tt.ipv6Prefix}
+		assert.Equal(t, tt.expectAddress, a.cacheKeyAddress(tt.clientIP), tt.clientIP)
+	}
+
+	a := &Modsecurity{cacheKeyIncludeRemoteAddress: true, cacheKeyIPv4Prefix: 24}
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	assert.Equal(t, a.cacheKey(req, "192.0.2.1"), a.cacheKey(req, "192.0.2.200"))
+	assert.NotEqual(t, a.cacheKey(req, "192.0.2.1"), a.cacheKey(req, "192.0.3.1"))
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.CacheKeyIPv6Prefix = 129
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_CacheKeyURI(t *testing.T) {
+	tests := []struct {
+		name          string
+		ignoredParams []string
+		sortParams    bool
+		lowercasePath bool
+		target        string
+		expectURI     string
+	}{
+		{name: "as sent", target: "/Test?b=2&a=1", expectURI: "/Test?b=2&a=1"},
+		{name: "ignored", ignoredParams: []string{"utm_*", "fbclid"}, target: "/test?utm_source=x&a=1&fbclid=y&utm_medium=z", expectURI: "/test?a=1"},
+		{name: "only ignored", ignoredParams: []string{"utm_*"}, target: "/test?utm_source=x", expectURI: "/test"},
+		{name: "escaped name", ignoredParams: []string{"fbclid"}, target: "/test?%66bclid=y&a=1", expectURI: "/test?a=1"},
+		{name: "sorted", sortParams: true, target: "/test?b=2&a=1&b=1&&c", expectURI: "/test?a=1&b=2&b=1&c"},
+		{name: "lowercase", lowercasePath: true, target: "/Test/%2F?A=1", expectURI: "/test/%2f?A=1"},
+	}
+
+	for _, tt := range tests {
+		a := &Modsecurity{cacheKeyIgnoredParams: tt.ignoredParams, cacheKeySortParams: tt.sortParams, cacheKeyLowercasePath: tt.lowercasePath}
+		assert.Equal(t, tt.expectURI, a.cacheKeyURI(httptest.NewRequest(http.MethodGet, tt.target, nil)), tt.name)
+	}
+
+	a := &Modsecurity{cacheKeyIgnoredParams: []string{"utm_*"}, cacheKeySortParams: true, cacheKeyLowercasePath: true}
+	key := a.cacheKey(httptest.NewRequest(http.MethodGet, "/Shop?b=2&a=1&utm_source=mail", nil), "10.0.0.1")
+	assert.Equal(t, key, a.cacheKey(httptest.NewRequest(http.MethodGet, "/shop?a=1&b=2", nil), "10.0.0.1"))
+	assert.NotEqual(t, key, a.cacheKey(httptest.NewRequest(http.MethodGet, "/shop?a=1&b=3", nil), "10.0.0.1"))
+}
+
+func TestModsecurity_Cache(t *testing.T) {
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			var wafCalls int32
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&wafCalls, 1)
+				if strings.Contains(r.URL.RawQuery, "etc") {
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte("Response from waf"))
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Response from service"))
+			})
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.CacheEnabled = true
+			config.CacheBackend = backend
+			if backend == "redis" {
+				config.RedisAddress = newFakeRedis(t, "").Addr()
+			}
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			serve := func(method, target string, body io.Reader) (int, string) {
+				rw := httptest.NewRecorder()
+				middleware.ServeHTTP(rw, httptest.NewRequest(method, target, body))
+				respBody, _ := io.ReadAll(rw.Result().Body)
+				return rw.Result().StatusCode, string(respBody)
+			}
+
+			for i := 0; i < 3; i++ {
+				status, body := serve(http.MethodGet, "/website", nil)
+				assert.Equal(t, http.StatusOK, status)
+				assert.Equal(t, "Response from service", body)
+
+				status, body = serve(http.MethodGet, "/website?test=../etc", nil)
+				assert.Equal(t, http.StatusForbidden, status)
+				assert.Equal(t, "Response from waf", body)
+			}
+			assert.Equal(t, int32(2), atomic.LoadInt32(&wafCalls))
+
+			// Requests with a body or with a method that is not cached always reach modsecurity
+			serve(http.MethodPost, "/website", strings.NewReader("a=b"))
+			serve(http.MethodDelete, "/website", nil)
+			assert.Equal(t, int32(4), atomic.LoadInt32(&wafCalls))
+		})
+	}
+}
+
+func TestModsecurity_CacheConfig(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf:8080"
+	config.CacheEnabled = true
+
+	config.CacheBackend = "memcached"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+
+	config.CacheBackend = "redis"
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_CacheWhichVerdicts(t *testing.T) {
+	tests := []struct {
+		which            string
+		expectAllowCalls int32
+		expectBlockCalls int32
+	}{
+		{which: "all", expectAllowCalls: 1, expectBlockCalls: 1},
+		{which: "blocks", expectAllowCalls: 3, expectBlockCalls: 1},
+		{which: "allows", expectAllowCalls: 1, expectBlockCalls: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.which, func(t *testing.T) {
+			var allowCalls, blockCalls int32
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/attack" {
+					atomic.AddInt32(&blockCalls, 1)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				atomic.AddInt32(&allowCalls, 1)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.CacheEnabled = true
+			config.CacheWhichVerdicts = tt.which
+
+			middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			for i := 0; i < 3; i++ {
+				middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+				middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/attack", nil))
+			}
+			assert.Equal(t, tt.expectAllowCalls, atomic.LoadInt32(&allowCalls))
+			assert.Equal(t, tt.expectBlockCalls, atomic.LoadInt32(&blockCalls))
+		})
+	}
+}
+
+func TestModsecurity_CacheServerErrors(t *testing.T) {
+	tests := []struct {
+		cacheServerErrors bool
+		status            int
+		expectCalls       int32
+	}{
+		{status: http.StatusInternalServerError, expectCalls: 3},
+		{status: http.StatusBadGateway, expectCalls: 3},
+		{status: http.StatusGatewayTimeout, expectCalls: 3},
+		{status: http.StatusForbidden, expectCalls: 1},
+		{cacheServerErrors: true, status: http.StatusBadGateway, expectCalls: 1},
+	}
+
+	for _, tt := range tests {
+		var calls int32
+		modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(tt.status)
+		}))
+
+		config := CreateConfig()
+		config.ModSecurityUrl = modsecurityMockServer.URL
+		config.CacheEnabled = true
+		config.CacheServerErrors = tt.cacheServerErrors
+
+		middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+		if err != nil {
+			t.Fatalf("Failed to create middleware: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+		}
+		assert.Equal(t, tt.expectCalls, atomic.LoadInt32(&calls), "status %d, cacheServerErrors %t", tt.status, tt.cacheServerErrors)
+		modsecurityMockServer.Close()
+	}
+}
+
+func TestModsecurity_ConcurrentCacheHits(t *testing.T) {
+	var calls int32
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Rule", "942100")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "blocked by rule 942100")
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CacheEnabled = true
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// Responses written from a cached verdict must not share its header
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+	rw.Header()["X-Rule"][0] = "tampered"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Equal(t, "942100", rw.Header().Get("X-Rule"))
+			assert.Equal(t, "blocked by rule 942100", rw.Body.String())
+			rw.Header().Set("X-Rule", "tampered")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestModsecurity_CacheControlHeader(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusOK)
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CacheEnabled = true
+	config.CacheControlHeader = "X-Waf-Cache"
+	config.CacheControlSourceRanges = []string{"192.0.2.0/24"}
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func(remoteAddr, control string) int {
+		req := httptest.NewRequest(http.MethodGet, "/website", nil)
+		req.RemoteAddr = remoteAddr
+		if control != "" {
+			req.Header.Set("X-Waf-Cache", control)
+		}
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", ""))
+	// Rules were tuned, the cached verdict is stale
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", ""))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// A bypass gets a fresh verdict without caching it
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "bypass"))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", ""))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// Other clients can't use the header
+	assert.Equal(t, http.StatusOK, serve("198.51.100.1:1234", "refresh"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// A refresh overwrites the cached verdict
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:1234", "Refresh"))
+	assert.Equal(t, http.StatusForbidden, serve("198.51.100.1:1234", ""))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	config.CacheControlSourceRanges = nil
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_CacheStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusOK)
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CacheEnabled = true
+	config.CacheStaleWhileRevalidateSecs = 60
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	middleware.(*Modsecurity).cacheTTL = 50 * time.Millisecond
+
+	serve := func() int {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve())
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// The stale verdict is still served, while it is refreshed in the background
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return serve() == http.StatusForbidden }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestModsecurity_CacheStaleWhileBreakerOpen(t *testing.T) {
+	var calls int32
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CacheEnabled = true
+	config.CacheStaleWhileRevalidateSecs = 60
+	config.CircuitBreakerEnabled = true
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+	a.cacheTTL = 50 * time.Millisecond
+
+	serve := func() int {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// The open circuit keeps the stale verdict from being refreshed, and the breaker from hearing about it
+	a.breaker.mu.Lock()
+	a.breaker.state = circuitOpen
+	a.breaker.openedAt = time.Now()
+	a.breaker.mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, "open", a.breaker.status())
+}
+
+func TestModsecurity_JitteredCacheTTL(t *testing.T) {
+	a := &Modsecurity{cacheTTL: 100 * time.Second}
+	assert.Equal(t, 100*time.Second, a.jitteredCacheTTL())
+
+	a.cacheTTLJitter = 0.2
+	ttls := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		ttl := a.jitteredCacheTTL()
+		assert.GreaterOrEqual(t, ttl, 80*time.Second)
+		assert.LessOrEqual(t, ttl, 100*time.Second)
+		ttls[ttl] = true
+	}
+	assert.Greater(t, len(ttls), 1)
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.CacheTtlJitterPercent = 150
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
@@ -0,0 +1,303 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// crowdsecScenario the scenario of the alerts pushed to CrowdSec.
+const crowdsecScenario = "madebymode/traefik-modsecurity"
+
+// crowdsec a client of the CrowdSec local API: as a bouncer it gets the decisions on clients, as a machine
+// it pushes alerts about blocked requests and jailed clients.
+type crowdsec struct {
+	url         string
+	apiKey      string
+	machineID   string
+	password    string
+	client      *http.Client
+	decisionTTL time.Duration
+	alerts      chan crowdsecAlert
+	logger      *logger
+	nowFn       func() time.Time
+
+	mu        sync.Mutex
+	decisions map[string]crowdsecDecision
+	nextPurge time.Time
+
+	// Only used by the goroutine pushing alerts
+	token        string
+	tokenExpires time.Time
+}
+
+// crowdsecDecision a cached answer of the local API about a client, until is zero when it is not banned.
+type crowdsecDecision struct {
+	until   time.Time
+	expires time.Time
+}
+
+// crowdsecAlert an alert as the local API takes it, with the ban decision of jailed clients.
+type crowdsecAlert struct {
+	Scenario        string          `json:"scenario"`
+	ScenarioHash    string          `json:"scenario_hash"`
+	ScenarioVersion string          `json:"scenario_version"`
+	Message         string          `json:"message"`
+	EventsCount     int             `json:"events_count"`
+	StartAt         string          `json:"start_at"`
+	StopAt          string          `json:"stop_at"`
+	Capacity        int             `json:"capacity"`
+	Leakspeed       string          `json:"leakspeed"`
+	Simulated       bool            `json:"simulated"`
+	Events          []crowdsecEvent `json:"events"`
+	Source          crowdsecSource  `json:"source"`
+	Decisions       []crowdsecBan   `json:"decisions,omitempty"`
+}
+
+type crowdsecEvent struct {
+	Timestamp string             `json:"timestamp"`
+	Meta      []crowdsecMetaItem `json:"meta"`
+}
+
+type crowdsecMetaItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type crowdsecSource struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	IP    string `json:"ip"`
+}
+
+type crowdsecBan struct {
+	Duration string `json:"duration"`
+	Origin   string `json:"origin"`
+	Scenario string `json:"scenario"`
+	Scope    string `json:"scope"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+}
+
+func newCrowdsec(ctx context.Context, url, apiKey, machineID, password string, decisionTTL, timeout time.Duration, logger *logger) *crowdsec {
+	c := &crowdsec{
+		url:         url,
+		apiKey:      apiKey,
+		machineID:   machineID,
+		password:    password,
+		client:      &http.Client{Timeout: timeout},
+		decisionTTL: decisionTTL,
+		logger:      logger,
+		nowFn:       time.Now,
+		decisions:   make(map[string]crowdsecDecision),
+	}
+	if machineID != "" {
+		c.alerts = make(chan crowdsecAlert, webhookQueueSize)
+		go c.run(ctx)
+	}
+	return c
+}
+
+// banTime returns when the CrowdSec ban of the client ends, zero when it is not banned.
+// Answers of the local API are cached for decisionTTL.
+func (c *crowdsec) banTime(ctx context.Context, ip string) (time.Time, error) {
+	now := c.nowFn()
+	c.mu.Lock()
+	d, ok := c.decisions[ip]
+	c.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		if now.Before(d.until) {
+			return d.until, nil
+		}
+		return time.Time{}, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/v1/decisions?ip="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("X-Api-Key", c.apiKey)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return time.Time{}, fmt.Errorf("crowdsec returned %d", resp.StatusCode)
+	}
+
+	// No decision at all is a null body
+	var decisions []struct {
+		Type     string `json:"type"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decisions); err != nil {
+		return time.Time{}, fmt.Errorf("fail to decode crowdsec decisions: %w", err)
+	}
+
+	d = crowdsecDecision{expires: now.Add(c.decisionTTL)}
+	for _, decision := range decisions {
+		if decision.Type != "ban" {
+			continue
+		}
+		remaining, err := time.ParseDuration(decision.Duration)
+		if err != nil || remaining <= 0 {
+			continue
+		}
+		if until := now.Add(remaining); until.After(d.until) {
+			d.until = until
+		}
+	}
+	c.store(ip, d, now)
+	return d.until, nil
+}
+
+func (c *crowdsec) store(ip string, d crowdsecDecision, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.After(c.nextPurge) {
+		for k, entry := range c.decisions {
+			if !now.Before(entry.expires) {
+				delete(c.decisions, k)
+			}
+		}
+		c.nextPurge = now.Add(memoryCachePurgeInterval)
+	}
+	c.decisions[ip] = d
+}
+
+// report queues an alert about a client, with a ban decision for banFor when it is not zero, or drops it when
+// the queue is full. Alerts are only pushed when a machine is configured.
+func (c *crowdsec) report(message string, req *http.Request, clientIP string, status int, banFor time.Duration) {
+	if c.alerts == nil {
+		return
+	}
+
+	now := c.nowFn().UTC().Format(time.RFC3339)
+	alert := crowdsecAlert{
+		Scenario:    crowdsecScenario,
+		Message:     message,
+		EventsCount: 1,
+		StartAt:     now,
+		StopAt:      now,
+		Leakspeed:   "0",
+		Events: []crowdsecEvent{{
+			Timestamp: now,
+			Meta: []crowdsecMetaItem{
+				{Key: "method", Value: req.Method},
+				{Key: "target_fqdn", Value: req.Host},
+				{Key: "target_uri", Value: req.RequestURI},
+				{Key: "status", Value: fmt.Sprint(status)},
+			},
+		}},
+		Source: crowdsecSource{Scope: "Ip", Value: clientIP, IP: clientIP},
+	}
+	if banFor > 0 {
+		alert.Decisions = []crowdsecBan{{
+			Duration: banFor.Round(time.Second).String(),
+			Origin:   "crowdsec",
+			Scenario: crowdsecScenario,
+			Scope:    "Ip",
+			Type:     "ban",
+			Value:    clientIP,
+		}}
+	}
+
+	select {
+	case c.alerts <- alert:
+	default:
+		c.logger.Warn("crowdsec alert queue is full, dropping alert", "clientIP", clientIP)
+	}
+}
+
+func (c *crowdsec) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case alert := <-c.alerts:
+			if err := c.push(ctx, alert); err != nil {
+				c.logger.Warn("fail to push alert to crowdsec", "clientIP", alert.Source.IP, "error", err)
+			}
+		}
+	}
+}
+
+func (c *crowdsec) push(ctx context.Context, alert crowdsecAlert) error {
+	token, err := c.login(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(ctx, "/v1/alerts", token, []crowdsecAlert{alert})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The token was revoked, the next alert logs in again
+		c.token = ""
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("crowdsec returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// login returns a token of the machine, logging in when there is none or it is about to expire.
+func (c *crowdsec) login(ctx context.Context) (string, error) {
+	if c.token != "" && c.nowFn().Before(c.tokenExpires) {
+		return c.token, nil
+	}
+
+	resp, err := c.post(ctx, "/v1/watchers/login", "", map[string]interface{}{
+		"machine_id": c.machineID,
+		"password":   c.password,
+		"scenarios":  []string{crowdsecScenario},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("crowdsec login returned %d", resp.StatusCode)
+	}
+
+	var login struct {
+		Token  string    `json:"token"`
+		Expire time.Time `json:"expire"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return "", fmt.Errorf("fail to decode crowdsec login: %w", err)
+	}
+	c.token = login.Token
+	c.tokenExpires = login.Expire.Add(-time.Minute)
+	return c.token, nil
+}
+
+func (c *crowdsec) post(ctx context.Context, path, token string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.client.Do(req)
+}
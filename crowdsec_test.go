@@ -0,0 +1,207 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crowdsecLapiMock a CrowdSec local API banning 198.51.100.1, it records the alerts pushed by machines.
+type crowdsecLapiMock struct {
+	server           *httptest.Server
+	decisionRequests int32
+	logins           int32
+	alerts           chan crowdsecAlert
+}
+
+func newCrowdsecLapiMock(t *testing.T) *crowdsecLapiMock {
+	m := &crowdsecLapiMock{alerts: make(chan crowdsecAlert, 10)}
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/decisions":
+			atomic.AddInt32(&m.decisionRequests, 1)
+			if r.Header.Get("X-Api-Key") != "bouncer-key" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.URL.Query().Get("ip") == "198.51.100.1" {
+				w.Write([]byte(`[{"type":"captcha","duration":"10h0m0s"},{"type":"ban","duration":"3h59m58.5s"},{"type":"ban","duration":"1h"}]`))
+				return
+			}
+			w.Write([]byte("null"))
+		case "/v1/watchers/login":
+			atomic.AddInt32(&m.logins, 1)
+			var login map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["machine_id"] != "waf" || login["password"] != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": 200, "token": "jwt", "expire": time.Now().Add(time.Hour)})
+		case "/v1/alerts":
+			if r.Header.Get("Authorization") != "Bearer jwt" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var alerts []crowdsecAlert
+			json.NewDecoder(r.Body).Decode(&alerts)
+			for _, alert := range alerts {
+				m.alerts <- alert
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return m
+}
+
+func TestCrowdsec_BanTime(t *testing.T) {
+	lapi := newCrowdsecLapiMock(t)
+	defer lapi.server.Close()
+
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	now := time.Now()
+	c := newCrowdsec(context.Background(), lapi.server.URL, "bouncer-key", "", "", time.Minute, time.Second, l)
+	c.nowFn = func() time.Time { return now }
+
+	tests := []struct {
+		ip       string
+		expect   time.Time
+		requests int32
+	}{
+		{ip: "192.0.2.1", expect: time.Time{}, requests: 1},
+		{ip: "198.51.100.1", expect: now.Add(4*time.Hour - 1500*time.Millisecond), requests: 2},
+		// Cached answers
+		{ip: "192.0.2.1", expect: time.Time{}, requests: 2},
+		{ip: "198.51.100.1", expect: now.Add(4*time.Hour - 1500*time.Millisecond), requests: 2},
+	}
+
+	for _, tt := range tests {
+		until, err := c.banTime(context.Background(), tt.ip)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, until, tt.ip)
+		assert.Equal(t, tt.requests, atomic.LoadInt32(&lapi.decisionRequests), tt.ip)
+	}
+
+	// Asks again once the cache expires
+	now = now.Add(time.Minute)
+	_, err := c.banTime(context.Background(), "192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lapi.decisionRequests))
+
+	c.apiKey = "wrong"
+	_, err = c.banTime(context.Background(), "203.0.113.1")
+	assert.EqualError(t, err, "crowdsec returned 403")
+}
+
+func TestModsecurity_Crowdsec(t *testing.T) {
+	lapi := newCrowdsecLapiMock(t)
+	defer lapi.server.Close()
+
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CrowdsecLapiUrl = lapi.server.URL + "/"
+	config.CrowdsecApiKey = "bouncer-key"
+	config.CrowdsecMachineId = "waf"
+	config.CrowdsecMachinePassword = "secret"
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 1
+	config.JailTimeDurationSecs = 600
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	banned := httptest.NewRequest(http.MethodGet, "/website", nil)
+	banned.RemoteAddr = "198.51.100.1:1234"
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, banned)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.NotEmpty(t, rw.Header().Get("Retry-After"))
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/attack", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	receive := func() crowdsecAlert {
+		select {
+		case alert := <-lapi.alerts:
+			return alert
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an alert")
+			return crowdsecAlert{}
+		}
+	}
+
+	blocked := receive()
+	assert.Equal(t, crowdsecScenario, blocked.Scenario)
+	assert.Equal(t, "192.0.2.1", blocked.Source.IP)
+	assert.Contains(t, blocked.Events[0].Meta, crowdsecMetaItem{Key: "target_uri", Value: "/attack"})
+	assert.Empty(t, blocked.Decisions)
+
+	jailed := receive()
+	assert.Equal(t, "192.0.2.1", jailed.Source.Value)
+	if assert.Len(t, jailed.Decisions, 1) {
+		assert.Equal(t, "ban", jailed.Decisions[0].Type)
+		duration, err := time.ParseDuration(jailed.Decisions[0].Duration)
+		assert.NoError(t, err)
+		assert.InDelta(t, 600, duration.Seconds(), 2)
+	}
+
+	// The token is reused
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lapi.logins))
+}
+
+func TestNew_CrowdsecConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		lapiUrl     string
+		apiKey      string
+		machineID   string
+		expectError bool
+	}{
+		{name: "Bouncer", lapiUrl: "http://crowdsec:8080", apiKey: "key"},
+		{name: "Machine", lapiUrl: "http://crowdsec:8080", machineID: "waf"},
+		{name: "No credentials", lapiUrl: "http://crowdsec:8080", expectError: true},
+		{name: "No URL", apiKey: "key", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = "http://modsecurity"
+			config.CrowdsecLapiUrl = tt.lapiUrl
+			config.CrowdsecApiKey = tt.apiKey
+			config.CrowdsecMachineId = tt.machineID
+
+			_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	// errDecompressedBodyTooLarge the request body is bigger than maxDecompressedBodySize once decompressed.
+	errDecompressedBodyTooLarge = errors.New("decompressed request body too large")
+	// errBodyEncoding the request body doesn't match its Content-Encoding.
+	errBodyEncoding = errors.New("invalid request body encoding")
+)
+
+// decompresses reports whether the body sent to modsecurity is decompressed first. Only the encodings of the
+// standard library are, bodies in other ones such as br or zstd are sent as they are.
+func (a *Modsecurity) decompresses(req *http.Request) bool {
+	if !a.decompressBodies {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+// rewritesBody reports whether the body sent to modsecurity differs from the one of the request, in which case
+// it is read whole in memory by rewriteBody instead of being streamed.
+func (a *Modsecurity) rewritesBody(req *http.Request) bool {
+	return len(a.redactBodyPatterns) > 0 || a.decompresses(req)
+}
+
+// rewriteBody returns the body to send to modsecurity, decompressed, truncated to inspectBodyBytes and redacted.
+func (a *Modsecurity) rewriteBody(req *http.Request, body *bodyBuffer) ([]byte, error) {
+	r := body.NewReader()
+	defer r.Close()
+
+	var src io.Reader = r
+	var limit int64
+	decompresses := a.decompresses(req)
+	if decompresses {
+		d, err := newDecompressor(req.Header.Get("Content-Encoding"), r)
+		if err != nil {
+			return nil, &requestBodyError{err: err}
+		}
+		defer d.Close()
+		src = d
+		// Bodies truncated below the limit can't expand past it
+		if a.inspectBodyBytes <= 0 || a.inspectBodyBytes > a.maxDecompressedBodySize {
+			limit = a.maxDecompressedBodySize
+		}
+	}
+	if a.inspectBodyBytes > 0 {
+		src = io.LimitReader(src, a.inspectBodyBytes)
+	}
+	if limit > 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		if readErr := body.readErr(); readErr != nil || !decompresses {
+			if readErr == nil {
+				readErr = err
+			}
+			return nil, &requestBodyError{err: readErr}
+		}
+		return nil, &requestBodyError{err: fmt.Errorf("%w: %s", errBodyEncoding, err.Error())}
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, &requestBodyError{err: errDecompressedBodyTooLarge}
+	}
+	return a.maskBody(data), nil
+}
+
+// newDecompressor returns a reader decompressing a gzip or deflate body.
+func newDecompressor(encoding string, r io.Reader) (io.ReadCloser, error) {
+	if enc := strings.ToLower(strings.TrimSpace(encoding)); enc == "gzip" || enc == "x-gzip" {
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBodyEncoding, err.Error())
+		}
+		return d, nil
+	}
+
+	// deflate is meant to be zlib wrapped, but some clients send raw deflate
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(2)
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		d, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBodyEncoding, err.Error())
+		}
+		return d, nil
+	}
+	return flate.NewReader(br), nil
+}
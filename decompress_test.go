@@ -0,0 +1,130 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compress(t *testing.T, encoding string, data string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestNewDecompressor(t *testing.T) {
+	tests := []struct {
+		name        string
+		encoding    string
+		data        []byte
+		expect      string
+		expectError bool
+	}{
+		{name: "gzip", encoding: "gzip", data: compress(t, "gzip", "q=1' or '1'='1"), expect: "q=1' or '1'='1"},
+		{name: "x-gzip", encoding: "X-Gzip", data: compress(t, "gzip", "a=1"), expect: "a=1"},
+		{name: "zlib deflate", encoding: "deflate", data: compress(t, "deflate", "a=1"), expect: "a=1"},
+		{name: "raw deflate", encoding: "deflate", data: compress(t, "raw-deflate", "a=1"), expect: "a=1"},
+		{name: "Not gzip", encoding: "gzip", data: []byte("a=1"), expectError: true},
+		{name: "Truncated", encoding: "gzip", data: compress(t, "gzip", "a=1")[:10], expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDecompressor(tt.encoding, bytes.NewReader(tt.data))
+			var data []byte
+			if err == nil {
+				data, err = io.ReadAll(d)
+			}
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, string(data))
+		})
+	}
+}
+
+func TestModsecurity_DecompressBodies(t *testing.T) {
+	tests := []struct {
+		name           string
+		encoding       string
+		body           []byte
+		expectStatus   int
+		expectWafBody  string
+		expectEncoding string
+	}{
+		{name: "Decompresses gzip", encoding: "gzip", body: compress(t, "gzip", "q=attack"), expectStatus: http.StatusForbidden, expectWafBody: "q=attack"},
+		{name: "Sends other encodings as they are", encoding: "br", body: []byte("q=attack"), expectStatus: http.StatusForbidden, expectWafBody: "q=attack", expectEncoding: "br"},
+		{name: "Passes clean bodies", encoding: "gzip", body: compress(t, "gzip", "q=1"), expectStatus: http.StatusOK, expectWafBody: "q=1"},
+		{name: "Accepts bodies at the limit", encoding: "gzip", body: compress(t, "gzip", strings.Repeat("a", 1024)), expectStatus: http.StatusOK, expectWafBody: strings.Repeat("a", 1024)},
+		{name: "Rejects bombs", encoding: "gzip", body: compress(t, "gzip", strings.Repeat("a", 1025)), expectStatus: http.StatusRequestEntityTooLarge},
+		{name: "Rejects truncated bodies", encoding: "gzip", body: compress(t, "gzip", "q=1")[:10], expectStatus: http.StatusBadRequest},
+		{name: "Rejects corrupt bodies", encoding: "gzip", body: []byte("q=1"), expectStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafBody, wafEncoding string
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				wafBody = string(body)
+				wafEncoding = r.Header.Get("Content-Encoding")
+				if strings.Contains(wafBody, "attack") {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			var nextBody []byte
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.DecompressBodies = true
+			config.MaxDecompressedBodySize = 1024
+
+			middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextBody, _ = io.ReadAll(r.Body)
+			}), config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/form", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			if tt.expectWafBody != "" {
+				assert.Equal(t, tt.expectWafBody, wafBody)
+				assert.Equal(t, tt.expectEncoding, wafEncoding)
+			}
+			if tt.expectStatus == http.StatusOK {
+				assert.Equal(t, tt.body, nextBody)
+			}
+		})
+	}
+}
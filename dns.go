@@ -0,0 +1,100 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// newDnsResolver returns a resolver asking the DNS server at address, instead of the system resolver.
+func newDnsResolver(address string, timeout time.Duration) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: timeout}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// dnsWatcher resolves the modsecurity hostnames again every interval, and recycles the connections to them once
+// their addresses changed, e.g. after a Kubernetes pod was rescheduled.
+type dnsWatcher struct {
+	lookupFn func(ctx context.Context, host string) ([]string, error)
+	hosts    []string
+	addrs    map[string]string
+	recycle  func()
+	logger   *logger
+}
+
+func newDnsWatcher(resolver *net.Resolver, hosts []string, recycle func(), logger *logger) *dnsWatcher {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &dnsWatcher{lookupFn: resolver.LookupHost, hosts: hosts, addrs: make(map[string]string), recycle: recycle, logger: logger}
+}
+
+// refresh resolves every hostname, and recycles the connections when the addresses of any changed since the
+// previous refresh. A failed resolution keeps the addresses known so far.
+func (w *dnsWatcher) refresh(ctx context.Context) {
+	changed := false
+	for _, host := range w.hosts {
+		ips, err := w.lookupFn(ctx, host)
+		if err != nil {
+			w.logger.Warn("fail to resolve modsec host", "host", host, "error", err)
+			continue
+		}
+		sort.Strings(ips)
+		addrs := strings.Join(ips, ",")
+		if previous, ok := w.addrs[host]; ok && previous != addrs {
+			w.logger.Info("modsec host addresses changed, recycling connections", "host", host, "from", previous, "to", addrs)
+			changed = true
+		}
+		w.addrs[host] = addrs
+	}
+	if changed {
+		w.recycle()
+	}
+}
+
+// run refreshes the addresses right away, then every interval until ctx is done.
+func (w *dnsWatcher) run(ctx context.Context, interval time.Duration) {
+	w.refresh(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.refresh(ctx)
+		}
+	}
+}
+
+// modsecHostnames returns the hostnames of the modsecurity URLs, leaving out IP addresses and unix sockets.
+func modsecHostnames(urls []string) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, rawUrl := range urls {
+		var host string
+		if address, ok := strings.CutPrefix(rawUrl, spoeScheme); ok {
+			host, _, _ = net.SplitHostPort(address)
+		} else if !strings.HasPrefix(rawUrl, unixSocketScheme) {
+			if u, err := url.Parse(rawUrl); err == nil {
+				host = u.Hostname()
+			}
+		}
+		if host == "" || net.ParseIP(host) != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
@@ -0,0 +1,70 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecHostnames(t *testing.T) {
+	hosts := modsecHostnames([]string{
+		"http://waf:8080",
+		"https://WAF.internal/check/",
+		"http://192.0.2.1:8080",
+		"http://[2001:db8::1]:8080",
+		"spoe://agent.internal:12345",
+		"spoe://192.0.2.2:12345",
+		"unix:///run/modsec.sock",
+		"http://waf:8081",
+	})
+	assert.Equal(t, []string{"waf", "WAF.internal", "agent.internal"}, hosts)
+}
+
+func TestDnsWatcher(t *testing.T) {
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	var recycled int
+	w := newDnsWatcher(nil, []string{"waf", "agent"}, func() { recycled++ }, l)
+
+	addrs := map[string][]string{"waf": {"10.0.0.2", "10.0.0.1"}, "agent": {"10.0.1.1"}}
+	var lookupErr error
+	w.lookupFn = func(ctx context.Context, host string) ([]string, error) {
+		return addrs[host], lookupErr
+	}
+
+	// The first resolution only records the addresses
+	w.refresh(context.Background())
+	assert.Equal(t, 0, recycled)
+
+	// Neither the order of the addresses nor a failed resolution recycle connections
+	addrs["waf"] = []string{"10.0.0.1", "10.0.0.2"}
+	w.refresh(context.Background())
+	lookupErr = errors.New("no such host")
+	w.refresh(context.Background())
+	assert.Equal(t, 0, recycled)
+
+	lookupErr = nil
+	addrs["waf"] = []string{"10.0.0.3"}
+	addrs["agent"] = []string{"10.0.1.2"}
+	w.refresh(context.Background())
+	assert.Equal(t, 1, recycled)
+	assert.Equal(t, "10.0.0.3", w.addrs["waf"])
+}
+
+func TestModsecurity_DnsResolverConfig(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf:8080"
+	config.DnsResolver = "10.96.0.10:53"
+	config.DnsRefreshSecs = 30
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := New(ctx, http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.NoError(t, err)
+
+	config.DnsResolver = "10.96.0.10"
+	_, err = New(ctx, http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// mmdbMetadataMarker starts the metadata section, at the end of MaxMind DB files.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errMmdbCorrupt the database doesn't follow the MaxMind DB format.
+var errMmdbCorrupt = errors.New("corrupt MaxMind database")
+
+// mmdbMaxDepth nesting of maps, arrays and pointers a record may have, deeper ones are corrupt.
+const mmdbMaxDepth = 32
+
+// Data types of the MaxMind DB format, the ones from 8 on are stored as extended types.
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbDouble   = 3
+	mmdbBytes    = 4
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbUint128  = 10
+	mmdbArray    = 11
+	mmdbBool     = 14
+	mmdbFloat    = 15
+)
+
+// geoipDB a MaxMind DB file, such as GeoLite2-Country, loaded in memory. Traefik plugins can only use the
+// standard library, hence this minimal reader of the format instead of the MaxMind one.
+type geoipDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+func openGeoipDB(path string) (*geoipDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind database", path)
+	}
+
+	metadata, _, err := decodeMmdb(buf[i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := metadata.(map[string]interface{})
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind database record size %d", recordSize)
+	}
+
+	// The search tree is followed by 16 zero bytes, then the data section
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errMmdbCorrupt
+	}
+	return &geoipDB{
+		tree:       buf[:treeSize],
+		data:       buf[treeSize+16 : i],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}, nil
+}
+
+// country returns the ISO code of the country of ip, empty when it is unknown.
+func (db *geoipDB) country(ip net.IP) string {
+	record, err := db.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	m, _ := record.(map[string]interface{})
+	// Anonymous proxies and satellite providers have no country, only the one their network is registered in
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// lookup returns the record of the network ip is in, nil when there is none.
+func (db *geoipDB) lookup(ip net.IP) (interface{}, error) {
+	var bits []byte
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		// IPv4 addresses are stored as ::a.b.c.d in IPv6 databases
+		if db.ipVersion == 6 {
+			for i := 0; i < 96 && node < db.nodeCount; i++ {
+				node = db.record(node, 0)
+			}
+		}
+	} else if db.ipVersion == 6 {
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, (bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	// Records past the node count point into the data section, after the 16 bytes separating it from the tree
+	record, _, err := decodeMmdb(db.data, node-db.nodeCount-16, 0)
+	return record, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node of the search tree.
+func (db *geoipDB) record(node uint, bit byte) uint {
+	b := db.tree
+	switch db.recordSize {
+	case 24:
+		off := node*6 + uint(bit)*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		// The middle byte holds the most significant bits of both records
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + uint(bit)*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// decodeMmdb decodes the value at offset of a data section, and returns it along with the offset following it.
+// Maps decode to map[string]interface{}, arrays to []interface{}, integers to uint64 or int64, floating point
+// numbers to float64, the others to string, []byte and bool.
+func decodeMmdb(data []byte, offset uint, depth int) (interface{}, uint, error) {
+	if offset >= uint(len(data)) || depth > mmdbMaxDepth {
+		return nil, 0, errMmdbCorrupt
+	}
+	ctrl := data[offset]
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		pointer, next, err := readMmdbPointer(data, ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := decodeMmdb(data, pointer, depth+1)
+		return value, next, err
+	}
+	if kind == mmdbExtended {
+		if offset >= uint(len(data)) {
+			return nil, 0, errMmdbCorrupt
+		}
+		kind = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errMmdbCorrupt
+		}
+		extra := uint(0)
+		for _, c := range data[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decodeMmdb(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMmdbCorrupt
+			}
+			if m[name], offset, err = decodeMmdb(data, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], offset, err = decodeMmdb(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errMmdbCorrupt
+	}
+	value := data[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(value), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), value...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMmdbCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(value)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMmdbCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(value))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		// 128-bit integers don't fit, their lower 64 bits are kept
+		i := uint64(0)
+		for _, c := range value {
+			i = i<<8 | uint64(c)
+		}
+		return i, offset, nil
+	case mmdbInt32:
+		i := uint32(0)
+		for _, c := range value {
+			i = i<<8 | uint32(c)
+		}
+		return int64(int32(i)), offset, nil
+	}
+	return nil, 0, errMmdbCorrupt
+}
+
+// readMmdbPointer returns the data section offset a pointer points to, and the offset following the pointer.
+func readMmdbPointer(data []byte, ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if offset+n > uint(len(data)) {
+		return 0, 0, errMmdbCorrupt
+	}
+	pointer := uint(0)
+	if n < 4 {
+		pointer = uint(ctrl & 0x7)
+	}
+	for _, c := range data[offset : offset+n] {
+		pointer = pointer<<8 | uint(c)
+	}
+	return pointer + []uint{0, 2048, 526336, 0}[n-1], offset + n, nil
+}
+
+// normalizeCountries returns the set of country codes, upper case as in the database.
+func normalizeCountries(codes []string) map[string]bool {
+	countries := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			countries[code] = true
+		}
+	}
+	return countries
+}
+
+// country returns the country of the client, empty when there is no GeoIP database or the country is unknown.
+func (a *Modsecurity) country(clientIP string) string {
+	if a.geoip == nil {
+		return ""
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	return a.geoip.country(ip)
+}
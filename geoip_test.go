@@ -0,0 +1,206 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mmdbTestNode a node of the search tree of a test database, a record is a child node or a country.
+type mmdbTestNode struct {
+	children  [2]*mmdbTestNode
+	countries [2]string
+	index     uint
+}
+
+// writeTestGeoipDB writes an IPv4 MaxMind DB with 24-bit records, mapping networks to countries.
+func writeTestGeoipDB(t *testing.T, networks map[string]string) string {
+	var nodes []*mmdbTestNode
+	newNode := func() *mmdbTestNode {
+		n := &mmdbTestNode{index: uint(len(nodes))}
+		nodes = append(nodes, n)
+		return n
+	}
+	root := newNode()
+	for cidr, country := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid network: %v", err)
+		}
+		ones, _ := network.Mask.Size()
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (network.IP.To4()[i/8] >> (7 - i%8)) & 1
+			if i == ones-1 {
+				node.countries[bit] = country
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = newNode()
+			}
+			node = node.children[bit]
+		}
+	}
+
+	str := func(b []byte, s string) []byte { return append(append(b, byte(mmdbString<<5|len(s))), s...) }
+	var data []byte
+	offsets := make(map[string]uint)
+	for _, country := range networks {
+		if _, ok := offsets[country]; ok {
+			continue
+		}
+		offsets[country] = uint(len(data))
+		data = append(data, mmdbMap<<5|1)
+		data = str(data, "country")
+		data = append(data, mmdbMap<<5|1)
+		data = str(data, "iso_code")
+		data = str(data, country)
+	}
+
+	nodeCount := uint(len(nodes))
+	var tree []byte
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := nodeCount
+			switch {
+			case n.children[bit] != nil:
+				record = n.children[bit].index
+			case n.countries[bit] != "":
+				record = nodeCount + 16 + offsets[n.countries[bit]]
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, mmdbMap<<5|3)
+	buf = str(buf, "node_count")
+	buf = binary.BigEndian.AppendUint32(append(buf, mmdbUint32<<5|4), uint32(nodeCount))
+	buf = str(buf, "record_size")
+	buf = append(buf, mmdbUint16<<5|1, 24)
+	buf = str(buf, "ip_version")
+	buf = append(buf, mmdbUint16<<5|1, 4)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	return path
+}
+
+func TestGeoipDB_Country(t *testing.T) {
+	db, err := openGeoipDB(writeTestGeoipDB(t, map[string]string{
+		"192.0.2.0/24":    "FR",
+		"198.51.100.0/25": "CN",
+		"203.0.113.7/32":  "US",
+	}))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		ip     string
+		expect string
+	}{
+		{ip: "192.0.2.1", expect: "FR"},
+		{ip: "192.0.2.255", expect: "FR"},
+		{ip: "198.51.100.127", expect: "CN"},
+		{ip: "198.51.100.128", expect: ""},
+		{ip: "203.0.113.7", expect: "US"},
+		{ip: "203.0.113.8", expect: ""},
+		{ip: "2001:db8::1", expect: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, db.country(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
+
+func TestDecodeMmdb(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		expect interface{}
+	}{
+		{name: "String", data: []byte{0x43, 'a', 'b', 'c'}, expect: "abc"},
+		{name: "Long string", data: append([]byte{0x5d, 1}, make([]byte, 30)...), expect: string(make([]byte, 30))},
+		{name: "Uint32", data: []byte{0xc2, 0x01, 0x00}, expect: uint64(256)},
+		{name: "Int32", data: []byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, expect: int64(-2)},
+		{name: "Bool", data: []byte{0x01, 0x07}, expect: true},
+		{name: "Double", data: []byte{0x68, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, expect: 1.5},
+		{name: "Array", data: []byte{0x02, 0x04, 0x41, 'a', 0x41, 'b'}, expect: []interface{}{"a", "b"}},
+		{name: "Pointer", data: []byte{0xe1, 0x41, 'k', 0x20, 0x05, 0x42, 'v', 'v'}, expect: map[string]interface{}{"k": "vv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := decodeMmdb(tt.data, 0, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, value)
+		})
+	}
+
+	// A pointer to itself
+	_, _, err := decodeMmdb([]byte{0x20, 0x00}, 0, 0)
+	assert.ErrorIs(t, err, errMmdbCorrupt)
+	_, _, err = decodeMmdb([]byte{0x45, 'a'}, 0, 0)
+	assert.ErrorIs(t, err, errMmdbCorrupt)
+}
+
+func TestModsecurity_Countries(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.GeoipDatabasePath = writeTestGeoipDB(t, map[string]string{"192.0.2.0/24": "FR", "198.51.100.0/24": "CN"})
+	config.BlockCountries = []string{"cn"}
+	config.BypassCountries = []string{"FR"}
+	config.DenyStatusCode = http.StatusUnavailableForLegalReasons
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		expectStatus int
+	}{
+		{remoteAddr: "198.51.100.1:1234", expectStatus: http.StatusUnavailableForLegalReasons},
+		{remoteAddr: "192.0.2.1:1234", expectStatus: http.StatusOK},
+		{remoteAddr: "203.0.113.1:1234", expectStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, tt.expectStatus, rw.Code)
+		})
+	}
+}
+
+func TestNew_CountriesWithoutDatabase(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.BlockCountries = []string{"CN"}
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+
+	config.GeoipDatabasePath = filepath.Join(t.TempDir(), "missing.mmdb")
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
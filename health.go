@@ -0,0 +1,80 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// probe requests healthCheckPath from an HTTP modsecurity instance. Any answer but a server error means the
+// instance is up, whatever verdict its rules give on the path. SPOE agents are never probed.
+func (a *Modsecurity) probe(ctx context.Context, b *backend) error {
+	replay, ok := b.verdicts.(*httpReplay)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, replay.url+a.healthCheckPath, nil)
+	if err != nil {
+		return err
+	}
+	a.setWafAuth(req.Header)
+	a.signWafRequest(req)
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("health check answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkHealth probes every modsecurity instance, ejecting those that fail until they pass again, and returns
+// the error of the first one that failed.
+func (a *Modsecurity) checkHealth(ctx context.Context) error {
+	var firstErr error
+	for _, pool := range a.backendPools() {
+		for _, b := range pool.backends {
+			err := a.probe(ctx, b)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("modsecurity instance %s is unhealthy: %w", b.url, err)
+			}
+
+			b.mu.Lock()
+			wasHealthy := b.probeErr == nil
+			b.probeErr = err
+			b.mu.Unlock()
+
+			switch {
+			case err != nil && wasHealthy:
+				a.logger.Warn("modsec backend failed its health check", "backend", b.url, "error", err)
+			case err == nil && !wasHealthy:
+				a.logger.Info("modsec backend passed its health check again", "backend", b.url)
+			}
+		}
+	}
+	return firstErr
+}
+
+// runHealthChecks probes the modsecurity instances every interval until ctx is done.
+func (a *Modsecurity) runHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.checkHealth(ctx)
+		}
+	}
+}
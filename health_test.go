@@ -0,0 +1,117 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_HealthCheck(t *testing.T) {
+	var down int32 = 1
+	var primaryCalls, secondaryCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if atomic.LoadInt32(&down) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		atomic.AddInt32(&primaryCalls, 1)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			atomic.AddInt32(&secondaryCalls, 1)
+		}
+	}))
+	defer secondary.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = primary.URL
+	config.ModSecurityUrls = []string{secondary.URL}
+	config.HealthCheckPath = "/healthz"
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+
+	// The failing instance is skipped until it passes its health check again
+	assert.Error(t, a.checkHealth(context.Background()))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&primaryCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&secondaryCalls))
+
+	atomic.StoreInt32(&down, 0)
+	assert.NoError(t, a.checkHealth(context.Background()))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryCalls))
+}
+
+func TestModsecurity_HealthCheckFailOnStartup(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name      string
+		url       string
+		path      string
+		expectErr bool
+	}{
+		{name: "healthy", url: modsecurityMockServer.URL, path: "/healthz"},
+		{name: "unreachable", url: "http://127.0.0.1:1", path: "/healthz", expectErr: true},
+		{name: "spoe agents are not probed", url: "spoe://127.0.0.1:1", path: "/healthz"},
+		{name: "relative path", url: modsecurityMockServer.URL, path: "healthz", expectErr: true},
+		{name: "no path", url: modsecurityMockServer.URL, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = tt.url
+			config.HealthCheckPath = tt.path
+			config.HealthCheckFailOnStartup = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			_, err := New(ctx, http.NotFoundHandler(), config, "modsecurity-middleware")
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestModsecurity_HealthCheckFailOnStartupStopsBackgroundWork(t *testing.T) {
+	dir := t.TempDir()
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://127.0.0.1:1"
+	config.HealthCheckPath = "/healthz"
+	config.HealthCheckFailOnStartup = true
+	config.JailEnabled = true
+	config.RateLimitAverage = 10
+	config.AuditLog = true
+	config.AuditLogPath = filepath.Join(dir, "audit.log")
+	config.BanLogPath = filepath.Join(dir, "ban.log")
+
+	before := runtime.NumGoroutine()
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+	// The jail and rate limiter reapers and the log file closers stop right away
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
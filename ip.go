@@ -0,0 +1,138 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseSourceRanges parses a list of CIDRs, bare IP addresses are accepted as single-host ranges.
+func parseSourceRanges(option string, values []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s entry %q", option, value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %s", option, value, err.Error())
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// ipInRanges reports whether ip belongs to one of the ranges, a nil ip never does.
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of the peer connected to Traefik, or nil if RemoteAddr can't be parsed.
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ipSubnet returns the subnet of the given prefix length an address belongs to, or "" when it is not an IP address.
+func ipSubnet(address string, ipv4Prefix, ipv6Prefix int) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	mask := net.CIDRMask(ipv6Prefix, 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(ipv4Prefix, 8*net.IPv4len)
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// clientIP returns the address of the client that sent the request, the key of the jail and of the cache.
+// Headers are only trusted when the peer connected to Traefik is one of the trustedProxies. X-Forwarded-For is
+// walked from the right, skipping the trusted proxies, so a client can't pick its address by prepending to it.
+func (a *Modsecurity) clientIP(req *http.Request) string {
+	peer := remoteIP(req)
+	if peer == nil {
+		return req.RemoteAddr
+	}
+	if !ipInRanges(peer, a.trustedProxies) {
+		return peer.String()
+	}
+
+	if !strings.EqualFold(a.clientIPHeader, "X-Forwarded-For") {
+		if ip := net.ParseIP(strings.TrimSpace(req.Header.Get(a.clientIPHeader))); ip != nil {
+			return ip.String()
+		}
+		return peer.String()
+	}
+
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !ipInRanges(ip, a.trustedProxies) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// setForwardedHeaders tells modsecurity about the original client the way a reverse proxy tells the backend service,
+// so that rules keyed on the client address or the scheme see the real values instead of the Traefik ones.
+func (a *Modsecurity) setForwardedHeaders(proxyReq *http.Request, req *http.Request) {
+	forwardedFor := strings.Join(req.Header.Values("X-Forwarded-For"), ", ")
+	if peer := remoteIP(req); peer != nil {
+		if forwardedFor != "" {
+			forwardedFor += ", "
+		}
+		forwardedFor += peer.String()
+	}
+	if forwardedFor != "" {
+		proxyReq.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	proxyReq.Header.Set("X-Real-IP", a.clientIP(req))
+
+	// Traefik already sets these from its entrypoint, accounting for the proxies in front of it
+	if proxyReq.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		proxyReq.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if proxyReq.Header.Get("X-Forwarded-Host") == "" {
+		proxyReq.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	proxyReq.Header.Set("X-Original-URL", req.RequestURI)
+}
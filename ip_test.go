@@ -0,0 +1,299 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSourceRanges(t *testing.T) {
+	ranges, err := parseSourceRanges("bypassSourceRanges", []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1"})
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 4)
+
+	assert.True(t, ipInRanges(net.ParseIP("10.1.2.3"), ranges))
+	assert.True(t, ipInRanges(net.ParseIP("192.168.1.10"), ranges))
+	assert.False(t, ipInRanges(net.ParseIP("192.168.1.11"), ranges))
+	assert.True(t, ipInRanges(net.ParseIP("2001:db8::1"), ranges))
+	assert.True(t, ipInRanges(net.ParseIP("::1"), ranges))
+	assert.False(t, ipInRanges(nil, ranges))
+
+	_, err = parseSourceRanges("bypassSourceRanges", []string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	_, err = parseSourceRanges("bypassSourceRanges", []string{"office"})
+	assert.Error(t, err)
+}
+
+func TestRemoteIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "192.0.2.1", remoteIP(req).String())
+
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	assert.Equal(t, "2001:db8::1", remoteIP(req).String())
+
+	req.RemoteAddr = "192.0.2.1"
+	assert.Equal(t, "192.0.2.1", remoteIP(req).String())
+
+	req.RemoteAddr = "pipe"
+	assert.Nil(t, remoteIP(req))
+}
+
+func TestModsecurity_BypassSourceRanges(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.BypassSourceRanges = []string{"10.0.0.0/8"}
+	config.TrustedProxies = []string{"172.16.0.0/12", "10.0.0.1"}
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expectedCode int
+	}{
+		{name: "Bypasses a trusted remote address", remoteAddr: "10.1.2.3:5555", expectedCode: http.StatusOK},
+		{name: "Bypasses a trusted forwarded address", remoteAddr: "172.16.0.1:5555", forwardedFor: "10.1.2.3", expectedCode: http.StatusOK},
+		{name: "Inspects other clients", remoteAddr: "192.0.2.1:5555", forwardedFor: "198.51.100.1", expectedCode: http.StatusForbidden},
+		{name: "Inspects a spoofed forwarded address from an untrusted peer", remoteAddr: "192.0.2.1:5555", forwardedFor: "10.1.2.3", expectedCode: http.StatusForbidden},
+		{name: "Inspects a spoofed left-most forwarded address", remoteAddr: "172.16.0.1:5555", forwardedFor: "10.1.2.3, 198.51.100.1", expectedCode: http.StatusForbidden},
+		{name: "Inspects the clients of a trusted proxy inside a bypassed range", remoteAddr: "10.0.0.1:5555", forwardedFor: "198.51.100.1", expectedCode: http.StatusForbidden},
+		{name: "Bypasses a trusted client behind a trusted proxy inside a bypassed range", remoteAddr: "10.0.0.1:5555", forwardedFor: "10.1.2.3", expectedCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, tt.expectedCode, rw.Result().StatusCode)
+		})
+	}
+}
+
+func TestModsecurity_DenySourceRanges(t *testing.T) {
+	var wafCalled bool
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalled = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name         string
+		statusCode   int
+		remoteAddr   string
+		forwardedFor string
+		websocket    bool
+		expectedCode int
+		expectWaf    bool
+	}{
+		{name: "Denies a remote address", remoteAddr: "198.51.100.7:5555", expectedCode: http.StatusForbidden},
+		{name: "Denies a forwarded address with a custom status", statusCode: http.StatusTeapot, remoteAddr: "10.0.0.1:5555", forwardedFor: "198.51.100.7", expectedCode: http.StatusTeapot},
+		{name: "Ignores a forwarded address from an untrusted peer", remoteAddr: "192.0.2.1:5555", forwardedFor: "198.51.100.7", expectedCode: http.StatusOK, expectWaf: true},
+		{name: "Denies even when bypassed", remoteAddr: "198.51.100.8:5555", expectedCode: http.StatusForbidden},
+		{name: "Denies a websocket upgrade", remoteAddr: "198.51.100.7:5555", websocket: true, expectedCode: http.StatusForbidden},
+		{name: "Inspects other clients", remoteAddr: "192.0.2.1:5555", expectedCode: http.StatusOK, expectWaf: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCalled = false
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.DenySourceRanges = []string{"198.51.100.0/24"}
+			config.BypassSourceRanges = []string{"198.51.100.8"}
+			config.TrustedProxies = []string{"10.0.0.0/8"}
+			if tt.statusCode != 0 {
+				config.DenyStatusCode = tt.statusCode
+			}
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.websocket {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, tt.expectedCode, rw.Result().StatusCode)
+			assert.Equal(t, tt.expectWaf, wafCalled)
+		})
+	}
+}
+
+func TestModsecurity_ClientIP(t *testing.T) {
+	trustedProxies, _ := parseSourceRanges("trustedProxies", []string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name           string
+		clientIPHeader string
+		remoteAddr     string
+		header         string
+		value          string
+		expected       string
+	}{
+		{name: "Strips the port of the remote address", remoteAddr: "192.0.2.1:5555", expected: "192.0.2.1"},
+		{name: "Ignores headers sent by untrusted peers", remoteAddr: "192.0.2.1:5555", header: "X-Forwarded-For", value: "198.51.100.1", expected: "192.0.2.1"},
+		{name: "Uses X-Forwarded-For of a trusted proxy", remoteAddr: "10.0.0.1:5555", header: "X-Forwarded-For", value: "198.51.100.1", expected: "198.51.100.1"},
+		{name: "Skips trusted proxies in X-Forwarded-For", remoteAddr: "10.0.0.1:5555", header: "X-Forwarded-For", value: "203.0.113.9, 198.51.100.1, 10.0.0.2", expected: "198.51.100.1"},
+		{name: "Stops at an invalid X-Forwarded-For hop", remoteAddr: "10.0.0.1:5555", header: "X-Forwarded-For", value: "garbage, 10.0.0.2", expected: "10.0.0.2"},
+		{name: "Falls back to the peer without X-Forwarded-For", remoteAddr: "10.0.0.1:5555", expected: "10.0.0.1"},
+		{name: "Uses CF-Connecting-IP", clientIPHeader: "CF-Connecting-IP", remoteAddr: "10.0.0.1:5555", header: "CF-Connecting-IP", value: "198.51.100.1", expected: "198.51.100.1"},
+		{name: "Ignores an invalid X-Real-IP", clientIPHeader: "X-Real-IP", remoteAddr: "10.0.0.1:5555", header: "X-Real-IP", value: "unknown", expected: "10.0.0.1"},
+		{name: "Keeps an unparsable remote address", remoteAddr: "pipe", expected: "pipe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Modsecurity{trustedProxies: trustedProxies, clientIPHeader: "X-Forwarded-For"}
+			if tt.clientIPHeader != "" {
+				a.clientIPHeader = tt.clientIPHeader
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			assert.Equal(t, tt.expected, a.clientIP(req))
+		})
+	}
+}
+
+func TestModsecurity_JailsClientsBehindTrustedProxy(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 2
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func(path, client string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:5555"
+		req.Header.Set("X-Forwarded-For", client)
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Result().StatusCode
+	}
+
+	serve("/attack", "198.51.100.1")
+	serve("/attack", "198.51.100.1")
+	assert.Equal(t, http.StatusTooManyRequests, serve("/test", "198.51.100.1"))
+	assert.Equal(t, http.StatusOK, serve("/test", "198.51.100.2"))
+}
+
+func TestModsecurity_ForwardClientHeaders(t *testing.T) {
+	var wafHeader http.Header
+	var wafHost string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafHeader = r.Header.Clone()
+		wafHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("X-Original-URL"))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/cart?id=1", nil)
+	req.Host = "shop.example.com"
+	req.TLS = &tls.ConnectionState{}
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, "198.51.100.1, 10.0.0.1", wafHeader.Get("X-Forwarded-For"))
+	assert.Equal(t, "198.51.100.1", wafHeader.Get("X-Real-IP"))
+	assert.Equal(t, "https", wafHeader.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "shop.example.com", wafHeader.Get("X-Forwarded-Host"))
+	assert.Equal(t, "/cart?id=1", wafHeader.Get("X-Original-URL"))
+	assert.NotEqual(t, "shop.example.com", wafHost)
+
+	// Headers set by Traefik are kept
+	req = httptest.NewRequest(http.MethodGet, "/cart", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "shop.example.com")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "https", wafHeader.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "shop.example.com", wafHeader.Get("X-Forwarded-Host"))
+	assert.Equal(t, "192.0.2.1", wafHeader.Get("X-Forwarded-For"))
+
+	config.ForwardClientHeaders = false
+	config.PreserveHost = true
+	middleware, err = New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/cart", nil)
+	req.Host = "shop.example.com"
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, wafHeader.Get("X-Forwarded-For"))
+	assert.Empty(t, wafHeader.Get("X-Original-URL"))
+	assert.Equal(t, "shop.example.com", wafHost)
+}
@@ -0,0 +1,915 @@
+package traefik_modsecurity_plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scopes of the jail and cache entries: shared by every host the middleware serves, or kept apart per host.
+const (
+	scopeGlobal    = "global"
+	scopePerRouter = "perRouter"
+)
+
+// jailScopeSeparator separates the host from the client in the jail keys of the perRouter scope.
+const jailScopeSeparator = "|"
+
+// jailSessionPrefix the prefix of the jail keys of the clients jailed by jailKeyCookie or jailKeyHeader.
+const jailSessionPrefix = "session:"
+
+// jailStore keeps the offenses and bans of the jail. A client that is not banned has a zero release time.
+type jailStore interface {
+	AddOffense(clientIP string, now time.Time, period time.Duration) (int, error)
+	AddScore(clientIP string, score int, now time.Time, period time.Duration) (int, error)
+	Ban(clientIP string, until time.Time) error
+	BannedUntil(clientIP string) (time.Time, error)
+	Release(clientIP string) error
+	Bans() (map[string]time.Time, error)
+	AddJailing(clientIP string, now time.Time, memory time.Duration) (int, error)
+}
+
+// jail keeps out the clients that got too many requests blocked by modsecurity in a period of time.
+// With a subnet threshold, offenses are also counted per subnet, so that clients rotating their address
+// within a subnet get the whole subnet jailed. With an escalation factor above 1, the jail time of a client
+// is multiplied by the factor every time it is jailed again within escalationReset of its previous jailing,
+// up to maxDuration.
+type jail struct {
+	store            jailStore
+	threshold        int
+	period           time.Duration
+	duration         time.Duration
+	escalationFactor int
+	escalationReset  time.Duration
+	maxDuration      time.Duration
+	exemptRanges     []*net.IPNet
+	subnetThreshold  int
+	scoreThreshold   int
+	subnetIPv4Prefix int
+	subnetIPv6Prefix int
+	nowFn            func() time.Time
+	logger           *logger
+}
+
+func newJail(store jailStore, threshold int, period, duration time.Duration, logger *logger) *jail {
+	return &jail{
+		store:            store,
+		threshold:        threshold,
+		period:           period,
+		duration:         duration,
+		escalationFactor: 1,
+		nowFn:            time.Now,
+		logger:           logger,
+	}
+}
+
+// jailDuration returns how long the client is jailed for, given how many times it was jailed recently.
+func (j *jail) jailDuration(clientIP string, now time.Time) time.Duration {
+	if j.escalationFactor <= 1 {
+		return j.duration
+	}
+	count, err := j.store.AddJailing(clientIP, now, j.escalationReset)
+	if err != nil {
+		j.logger.Warn("fail to record jailing", "clientIP", clientIP, "error", err)
+		return j.duration
+	}
+
+	duration := j.duration
+	for i := 1; i < count && duration < j.maxDuration; i++ {
+		duration *= time.Duration(j.escalationFactor)
+	}
+	if duration > j.maxDuration {
+		duration = j.maxDuration
+	}
+	return duration
+}
+
+// isExempt reports whether the client is in the exempt ranges, which are never jailed.
+func (j *jail) isExempt(clientIP string) bool {
+	return ipInRanges(net.ParseIP(clientIP), j.exemptRanges)
+}
+
+// isJailed reports whether the client is in jail.
+func (j *jail) isJailed(clientIP string) bool {
+	return !j.releaseTime(clientIP).IsZero()
+}
+
+// subnet returns the subnet the client belongs to for subnet jailing, or "" when subnet jailing is disabled.
+func (j *jail) subnet(clientIP string) string {
+	if j.subnetThreshold <= 0 {
+		return ""
+	}
+	return ipSubnet(clientIP, j.subnetIPv4Prefix, j.subnetIPv6Prefix)
+}
+
+// releaseTime returns when the client gets out of jail, or a zero time when neither it nor its subnet
+// is in jail. A failing store never keeps clients out.
+func (j *jail) releaseTime(clientIP string) time.Time {
+	if j.isExempt(clientIP) {
+		return time.Time{}
+	}
+	until := j.bannedUntil(clientIP)
+	if subnet := j.subnet(clientIP); subnet != "" {
+		if subnetUntil := j.bannedUntil(subnet); subnetUntil.After(until) {
+			until = subnetUntil
+		}
+	}
+	return until
+}
+
+// bannedUntil returns when a client or subnet gets out of jail, releasing it once its time is served.
+func (j *jail) bannedUntil(key string) time.Time {
+	until, err := j.store.BannedUntil(key)
+	if err != nil {
+		j.logger.Warn("fail to read jail", "clientIP", key, "error", err)
+		return time.Time{}
+	}
+	if until.IsZero() || j.nowFn().Before(until) {
+		return until
+	}
+
+	if err := j.store.Release(key); err != nil {
+		j.logger.Warn("fail to release client from jail", "clientIP", key, "error", err)
+	} else {
+		j.logger.Info("client released from jail", "clientIP", key)
+	}
+	return time.Time{}
+}
+
+// recordOffense records a blocked request of the client, and of its subnet with subnet jailing.
+// It returns true when the client or its subnet is put in jail.
+func (j *jail) recordOffense(clientIP string) bool {
+	if j.isExempt(clientIP) {
+		return false
+	}
+	now := j.nowFn()
+	jailed := j.offend(clientIP, j.threshold, now)
+	if subnet := j.subnet(clientIP); subnet != "" && j.offend(subnet, j.subnetThreshold, now) {
+		jailed = true
+	}
+	return jailed
+}
+
+// offend counts an offense of a client or subnet, and puts it in jail once it reached the threshold.
+func (j *jail) offend(key string, threshold int, now time.Time) bool {
+	count, err := j.store.AddOffense(key, now, j.period)
+	if err != nil {
+		j.logger.Warn("fail to record offense", "clientIP", key, "error", err)
+		return false
+	}
+	return j.banOverThreshold(key, count, threshold, now)
+}
+
+// recordScore adds the anomaly score of a request of the client to its total over the threshold period.
+// It returns true when the total reaches the score threshold and the client is put in jail.
+func (j *jail) recordScore(key string, score int) bool {
+	if j.isExempt(key) {
+		return false
+	}
+	now := j.nowFn()
+	total, err := j.store.AddScore(key, score, now, j.period)
+	if err != nil {
+		j.logger.Warn("fail to record anomaly score", "clientIP", key, "error", err)
+		return false
+	}
+	return j.banOverThreshold(key, total, j.scoreThreshold, now)
+}
+
+// banOverThreshold puts a client or subnet in jail once its count reached the threshold.
+func (j *jail) banOverThreshold(key string, count, threshold int, now time.Time) bool {
+	if count < threshold {
+		return false
+	}
+
+	duration := j.jailDuration(key, now)
+	j.logger.Warn("client reached threshold, putting in jail", "clientIP", key, "duration", duration.String())
+	if err := j.store.Ban(key, now.Add(duration)); err != nil {
+		j.logger.Warn("fail to jail client", "clientIP", key, "error", err)
+		return false
+	}
+	return true
+}
+
+// jailKey returns the key the client is jailed by: a hash of its jailKeyCookie or jailKeyHeader, so that
+// clients sharing an address behind a NAT are jailed apart, or its address when it sends neither. With the
+// perRouter scope, it is prefixed with the request host. Exempt clients are always keyed by their address.
+func (a *Modsecurity) jailKey(req *http.Request, clientIP string) string {
+	if a.jail.isExempt(clientIP) {
+		return clientIP
+	}
+	return a.scopedJailKey(req, a.clientJailKey(req, clientIP))
+}
+
+// scopedJailKey prefixes a jail key with the request host with the perRouter scope.
+func (a *Modsecurity) scopedJailKey(req *http.Request, key string) string {
+	if a.scope == scopePerRouter {
+		return requestHost(req) + jailScopeSeparator + key
+	}
+	return key
+}
+
+// jailReleaseTime returns when the client gets out of jail, or the zero time when it is not jailed. A client
+// jailed by its address stays jailed when it starts sending jailKeyCookie or jailKeyHeader.
+func (a *Modsecurity) jailReleaseTime(req *http.Request, clientIP string) time.Time {
+	key := a.jailKey(req, clientIP)
+	until := a.jail.releaseTime(key)
+	if addressKey := a.scopedJailKey(req, clientIP); addressKey != key {
+		if addressUntil := a.jail.releaseTime(addressKey); addressUntil.After(until) {
+			until = addressUntil
+		}
+	}
+	return until
+}
+
+// clientJailKey returns the session key of the client, or its address when it sends neither jailKeyCookie
+// nor jailKeyHeader.
+func (a *Modsecurity) clientJailKey(req *http.Request, clientIP string) string {
+	var value string
+	if a.jailKeyCookie != "" {
+		if cookie, err := req.Cookie(a.jailKeyCookie); err == nil {
+			value = cookie.Value
+		}
+	}
+	if value == "" && a.jailKeyHeader != "" {
+		value = req.Header.Get(a.jailKeyHeader)
+	}
+	if value == "" {
+		return clientIP
+	}
+	// The session ID or API key itself is never stored, nor shown by the admin API
+	sum := sha256.Sum256([]byte(value))
+	return jailSessionPrefix + hex.EncodeToString(sum[:16])
+}
+
+// isAddressJailKey reports whether a jail key is a client address or a subnet.
+func isAddressJailKey(key string) bool {
+	_, _, err := net.ParseCIDR(key)
+	return err == nil || net.ParseIP(key) != nil
+}
+
+// recordAnomalyScore adds the anomaly score of the request to the total of the client, by its jail key, and
+// reports it when it gets jailed.
+func (a *Modsecurity) recordAnomalyScore(req *http.Request, clientIP string, v *verdict) {
+	if a.jail.recordScore(a.jailKey(req, clientIP), v.AnomalyScore) {
+		a.metrics.incJailed()
+		a.notify(eventJailed, req, clientIP, v)
+	}
+}
+
+// recordOffense records an offense of the client, by its jail key, and reports it when it gets jailed.
+func (a *Modsecurity) recordOffense(req *http.Request, clientIP string, v *verdict) {
+	if a.jail.recordOffense(a.jailKey(req, clientIP)) {
+		a.metrics.incJailed()
+		a.notify(eventJailed, req, clientIP, v)
+	}
+}
+
+// jailBan a client in jail, as listed by the admin API.
+type jailBan struct {
+	ClientIP      string    `json:"clientIP"`
+	ReleasedAt    time.Time `json:"releasedAt"`
+	RemainingSecs int64     `json:"remainingSecs"`
+}
+
+// bans lists the clients in jail, sorted by address.
+func (j *jail) bans() ([]jailBan, error) {
+	releases, err := j.store.Bans()
+	if err != nil {
+		return nil, err
+	}
+
+	now := j.nowFn()
+	bans := []jailBan{}
+	for clientIP, until := range releases {
+		if now.Before(until) {
+			bans = append(bans, jailBan{ClientIP: clientIP, ReleasedAt: until, RemainingSecs: int64(math.Ceil(until.Sub(now).Seconds()))})
+		}
+	}
+	sort.Slice(bans, func(i, k int) bool { return bans[i].ClientIP < bans[k].ClientIP })
+	return bans, nil
+}
+
+// ban puts a client in jail for the given duration, whatever its offenses.
+func (j *jail) ban(clientIP string, duration time.Duration) (jailBan, error) {
+	until := j.nowFn().Add(duration)
+	if err := j.store.Ban(clientIP, until); err != nil {
+		return jailBan{}, err
+	}
+	j.logger.Warn("client manually put in jail", "clientIP", clientIP, "releasedAt", until.Format(time.RFC3339))
+	return jailBan{ClientIP: clientIP, ReleasedAt: until, RemainingSecs: int64(math.Ceil(duration.Seconds()))}, nil
+}
+
+// release lets a client out of jail before its time is served, forgetting its offenses.
+func (j *jail) release(clientIP string) error {
+	if err := j.store.Release(clientIP); err != nil {
+		return err
+	}
+	j.logger.Info("client manually released from jail", "clientIP", clientIP)
+	return nil
+}
+
+// memoryJailShards number of independently locked shards of a memoryJailStore.
+const memoryJailShards = 32
+
+// memoryJailReapInterval how often expired offenses, bans and jailings are swept from a memoryJailStore.
+const memoryJailReapInterval = time.Minute
+
+// memoryJailStatsInterval how often the occupancy of a memoryJailStore is logged.
+const memoryJailStatsInterval = 5 * time.Minute
+
+// memoryJailSaveInterval how often a memoryJailStore that changed is saved to its persistence path, so that a
+// burst of bans costs a single write.
+const memoryJailSaveInterval = time.Second
+
+// memoryJailState the content of a memoryJailStore, as saved to its persistence path.
+type memoryJailState struct {
+	Offenses map[string][]time.Time    `json:"offenses"`
+	Releases map[string]time.Time      `json:"releases"`
+	Jailings map[string]jailingCount   `json:"jailings,omitempty"`
+	Scores   map[string][]anomalyScore `json:"scores,omitempty"`
+}
+
+// anomalyScore the anomaly score of a request of a client, counted toward score-based jailing.
+type anomalyScore struct {
+	At    time.Time `json:"at"`
+	Score int       `json:"score"`
+}
+
+// jailingCount how many times a client was jailed, forgotten once expired.
+type jailingCount struct {
+	Count   int       `json:"count"`
+	Expires time.Time `json:"expires"`
+}
+
+// memoryJailShard the part of a memoryJailStore holding the clients whose address hashes to it.
+type memoryJailShard struct {
+	mu       sync.RWMutex
+	offenses map[string][]time.Time
+	releases map[string]time.Time
+	jailings map[string]jailingCount
+	scores   map[string][]anomalyScore
+	// seen the clients the shard holds anything about, in the order they were last recorded, jailed ones apart,
+	// so that the oldest one is evicted without going through the whole shard
+	seen   map[string]*list.Element
+	free   *list.List
+	jailed *list.List
+}
+
+// memoryJailEntry a client of a memoryJailShard, in the list of free or jailed clients.
+type memoryJailEntry struct {
+	clientIP string
+	jailed   bool
+}
+
+// memoryJailStore a jailStore local to the Traefik process, optionally saved to a file to survive restarts.
+// Clients are spread over shards with their own lock, so that requests of different clients don't contend,
+// and the checks every request goes through only take a read lock.
+// Each shard holds up to its share of maxEntries clients, so that a flood of spoofed sources can't grow the
+// jail without limit. Once full, the client recorded the longest ago is evicted, jailed clients last.
+type memoryJailStore struct {
+	shards          [memoryJailShards]*memoryJailShard
+	shardMaxEntries int
+	evicted         int64
+	persistencePath string
+	dirty           int32
+	saveMu          sync.Mutex
+	logger          *logger
+}
+
+func newMemoryJailStore(persistencePath string, maxEntries int, logger *logger) *memoryJailStore {
+	s := &memoryJailStore{persistencePath: persistencePath, logger: logger}
+	if maxEntries > 0 {
+		s.shardMaxEntries = (maxEntries + memoryJailShards - 1) / memoryJailShards
+	}
+	for i := range s.shards {
+		s.shards[i] = &memoryJailShard{
+			offenses: make(map[string][]time.Time),
+			releases: make(map[string]time.Time),
+			jailings: make(map[string]jailingCount),
+			scores:   make(map[string][]anomalyScore),
+			seen:     make(map[string]*list.Element),
+			free:     list.New(),
+			jailed:   list.New(),
+		}
+	}
+	return s
+}
+
+// track records the client as seen at now, evicting the oldest client of the shard first when it is full.
+// The shard lock must be held.
+func (s *memoryJailStore) track(shard *memoryJailShard, clientIP string, now time.Time) {
+	if element, ok := shard.seen[clientIP]; ok {
+		shard.remove(element)
+	} else if s.shardMaxEntries > 0 && len(shard.seen) >= s.shardMaxEntries {
+		s.evictOldest(shard)
+	}
+
+	entry := &memoryJailEntry{clientIP: clientIP, jailed: now.Before(shard.releases[clientIP])}
+	if entry.jailed {
+		shard.seen[clientIP] = shard.jailed.PushBack(entry)
+	} else {
+		shard.seen[clientIP] = shard.free.PushBack(entry)
+	}
+}
+
+// evictOldest forgets the client of the shard recorded the longest ago, a jailed one only when every client
+// of the shard was jailed when last recorded. The shard lock must be held.
+func (s *memoryJailStore) evictOldest(shard *memoryJailShard) {
+	oldest := shard.free.Front()
+	if oldest == nil {
+		oldest = shard.jailed.Front()
+	}
+	clientIP := oldest.Value.(*memoryJailEntry).clientIP
+	delete(shard.offenses, clientIP)
+	delete(shard.scores, clientIP)
+	delete(shard.releases, clientIP)
+	delete(shard.jailings, clientIP)
+	delete(shard.seen, clientIP)
+	shard.remove(oldest)
+	atomic.AddInt64(&s.evicted, 1)
+}
+
+// remove takes a client out of the list it is in. The shard lock must be held.
+func (shard *memoryJailShard) remove(element *list.Element) {
+	if element.Value.(*memoryJailEntry).jailed {
+		shard.jailed.Remove(element)
+	} else {
+		shard.free.Remove(element)
+	}
+}
+
+// untrack forgets when the client was seen once the shard holds nothing else about it. The shard lock must
+// be held.
+func (shard *memoryJailShard) untrack(clientIP string) {
+	_, offended := shard.offenses[clientIP]
+	_, scored := shard.scores[clientIP]
+	_, banned := shard.releases[clientIP]
+	_, jailed := shard.jailings[clientIP]
+	if element, ok := shard.seen[clientIP]; ok && !offended && !scored && !banned && !jailed {
+		shard.remove(element)
+		delete(shard.seen, clientIP)
+	}
+}
+
+// entries returns the number of clients the store holds anything about.
+func (s *memoryJailStore) entries() int {
+	var n int
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		n += len(shard.seen)
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// evictions returns the number of clients evicted because their shard was full.
+func (s *memoryJailStore) evictions() int64 {
+	return atomic.LoadInt64(&s.evicted)
+}
+
+func (s *memoryJailStore) shard(clientIP string) *memoryJailShard {
+	h := fnv.New32a()
+	h.Write([]byte(clientIP))
+	return s.shards[h.Sum32()%memoryJailShards]
+}
+
+func (s *memoryJailStore) AddOffense(clientIP string, now time.Time, period time.Duration) (int, error) {
+	shard := s.shard(clientIP)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Remove offenses that are older than the threshold period
+	var offenses []time.Time
+	for _, offense := range shard.offenses[clientIP] {
+		if now.Sub(offense) <= period {
+			offenses = append(offenses, offense)
+		}
+	}
+	shard.offenses[clientIP] = append(offenses, now)
+	s.track(shard, clientIP, now)
+	return len(shard.offenses[clientIP]), nil
+}
+
+func (s *memoryJailStore) AddScore(clientIP string, score int, now time.Time, period time.Duration) (int, error) {
+	shard := s.shard(clientIP)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Remove scores that are older than the threshold period
+	var scores []anomalyScore
+	total := score
+	for _, previous := range shard.scores[clientIP] {
+		if now.Sub(previous.At) <= period {
+			scores = append(scores, previous)
+			total += previous.Score
+		}
+	}
+	shard.scores[clientIP] = append(scores, anomalyScore{At: now, Score: score})
+	s.track(shard, clientIP, now)
+	return total, nil
+}
+
+func (s *memoryJailStore) Ban(clientIP string, until time.Time) error {
+	shard := s.shard(clientIP)
+	shard.mu.Lock()
+	shard.releases[clientIP] = until
+	s.track(shard, clientIP, time.Now())
+	shard.mu.Unlock()
+
+	s.markDirty()
+	return nil
+}
+
+func (s *memoryJailStore) BannedUntil(clientIP string) (time.Time, error) {
+	shard := s.shard(clientIP)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.releases[clientIP], nil
+}
+
+func (s *memoryJailStore) Release(clientIP string) error {
+	shard := s.shard(clientIP)
+	shard.mu.Lock()
+	// Concurrent requests of the same client may race to release it
+	_, exists := shard.releases[clientIP]
+	delete(shard.offenses, clientIP)
+	delete(shard.scores, clientIP)
+	delete(shard.releases, clientIP)
+	shard.untrack(clientIP)
+	shard.mu.Unlock()
+
+	if exists {
+		s.markDirty()
+	}
+	return nil
+}
+
+func (s *memoryJailStore) Bans() (map[string]time.Time, error) {
+	return s.snapshot().Releases, nil
+}
+
+// AddJailing counts a jailing of the client, the count is kept until memory elapsed without the client
+// being jailed again. It outlives releases on purpose.
+func (s *memoryJailStore) AddJailing(clientIP string, now time.Time, memory time.Duration) (int, error) {
+	shard := s.shard(clientIP)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	jailing := shard.jailings[clientIP]
+	if !now.Before(jailing.Expires) {
+		jailing.Count = 0
+	}
+	jailing.Count++
+	jailing.Expires = now.Add(memory)
+	shard.jailings[clientIP] = jailing
+	s.track(shard, clientIP, now)
+	return jailing.Count, nil
+}
+
+// snapshot copies the content of every shard, one shard at a time.
+func (s *memoryJailStore) snapshot() memoryJailState {
+	state := memoryJailState{
+		Offenses: make(map[string][]time.Time),
+		Releases: make(map[string]time.Time),
+		Jailings: make(map[string]jailingCount),
+		Scores:   make(map[string][]anomalyScore),
+	}
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for clientIP, offenses := range shard.offenses {
+			state.Offenses[clientIP] = append([]time.Time(nil), offenses...)
+		}
+		for clientIP, until := range shard.releases {
+			state.Releases[clientIP] = until
+		}
+		for clientIP, jailing := range shard.jailings {
+			state.Jailings[clientIP] = jailing
+		}
+		for clientIP, scores := range shard.scores {
+			state.Scores[clientIP] = append([]anomalyScore(nil), scores...)
+		}
+		shard.mu.RUnlock()
+	}
+	return state
+}
+
+// reap removes the offenses and scores older than period, and the bans and jailings that expired.
+func (s *memoryJailStore) reap(now time.Time, period time.Duration) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for clientIP, offenses := range shard.offenses {
+			if len(offenses) == 0 || now.Sub(offenses[len(offenses)-1]) > period {
+				delete(shard.offenses, clientIP)
+			}
+		}
+		for clientIP, scores := range shard.scores {
+			if len(scores) == 0 || now.Sub(scores[len(scores)-1].At) > period {
+				delete(shard.scores, clientIP)
+			}
+		}
+		for clientIP, until := range shard.releases {
+			if !now.Before(until) {
+				delete(shard.releases, clientIP)
+			}
+		}
+		for clientIP, jailing := range shard.jailings {
+			if !now.Before(jailing.Expires) {
+				delete(shard.jailings, clientIP)
+			}
+		}
+		for clientIP := range shard.seen {
+			shard.untrack(clientIP)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// runReaper reaps the store every memoryJailReapInterval until ctx is done, so that clients that never come
+// back don't stay in memory forever, and logs its occupancy every memoryJailStatsInterval. The changes to the
+// jail are saved every memoryJailSaveInterval, and once more when ctx is done.
+func (s *memoryJailStore) runReaper(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(memoryJailReapInterval)
+	defer ticker.Stop()
+	stats := time.NewTicker(memoryJailStatsInterval)
+	defer stats.Stop()
+	saves := time.NewTicker(memoryJailSaveInterval)
+	defer saves.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush()
+			return
+		case now := <-ticker.C:
+			s.reap(now, period)
+		case <-stats.C:
+			s.logStats()
+		case <-saves.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *memoryJailStore) logStats() {
+	s.logger.Info("jail stats", "entries", s.entries(), "maxEntries", s.shardMaxEntries*memoryJailShards, "evicted", s.evictions())
+}
+
+// load restores the jail saved to the persistence path, dropping the bans and offenses that expired meanwhile.
+func (s *memoryJailStore) load(now time.Time, period time.Duration) error {
+	if s.persistencePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.persistencePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state memoryJailState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	for clientIP, release := range state.Releases {
+		if now.Before(release) {
+			shard := s.shard(clientIP)
+			shard.mu.Lock()
+			shard.releases[clientIP] = release
+			s.track(shard, clientIP, now)
+			shard.mu.Unlock()
+		}
+	}
+	for clientIP, jailing := range state.Jailings {
+		if now.Before(jailing.Expires) {
+			shard := s.shard(clientIP)
+			shard.mu.Lock()
+			shard.jailings[clientIP] = jailing
+			s.track(shard, clientIP, now)
+			shard.mu.Unlock()
+		}
+	}
+	for clientIP, offenses := range state.Offenses {
+		shard := s.shard(clientIP)
+		shard.mu.Lock()
+		for _, offense := range offenses {
+			if now.Sub(offense) <= period {
+				shard.offenses[clientIP] = append(shard.offenses[clientIP], offense)
+				s.track(shard, clientIP, now)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	for clientIP, scores := range state.Scores {
+		shard := s.shard(clientIP)
+		shard.mu.Lock()
+		for _, score := range scores {
+			if now.Sub(score.At) <= period {
+				shard.scores[clientIP] = append(shard.scores[clientIP], score)
+				s.track(shard, clientIP, now)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// markDirty records that a client entered or left the jail, for the next flush to save it.
+func (s *memoryJailStore) markDirty() {
+	if s.persistencePath != "" {
+		atomic.StoreInt32(&s.dirty, 1)
+	}
+}
+
+// flush saves the jail if it changed since it was last saved.
+func (s *memoryJailStore) flush() {
+	if atomic.CompareAndSwapInt32(&s.dirty, 1, 0) {
+		s.save()
+	}
+}
+
+// save writes the jail to the persistence path, through a temporary file so that a crash never leaves it half
+// written. It is called from the reaper, off the request path, without any shard lock held.
+func (s *memoryJailStore) save() {
+	if s.persistencePath == "" {
+		return
+	}
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	data, err := json.Marshal(s.snapshot())
+	if err == nil {
+		tmp := s.persistencePath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.persistencePath)
+		}
+	}
+	if err != nil {
+		s.logger.Warn("fail to persist jail", "path", s.persistencePath, "error", err)
+	}
+}
+
+// redisJailStore a jailStore shared by every Traefik replica using the same redis server, so that a client
+// is jailed everywhere as soon as it reached the threshold through any of them. Offenses and scores are kept in
+// sorted sets by time, counted over a sliding window of the threshold period, and bans expire on their own.
+type redisJailStore struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisJailStore(client *redisClient, prefix string) *redisJailStore {
+	return &redisJailStore{client: client, prefix: prefix + "jail:"}
+}
+
+// slide adds a member to the sorted set of a client, scored by the time it happened, after removing the members
+// older than period. Members must be unique, the sorted set would keep a single one otherwise.
+func (s *redisJailStore) slide(key, member string, now time.Time, period time.Duration) error {
+	cutoff := now.Add(-period).UnixMilli()
+	if _, err := s.client.Do("ZREMRANGEBYSCORE", key, "-inf", "("+strconv.FormatInt(cutoff, 10)); err != nil {
+		return err
+	}
+	if _, err := s.client.Do("ZADD", key, strconv.FormatInt(now.UnixMilli(), 10), member); err != nil {
+		return err
+	}
+	_, err := s.client.Do("PEXPIRE", key, strconv.FormatInt(period.Milliseconds(), 10))
+	return err
+}
+
+// windowMember returns a member of a sorted set unique across replicas, ending with value.
+func windowMember(now time.Time, value string) string {
+	return strconv.FormatInt(now.UnixNano(), 36) + "." + strconv.FormatInt(rand.Int63(), 36) + ":" + value
+}
+
+func (s *redisJailStore) AddOffense(clientIP string, now time.Time, period time.Duration) (int, error) {
+	key := s.prefix + "offenseLog:" + clientIP
+	if err := s.slide(key, windowMember(now, "1"), now, period); err != nil {
+		return 0, err
+	}
+	reply, err := s.client.Do("ZCARD", key)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected ZCARD reply %T", reply)
+	}
+	return int(count), nil
+}
+
+func (s *redisJailStore) AddScore(clientIP string, score int, now time.Time, period time.Duration) (int, error) {
+	key := s.prefix + "scoreLog:" + clientIP
+	if err := s.slide(key, windowMember(now, strconv.Itoa(score)), now, period); err != nil {
+		return 0, err
+	}
+	reply, err := s.client.Do("ZRANGE", key, "0", "-1")
+	if err != nil {
+		return 0, err
+	}
+	members, ok := reply.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected ZRANGE reply %T", reply)
+	}
+	total := 0
+	for _, member := range members {
+		_, value, _ := strings.Cut(fmt.Sprint(member), ":")
+		n, _ := strconv.Atoi(value)
+		total += n
+	}
+	return total, nil
+}
+
+func (s *redisJailStore) Ban(clientIP string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := s.client.Do("SET", s.prefix+"ban:"+clientIP, strconv.FormatInt(until.UnixMilli(), 10), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (s *redisJailStore) BannedUntil(clientIP string) (time.Time, error) {
+	reply, err := s.client.Do("GET", s.prefix+"ban:"+clientIP)
+	if err != nil || reply == nil {
+		return time.Time{}, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	ms, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func (s *redisJailStore) Release(clientIP string) error {
+	_, err := s.client.Do("DEL", s.prefix+"ban:"+clientIP, s.prefix+"offenseLog:"+clientIP, s.prefix+"scoreLog:"+clientIP)
+	return err
+}
+
+func (s *redisJailStore) AddJailing(clientIP string, now time.Time, memory time.Duration) (int, error) {
+	key := s.prefix + "jailings:" + clientIP
+	reply, err := s.client.Do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %T", reply)
+	}
+	if _, err := s.client.Do("PEXPIRE", key, strconv.FormatInt(memory.Milliseconds(), 10)); err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// Bans walks the ban keys with SCAN, which unlike KEYS doesn't block the redis server.
+func (s *redisJailStore) Bans() (map[string]time.Time, error) {
+	bans := make(map[string]time.Time)
+	cursor := "0"
+	for {
+		reply, err := s.client.Do("SCAN", cursor, "MATCH", s.prefix+"ban:*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %T", reply)
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			clientIP := strings.TrimPrefix(fmt.Sprint(key), s.prefix+"ban:")
+			until, err := s.BannedUntil(clientIP)
+			if err != nil {
+				return nil, err
+			}
+			if !until.IsZero() {
+				bans[clientIP] = until
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return bans, nil
+		}
+	}
+}
@@ -0,0 +1,800 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJail(t *testing.T, store jailStore) (*jail, *time.Time) {
+	l, err := newLogger(io.Discard, "info", "text", "waf")
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	now := time.Now()
+	j := newJail(store, 2, time.Minute, 10*time.Minute, l)
+	j.nowFn = func() time.Time { return now }
+	return j, &now
+}
+
+func newTestMemoryJailStore(persistencePath string) *memoryJailStore {
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	return newMemoryJailStore(persistencePath, 0, l)
+}
+
+func TestJail_ThresholdAndRelease(t *testing.T) {
+	store := newTestMemoryJailStore("")
+	j, now := newTestJail(t, store)
+
+	assert.False(t, j.recordOffense("192.0.2.1"))
+	assert.False(t, j.isJailed("192.0.2.1"))
+	assert.True(t, j.recordOffense("192.0.2.1"))
+	assert.True(t, j.isJailed("192.0.2.1"))
+	assert.False(t, j.isJailed("192.0.2.2"))
+
+	// Released once the time is served, without deadlocking
+	*now = now.Add(10 * time.Minute)
+	assert.False(t, j.isJailed("192.0.2.1"))
+	state := store.snapshot()
+	assert.Empty(t, state.Releases)
+	assert.Empty(t, state.Offenses)
+}
+
+func TestJail_OffensesExpire(t *testing.T) {
+	j, now := newTestJail(t, newTestMemoryJailStore(""))
+
+	j.recordOffense("192.0.2.1")
+	*now = now.Add(2 * time.Minute)
+	assert.False(t, j.recordOffense("192.0.2.1"))
+	assert.False(t, j.isJailed("192.0.2.1"))
+}
+
+func TestMemoryJailStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jail.json")
+	now := time.Now()
+
+	store := newTestMemoryJailStore(path)
+	store.AddOffense("192.0.2.1", now.Add(-2*time.Minute), time.Minute)
+	store.AddOffense("192.0.2.3", now, time.Minute)
+	store.Ban("192.0.2.1", now.Add(time.Minute))
+	store.Ban("192.0.2.2", now.Add(-time.Second))
+
+	// Bans are saved by the next flush, not by the request that jailed the client
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	store.flush()
+
+	restored := newTestMemoryJailStore(path)
+	assert.NoError(t, restored.load(now, time.Minute))
+	state := restored.snapshot()
+	assert.Len(t, state.Releases, 1)
+	assert.True(t, now.Add(time.Minute).Equal(state.Releases["192.0.2.1"]))
+	assert.Len(t, state.Offenses["192.0.2.3"], 1)
+	assert.NotContains(t, state.Offenses, "192.0.2.1")
+
+	// Releases are persisted too
+	assert.NoError(t, restored.Release("192.0.2.1"))
+	restored.flush()
+	reloaded := newTestMemoryJailStore(path)
+	assert.NoError(t, reloaded.load(now, time.Minute))
+	assert.Empty(t, reloaded.snapshot().Releases)
+
+	// The reaper saves the changes left once it stops
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reloaded.runReaper(ctx, time.Minute)
+		close(done)
+	}()
+	reloaded.Ban("192.0.2.4", now.Add(time.Minute))
+	cancel()
+	<-done
+	final := newTestMemoryJailStore(path)
+	assert.NoError(t, final.load(now, time.Minute))
+	assert.Contains(t, final.snapshot().Releases, "192.0.2.4")
+}
+
+func TestMemoryJailStore_LoadMissingOrCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jail.json")
+
+	store := newTestMemoryJailStore(path)
+	assert.NoError(t, store.load(time.Now(), time.Minute))
+
+	assert.NoError(t, os.WriteFile(path, []byte("{not json"), 0o600))
+	assert.Error(t, store.load(time.Now(), time.Minute))
+}
+
+func TestRedisJailStore(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := newRedisJailStore(newRedisClient(server.Addr(), "", 0, time.Second), "test:")
+	now := time.Now()
+
+	count, err := store.AddOffense("192.0.2.1", now, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = store.AddOffense("192.0.2.1", now, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Contains(t, server.expires, "test:jail:offenseLog:192.0.2.1")
+
+	until, err := store.BannedUntil("192.0.2.1")
+	assert.NoError(t, err)
+	assert.True(t, until.IsZero())
+
+	assert.NoError(t, store.Ban("192.0.2.1", now.Add(time.Minute)))
+	until, err = store.BannedUntil("192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute).UnixMilli(), until.UnixMilli())
+
+	assert.NoError(t, store.Release("192.0.2.1"))
+	until, err = store.BannedUntil("192.0.2.1")
+	assert.NoError(t, err)
+	assert.True(t, until.IsZero())
+	assert.Empty(t, server.strings)
+	assert.Empty(t, server.zsets)
+}
+
+func TestJailStore_SlidingWindow(t *testing.T) {
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			var store jailStore = newTestMemoryJailStore("")
+			if backend == "redis" {
+				store = newRedisJailStore(newRedisClient(newFakeRedis(t, "").Addr(), "", 0, time.Second), "test:")
+			}
+			now := time.Now()
+
+			// A burst straddling what used to be a window boundary is counted as a whole
+			for i, expected := range []int{1, 2, 3, 4} {
+				count, err := store.AddOffense("192.0.2.1", now.Add(time.Duration(50+i*5)*time.Second), time.Minute)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, count)
+			}
+			count, _ := store.AddOffense("192.0.2.1", now.Add(112*time.Second), time.Minute)
+			assert.Equal(t, 4, count)
+			count, _ = store.AddOffense("192.0.2.1", now.Add(180*time.Second), time.Minute)
+			assert.Equal(t, 1, count)
+
+			total, err := store.AddScore("192.0.2.1", 5, now, time.Minute)
+			assert.NoError(t, err)
+			assert.Equal(t, 5, total)
+			total, _ = store.AddScore("192.0.2.1", 5, now.Add(30*time.Second), time.Minute)
+			assert.Equal(t, 10, total)
+			total, _ = store.AddScore("192.0.2.1", 3, now.Add(70*time.Second), time.Minute)
+			assert.Equal(t, 8, total)
+		})
+	}
+}
+
+func TestModsecurity_SharedRedisJail(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailEnabled = true
+	config.JailBackend = "redis"
+	config.BadRequestsThresholdCount = 2
+	config.RedisAddress = newFakeRedis(t, "").Addr()
+
+	// Two replicas sharing the same redis server
+	var replicas []http.Handler
+	for i := 0; i < 2; i++ {
+		middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+		if err != nil {
+			t.Fatalf("Failed to create middleware: %v", err)
+		}
+		replicas = append(replicas, middleware)
+	}
+
+	serve := func(replica http.Handler, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "198.51.100.1:5555"
+		rw := httptest.NewRecorder()
+		replica.ServeHTTP(rw, req)
+		return rw.Result().StatusCode
+	}
+
+	serve(replicas[0], "/attack")
+	serve(replicas[1], "/attack")
+	assert.Equal(t, http.StatusTooManyRequests, serve(replicas[0], "/test"))
+	assert.Equal(t, http.StatusTooManyRequests, serve(replicas[1], "/test"))
+}
+
+func TestModsecurity_JailConfig(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf:8080"
+	config.JailEnabled = true
+
+	config.JailBackend = "etcd"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+
+	config.JailBackend = "redis"
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestJail_Escalation(t *testing.T) {
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			var store jailStore = newTestMemoryJailStore("")
+			if backend == "redis" {
+				store = newRedisJailStore(newRedisClient(newFakeRedis(t, "").Addr(), "", 0, time.Second), "test:")
+			}
+			j, now := newTestJail(t, store)
+			j.threshold = 1
+			j.escalationFactor = 6
+			j.escalationReset = 24 * time.Hour
+			j.maxDuration = 24 * time.Hour
+
+			jailFor := func() time.Duration {
+				assert.True(t, j.recordOffense("192.0.2.1"))
+				until, err := store.BannedUntil("192.0.2.1")
+				assert.NoError(t, err)
+				assert.NoError(t, store.Release("192.0.2.1"))
+				return until.Sub(*now).Round(time.Second)
+			}
+
+			assert.Equal(t, 10*time.Minute, jailFor())
+			assert.Equal(t, time.Hour, jailFor())
+			assert.Equal(t, 6*time.Hour, jailFor())
+			assert.Equal(t, 24*time.Hour, jailFor())
+			assert.Equal(t, 24*time.Hour, jailFor())
+		})
+	}
+}
+
+func TestJail_RecordScore(t *testing.T) {
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			var store jailStore = newTestMemoryJailStore("")
+			if backend == "redis" {
+				store = newRedisJailStore(newRedisClient(newFakeRedis(t, "").Addr(), "", 0, time.Second), "test:")
+			}
+			j, _ := newTestJail(t, store)
+			j.scoreThreshold = 20
+
+			assert.False(t, j.recordScore("192.0.2.1", 5))
+			assert.False(t, j.recordScore("192.0.2.1", 10))
+			assert.False(t, j.recordScore("192.0.2.2", 10))
+			assert.True(t, j.recordScore("192.0.2.1", 5))
+			assert.True(t, j.isJailed("192.0.2.1"))
+			assert.False(t, j.isJailed("192.0.2.2"))
+
+			// Released clients start over
+			assert.NoError(t, store.Release("192.0.2.1"))
+			assert.False(t, j.recordScore("192.0.2.1", 5))
+		})
+	}
+}
+
+func TestMemoryJailStore_ScoresExpire(t *testing.T) {
+	store := newTestMemoryJailStore("")
+	now := time.Now()
+
+	total, _ := store.AddScore("192.0.2.1", 5, now, time.Minute)
+	assert.Equal(t, 5, total)
+	total, _ = store.AddScore("192.0.2.1", 10, now.Add(30*time.Second), time.Minute)
+	assert.Equal(t, 15, total)
+	total, _ = store.AddScore("192.0.2.1", 3, now.Add(80*time.Second), time.Minute)
+	assert.Equal(t, 13, total)
+
+	store.reap(now.Add(3*time.Minute), time.Minute)
+	assert.Empty(t, store.snapshot().Scores)
+}
+
+func TestModsecurity_JailAnomalyScore(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Anomaly-Score", "3")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailEnabled = true
+	config.JailAnomalyScoreThreshold = 10
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// Borderline requests go through until their scores add up to the threshold
+	for i := 0; i < 4; i++ {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/search?q=borderline", nil))
+		assert.Equal(t, http.StatusOK, rw.Code, "request %d", i)
+	}
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/search?q=borderline", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, int64(1), middleware.(*Modsecurity).metrics.jailed)
+
+	config.JailEnabled = false
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestMemoryJailStore_JailingsExpire(t *testing.T) {
+	store := newTestMemoryJailStore("")
+	now := time.Now()
+
+	count, _ := store.AddJailing("192.0.2.1", now, time.Hour)
+	assert.Equal(t, 1, count)
+	count, _ = store.AddJailing("192.0.2.1", now.Add(59*time.Minute), time.Hour)
+	assert.Equal(t, 2, count)
+	count, _ = store.AddJailing("192.0.2.1", now.Add(2*time.Hour), time.Hour)
+	assert.Equal(t, 1, count)
+}
+
+func TestModsecurity_JailExemptSourceRanges(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 2
+	config.JailExemptSourceRanges = []string{"10.0.0.0/8"}
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Result().StatusCode
+	}
+
+	for i := 0; i < 3; i++ {
+		// Exempt clients are still blocked request by request
+		assert.Equal(t, http.StatusForbidden, serve("10.0.0.1:5555"))
+	}
+	serve("192.0.2.1:5555")
+	serve("192.0.2.1:5555")
+	assert.Equal(t, http.StatusTooManyRequests, serve("192.0.2.1:5555"))
+
+	config.JailExemptSourceRanges = []string{"office"}
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestMemoryJailStore_Reap(t *testing.T) {
+	store := newTestMemoryJailStore("")
+	now := time.Now()
+
+	store.AddOffense("192.0.2.1", now.Add(-2*time.Minute), time.Minute)
+	store.AddOffense("192.0.2.2", now, time.Minute)
+	store.Ban("192.0.2.3", now.Add(-time.Second))
+	store.Ban("192.0.2.4", now.Add(time.Minute))
+	store.AddJailing("192.0.2.5", now.Add(-2*time.Hour), time.Hour)
+
+	store.reap(now, time.Minute)
+	state := store.snapshot()
+	assert.Len(t, state.Offenses, 1)
+	assert.Contains(t, state.Offenses, "192.0.2.2")
+	assert.Len(t, state.Releases, 1)
+	assert.Contains(t, state.Releases, "192.0.2.4")
+	assert.Empty(t, state.Jailings)
+	assert.Equal(t, 2, store.entries())
+}
+
+func TestMemoryJailStore_MaxEntries(t *testing.T) {
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	store := newMemoryJailStore("", 2*memoryJailShards, l)
+	now := time.Now().Add(time.Hour)
+
+	// Three clients landing on the same shard as the jailed one
+	jailed := "192.0.2.1"
+	var clients []string
+	for i := 2; len(clients) < 3; i++ {
+		clientIP := fmt.Sprintf("192.0.2.%d", i)
+		if store.shard(clientIP) == store.shard(jailed) {
+			clients = append(clients, clientIP)
+		}
+	}
+
+	// The jailed client is the oldest, but evicted last
+	store.Ban(jailed, now.Add(time.Hour))
+	store.AddOffense(clients[0], now, time.Minute)
+	store.AddOffense(clients[1], now.Add(time.Second), time.Minute)
+	assert.Equal(t, 2, store.entries())
+	assert.Equal(t, int64(1), store.evictions())
+	until, _ := store.BannedUntil(jailed)
+	assert.False(t, until.IsZero())
+	assert.NotContains(t, store.snapshot().Offenses, clients[0])
+
+	// Clients already tracked don't evict anyone
+	store.AddOffense(clients[1], now.Add(2*time.Second), time.Minute)
+	assert.Equal(t, int64(1), store.evictions())
+
+	// Once every client is jailed, the oldest jailed one goes
+	store.Ban(clients[1], now.Add(time.Hour))
+	store.AddOffense(clients[2], now.Add(3*time.Second), time.Minute)
+	assert.Equal(t, int64(2), store.evictions())
+	until, _ = store.BannedUntil(jailed)
+	assert.True(t, until.IsZero())
+}
+
+func TestMemoryJailStore_Concurrent(t *testing.T) {
+	store := newTestMemoryJailStore(filepath.Join(t.TempDir(), "jail.json"))
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clientIP := fmt.Sprintf("192.0.2.%d", i)
+			for k := 0; k < 100; k++ {
+				store.AddOffense(clientIP, now, time.Minute)
+				store.BannedUntil(clientIP)
+			}
+			store.Ban(clientIP, now.Add(time.Minute))
+			store.Bans()
+			store.Release(clientIP)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Empty(t, store.snapshot().Releases)
+}
+
+func TestModsecurity_JailResponse(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name              string
+		statusCode        int
+		body              string
+		contentType       string
+		headers           map[string]string
+		expectStatus      int
+		expectBody        string
+		expectContentType string
+	}{
+		{
+			name:              "Default response",
+			expectStatus:      http.StatusTooManyRequests,
+			expectBody:        "Too Many Requests\n",
+			expectContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:              "Custom response",
+			statusCode:        http.StatusForbidden,
+			body:              `{"error": "banned"}`,
+			contentType:       "application/json",
+			headers:           map[string]string{"Cache-Control": "no-store"},
+			expectStatus:      http.StatusForbidden,
+			expectBody:        `{"error": "banned"}`,
+			expectContentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.JailEnabled = true
+			config.BadRequestsThresholdCount = 1
+			config.JailTimeDurationSecs = 120
+			if tt.statusCode != 0 {
+				config.JailResponseStatusCode = tt.statusCode
+			}
+			config.JailResponseBody = tt.body
+			config.JailResponseContentType = tt.contentType
+			config.JailResponseHeaders = tt.headers
+
+			middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectBody, rw.Body.String())
+			assert.Equal(t, tt.expectContentType, rw.Header().Get("Content-Type"))
+			assert.Equal(t, "120", rw.Header().Get("Retry-After"))
+			for k, v := range tt.headers {
+				assert.Equal(t, v, rw.Header().Get(k))
+			}
+		})
+	}
+}
+
+func TestModsecurity_JailOnStatusCodes(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/attack":
+			w.WriteHeader(http.StatusForbidden)
+		case "/upload":
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name        string
+		statusCodes []int
+		path        string
+		expectJail  bool
+	}{
+		{name: "Counts 403 by default", path: "/attack", expectJail: true},
+		{name: "Ignores 413 by default", path: "/upload", expectJail: false},
+		{name: "Ignores 400 by default", path: "/malformed", expectJail: false},
+		{name: "Counts configured codes", statusCodes: []int{400, 403}, path: "/malformed", expectJail: true},
+		{name: "Ignores codes that are not configured", statusCodes: []int{400}, path: "/attack", expectJail: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.JailEnabled = true
+			config.BadRequestsThresholdCount = 2
+			if tt.statusCodes != nil {
+				config.JailOnStatusCodes = tt.statusCodes
+			}
+
+			middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.expectJail, rw.Code == http.StatusTooManyRequests)
+		})
+	}
+}
+
+func TestModsecurity_JailLoginPaths(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	tests := []struct {
+		name        string
+		statusCodes []int
+		path        string
+		password    string
+		expectJail  bool
+	}{
+		{name: "Counts failed logins", path: "/login", password: "guess", expectJail: true},
+		{name: "Ignores successful logins", path: "/login", password: "secret", expectJail: false},
+		{name: "Ignores other paths", path: "/account", password: "guess", expectJail: false},
+		{name: "Ignores codes that are not configured", statusCodes: []int{403}, path: "/login", password: "guess", expectJail: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.JailEnabled = true
+			config.BadRequestsThresholdCount = 2
+			config.JailLoginPaths = []string{"^/login$"}
+			if tt.statusCodes != nil {
+				config.JailOnLoginStatusCodes = tt.statusCodes
+			}
+
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path+"?password="+tt.password, nil))
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path+"?password=secret", nil))
+			assert.Equal(t, tt.expectJail, rw.Code == http.StatusTooManyRequests)
+		})
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailLoginPaths = []string{"^/login$"}
+	_, err := New(context.Background(), next, config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestJail_Subnet(t *testing.T) {
+	j, _ := newTestJail(t, newTestMemoryJailStore(""))
+	j.threshold = 10
+	j.subnetThreshold = 3
+	j.subnetIPv4Prefix = 24
+	j.subnetIPv6Prefix = 64
+
+	assert.Equal(t, "198.51.100.0/24", j.subnet("198.51.100.7"))
+	assert.Equal(t, "2001:db8:0:1::/64", j.subnet("2001:db8:0:1:2:3:4:5"))
+
+	// Addresses rotating within the subnet get it jailed as a whole
+	assert.False(t, j.recordOffense("198.51.100.1"))
+	assert.False(t, j.recordOffense("198.51.100.2"))
+	assert.True(t, j.recordOffense("198.51.100.3"))
+	assert.True(t, j.isJailed("198.51.100.200"))
+	assert.False(t, j.isJailed("198.51.101.1"))
+
+	j.subnetThreshold = 0
+	assert.Equal(t, "", j.subnet("198.51.100.7"))
+}
+
+func TestModsecurity_JailSubnetConfig(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf:8080"
+	config.JailEnabled = true
+	config.JailSubnetThresholdCount = 100
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.NoError(t, err)
+
+	config.JailSubnetIPv4Prefix = 33
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_JailKey(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 2
+	config.JailKeyCookie = "session"
+	config.JailKeyHeader = "X-Api-Key"
+	config.JailExemptSourceRanges = []string{"203.0.113.0/24"}
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+
+	request := func(remoteAddr, session, apiKey string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/attack", nil)
+		req.RemoteAddr = remoteAddr
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		return req
+	}
+
+	alice := a.jailKey(request("192.0.2.1:1234", "alice", ""), "192.0.2.1")
+	assert.Regexp(t, "^session:[0-9a-f]{32}$", alice)
+	assert.Equal(t, alice, a.jailKey(request("192.0.2.2:1234", "alice", "key"), "192.0.2.2"))
+	assert.Regexp(t, "^session:", a.jailKey(request("192.0.2.1:1234", "", "key"), "192.0.2.1"))
+	assert.Equal(t, "192.0.2.1", a.jailKey(request("192.0.2.1:1234", "", ""), "192.0.2.1"))
+	assert.Equal(t, "203.0.113.1", a.jailKey(request("203.0.113.1:1234", "alice", ""), "203.0.113.1"))
+
+	// Alice gets jailed, whatever her address, but not Bob behind the same NAT
+	for i := 0; i < 2; i++ {
+		middleware.ServeHTTP(httptest.NewRecorder(), request("192.0.2.1:1234", "alice", ""))
+	}
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, request("192.0.2.9:1234", "alice", ""))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, request("192.0.2.1:1234", "bob", ""))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.True(t, a.jail.isJailed(alice))
+	assert.False(t, a.jail.isJailed("192.0.2.1"))
+
+	// A client jailed by its address can't get out by adding the cookie
+	for i := 0; i < 2; i++ {
+		middleware.ServeHTTP(httptest.NewRecorder(), request("192.0.2.3:1234", "", ""))
+	}
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, request("192.0.2.3:1234", "carol", ""))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	key, ok := parseJailKey(strings.ToUpper(alice[len(jailSessionPrefix):]))
+	assert.False(t, ok)
+	key, ok = parseJailKey(jailSessionPrefix + strings.ToUpper(alice[len(jailSessionPrefix):]))
+	assert.True(t, ok)
+	assert.Equal(t, alice, key)
+	_, ok = parseJailKey(jailSessionPrefix + "alice")
+	assert.False(t, ok)
+
+	config.JailEnabled = false
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_Scope(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 2
+	config.Scope = scopePerRouter
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+
+	serve := func(host string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/attack", nil)
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// The client is jailed on the first host only
+	for i := 0; i < 2; i++ {
+		serve("a.example.com")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve("A.example.com:8443"))
+	assert.Equal(t, http.StatusForbidden, serve("b.example.com"))
+	assert.True(t, a.jail.isJailed("a.example.com|192.0.2.1"))
+	assert.False(t, a.jail.isJailed("192.0.2.1"))
+	assert.True(t, a.cacheKeyIncludeHost)
+
+	key, ok := parseJailKey("A.example.com|192.0.2.1")
+	assert.True(t, ok)
+	assert.Equal(t, "a.example.com|192.0.2.1", key)
+	assert.False(t, isAddressJailKey(key))
+	_, ok = parseJailKey("|192.0.2.1")
+	assert.False(t, ok)
+
+	config.JailSubnetThresholdCount = 2
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+
+	config.JailSubnetThresholdCount = 0
+	config.Scope = "perHost"
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
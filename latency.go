@@ -0,0 +1,106 @@
+package traefik_modsecurity_plugin
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindow how far back the modsecurity round trips the p95 is computed from go.
+	latencyWindow = 10 * time.Second
+	// latencySamples round trips kept, the oldest ones are overwritten under heavy traffic.
+	latencySamples = 1024
+	// latencyMinSamples round trips in the window below which inspection is never degraded.
+	latencyMinSamples = 20
+	// latencyEvalInterval how often the p95 is computed.
+	latencyEvalInterval = time.Second
+	// latencyProbeInterval how often a request is still inspected while modsecurity is bypassed, to measure
+	// whether its latency recovered.
+	latencyProbeInterval = 100 * time.Millisecond
+)
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// latencyGuard tracks the rolling p95 of modsecurity round trips, and degrades inspection while it is over
+// the threshold.
+type latencyGuard struct {
+	mu        sync.Mutex
+	samples   [latencySamples]latencySample
+	next      int
+	threshold time.Duration
+	degraded  bool
+	lastEval  time.Time
+	lastProbe time.Time
+	nowFn     func() time.Time
+	logger    *logger
+}
+
+func newLatencyGuard(threshold time.Duration, logger *logger) *latencyGuard {
+	return &latencyGuard{threshold: threshold, nowFn: time.Now, logger: logger}
+}
+
+// isDegraded reports whether the p95 was over the threshold when it was last computed.
+func (g *latencyGuard) isDegraded() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.degraded
+}
+
+// probe reports whether a request should be inspected anyway while modsecurity is bypassed, one every
+// latencyProbeInterval.
+func (g *latencyGuard) probe() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.nowFn()
+	if now.Sub(g.lastProbe) < latencyProbeInterval {
+		return false
+	}
+	g.lastProbe = now
+	return true
+}
+
+// observe records a modsecurity round trip, and switches in or out of degraded inspection once per
+// latencyEvalInterval.
+func (g *latencyGuard) observe(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.nowFn()
+	g.samples[g.next] = latencySample{at: now, duration: d}
+	g.next = (g.next + 1) % latencySamples
+	if now.Sub(g.lastEval) < latencyEvalInterval {
+		return
+	}
+	g.lastEval = now
+
+	p95, count := g.percentile(now, 0.95)
+	switch {
+	case !g.degraded && count >= latencyMinSamples && p95 > g.threshold:
+		g.degraded = true
+		g.logger.Error("modsec p95 latency over threshold, degrading inspection", "p95", p95.String(), "threshold", g.threshold.String())
+	case g.degraded && count > 0 && p95 <= g.threshold:
+		g.degraded = false
+		g.logger.Warn("modsec p95 latency recovered, resuming full inspection", "p95", p95.String(), "threshold", g.threshold.String())
+	}
+}
+
+// percentile returns the given percentile of the round trips within latencyWindow, along with their count.
+func (g *latencyGuard) percentile(now time.Time, p float64) (time.Duration, int) {
+	var durations []time.Duration
+	for _, s := range g.samples {
+		if !s.at.IsZero() && now.Sub(s.at) <= latencyWindow {
+			durations = append(durations, s.duration)
+		}
+	}
+	if len(durations) == 0 {
+		return 0, 0
+	}
+	sort.Slice(durations, func(i, k int) bool { return durations[i] < durations[k] })
+	return durations[int(math.Ceil(p*float64(len(durations))))-1], len(durations)
+}
@@ -0,0 +1,132 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyGuard(t *testing.T) {
+	var logs bytes.Buffer
+	l, _ := newLogger(&logs, "info", "text", "waf")
+	now := time.Now()
+	g := newLatencyGuard(50*time.Millisecond, l)
+	g.nowFn = func() time.Time { return now }
+
+	// Too few round trips, whatever their latency
+	for i := 0; i < latencyMinSamples-1; i++ {
+		g.observe(time.Second)
+	}
+	assert.False(t, g.isDegraded())
+
+	// The p95 is over the threshold
+	now = now.Add(latencyEvalInterval)
+	g.observe(time.Second)
+	assert.True(t, g.isDegraded())
+	assert.Contains(t, logs.String(), "modsec p95 latency over threshold")
+
+	// Probes are spaced out
+	assert.True(t, g.probe())
+	assert.False(t, g.probe())
+	now = now.Add(latencyProbeInterval)
+	assert.True(t, g.probe())
+
+	// The slow round trips are still in the window
+	now = now.Add(latencyEvalInterval)
+	g.observe(time.Millisecond)
+	assert.True(t, g.isDegraded())
+
+	// Once they leave it, the fast ones make the p95
+	now = now.Add(latencyWindow)
+	g.observe(time.Millisecond)
+	assert.False(t, g.isDegraded())
+	assert.Contains(t, logs.String(), "modsec p95 latency recovered")
+}
+
+func TestLatencyGuard_Percentile(t *testing.T) {
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	now := time.Now()
+	g := newLatencyGuard(time.Second, l)
+	g.nowFn = func() time.Time { return now }
+
+	for i := 1; i <= 100; i++ {
+		g.observe(time.Duration(i) * time.Millisecond)
+	}
+	p95, count := g.percentile(now, 0.95)
+	assert.Equal(t, 95*time.Millisecond, p95)
+	assert.Equal(t, 100, count)
+
+	// The buffer keeps the most recent round trips only
+	for i := 0; i < latencySamples; i++ {
+		g.observe(time.Millisecond)
+	}
+	p95, count = g.percentile(now, 0.95)
+	assert.Equal(t, time.Millisecond, p95)
+	assert.Equal(t, latencySamples, count)
+}
+
+func TestModsecurity_LatencyBypass(t *testing.T) {
+	tests := []struct {
+		action       string
+		expectCalls  int
+		expectBodies []string
+	}{
+		{action: "bypass", expectCalls: 1, expectBodies: []string{"a=1"}},
+		{action: "headersOnly", expectCalls: 3, expectBodies: []string{"", "", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			var bodies []string
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			var nextBodies []string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				nextBodies = append(nextBodies, string(body))
+			})
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.LatencyBypassThresholdMillis = 50
+			config.LatencyBypassAction = tt.action
+
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+			guard := middleware.(*Modsecurity).latencyGuard
+			guard.degraded = true
+			// Keep the guard from evaluating the round trips of the test
+			guard.lastEval = time.Now()
+
+			for i := 0; i < 3; i++ {
+				rw := httptest.NewRecorder()
+				middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("a=1")))
+				assert.Equal(t, http.StatusOK, rw.Code)
+			}
+			assert.Len(t, bodies, tt.expectCalls)
+			assert.Equal(t, tt.expectBodies, bodies)
+			assert.Equal(t, []string{"a=1", "a=1", "a=1"}, nextBodies)
+		})
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.LatencyBypassThresholdMillis = 50
+	config.LatencyBypassAction = "reject"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
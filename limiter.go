@@ -0,0 +1,127 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// limiter bounds the modsecurity calls in flight. Requests beyond the limit wait in a bounded queue
+// for a call to complete, and are turned away when the queue is full or their wait times out.
+type limiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func newLimiter(maxConcurrent int, queueSize int, timeout time.Duration) *limiter {
+	return &limiter{
+		slots:   make(chan struct{}, maxConcurrent),
+		queue:   make(chan struct{}, queueSize),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting in the queue for one when they are all taken. It reports false when the
+// queue is full, the wait timed out or ctx is done; otherwise release must be called once the call is over.
+func (l *limiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-l.queue }()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// adaptiveBackoff factor the window is multiplied by when modsecurity answers slower than the target.
+const adaptiveBackoff = 0.9
+
+// adaptiveLimiter bounds the modsecurity calls in flight with a window following the modsecurity latency
+// (AIMD): the window grows by one call per window of calls answered within the target latency, and shrinks
+// by adaptiveBackoff when a call is slower, at most once per target latency so that a burst of slow calls
+// that were already in flight only counts once. Calls beyond the window are turned away straight away.
+type adaptiveLimiter struct {
+	mu           sync.Mutex
+	window       float64
+	minWindow    float64
+	maxWindow    float64
+	inFlight     int
+	target       time.Duration
+	lastDecrease time.Time
+	nowFn        func() time.Time
+	logger       *logger
+}
+
+// newAdaptiveLimiter starts with the maximum window, so that calls are only shed once modsecurity slows down.
+func newAdaptiveLimiter(minWindow, maxWindow int, target time.Duration, logger *logger) *adaptiveLimiter {
+	return &adaptiveLimiter{
+		window:    float64(maxWindow),
+		minWindow: float64(minWindow),
+		maxWindow: float64(maxWindow),
+		target:    target,
+		nowFn:     time.Now,
+		logger:    logger,
+	}
+}
+
+// acquire takes a place in the window, it reports false when the window is full; otherwise release
+// must be called with the latency of the call once it is over.
+func (l *adaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= int(l.window) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+func (l *adaptiveLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Growing the window is pointless while it isn't used
+	utilized := float64(l.inFlight) >= l.window/2
+	l.inFlight--
+
+	if latency <= l.target {
+		if utilized && l.window < l.maxWindow {
+			l.window = math.Min(l.maxWindow, l.window+1/l.window)
+		}
+		return
+	}
+
+	now := l.nowFn()
+	if now.Sub(l.lastDecrease) < l.target {
+		return
+	}
+	l.lastDecrease = now
+	if window := math.Max(l.minWindow, l.window*adaptiveBackoff); window < l.window {
+		l.window = window
+		l.logger.Debug("modsec is slow, shrinking concurrency window", "latency", latency.String(), "window", int(window))
+	}
+}
@@ -0,0 +1,173 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1, 1, 50*time.Millisecond)
+	assert.True(t, l.acquire(context.Background()))
+
+	// The queued request gets the slot once it is released
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// The queue is full
+	assert.False(t, l.acquire(context.Background()))
+
+	l.release()
+	assert.True(t, <-acquired)
+
+	// The wait times out
+	assert.False(t, l.acquire(context.Background()))
+
+	// The client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, l.acquire(ctx))
+
+	l.release()
+	assert.True(t, l.acquire(context.Background()))
+}
+
+func TestModsecurity_MaxConcurrentWafRequests(t *testing.T) {
+	inModsec := make(chan struct{})
+	unblock := make(chan struct{})
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inModsec <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.MaxConcurrentWafRequests = 1
+	config.OverloadRetryAfterSecs = 7
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	done := make(chan int)
+	go func() {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/first", nil))
+		done <- rw.Code
+	}()
+	<-inModsec
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/second", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "7", rw.Header().Get("Retry-After"))
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	now := time.Now()
+	a := newAdaptiveLimiter(2, 4, 100*time.Millisecond, l)
+	a.nowFn = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		assert.True(t, a.acquire(), "call %d", i)
+	}
+	assert.False(t, a.acquire())
+
+	// Slow calls shrink the window once per target latency
+	a.release(time.Second)
+	assert.Equal(t, 3.6, a.window)
+	a.release(time.Second)
+	assert.Equal(t, 3.6, a.window)
+	now = now.Add(100 * time.Millisecond)
+	a.release(time.Second)
+	assert.InDelta(t, 3.24, a.window, 0.001)
+	assert.Equal(t, 1, a.inFlight)
+
+	// The window never goes below the minimum
+	for i := 0; i < 20; i++ {
+		now = now.Add(100 * time.Millisecond)
+		assert.True(t, a.acquire())
+		a.release(time.Second)
+	}
+	assert.Equal(t, 2.0, a.window)
+	assert.True(t, a.acquire())
+	assert.False(t, a.acquire())
+
+	// Fast calls of a used window grow it, up to the maximum
+	for i := 0; i < 100; i++ {
+		a.release(time.Millisecond)
+		assert.True(t, a.acquire())
+	}
+	assert.Equal(t, 4.0, a.window)
+
+	// Unused windows don't grow
+	a.release(time.Millisecond)
+	a.window = 3
+	a.release(time.Millisecond)
+	assert.Equal(t, 3.0, a.window)
+	assert.Equal(t, 0, a.inFlight)
+}
+
+func TestModsecurity_AdaptiveConcurrency(t *testing.T) {
+	inModsec := make(chan struct{})
+	unblock := make(chan struct{})
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			inModsec <- struct{}{}
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.AdaptiveConcurrency = true
+	config.AdaptiveMinConcurrency = 1
+	config.AdaptiveMaxConcurrency = 1
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	done := make(chan int)
+	go func() {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		done <- rw.Code
+	}()
+	<-inModsec
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	config.AdaptiveMinConcurrency = 10
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
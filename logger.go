@@ -0,0 +1,142 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, in increasing order of severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logger a leveled logger writing either free-form text lines or one JSON object per line.
+// Messages take optional key/value pairs, e.g. l.Info("client jailed", "clientIP", ip).
+type logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  int
+	json   bool
+	name   string
+	nowFn  func() time.Time
+	fields []interface{}
+}
+
+// newLogger creates a logger for the given level ("debug", "info", "warn" or "error")
+// and format ("text" or "json"). Empty values default to "info" and "text".
+func newLogger(out io.Writer, level, format, name string) (*logger, error) {
+	l := &logger{mu: &sync.Mutex{}, out: out, name: name, nowFn: time.Now, level: levelInfo}
+
+	if level != "" {
+		found := false
+		for i, levelName := range levelNames {
+			if strings.EqualFold(level, levelName) {
+				l.level = i
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid logLevel %q, must be one of debug, info, warn or error", level)
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("invalid logFormat %q, must be text or json", format)
+	}
+
+	return l, nil
+}
+
+// with returns a logger adding the key/value pairs to every message, writing to the same output.
+func (l *logger) with(kv ...interface{}) *logger {
+	child := *l
+	child.fields = append(append([]interface{}(nil), l.fields...), kv...)
+	return &child
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) enabled(level int) bool {
+	return level >= l.level
+}
+
+func (l *logger) log(level int, msg string, kv []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	if len(l.fields) > 0 {
+		kv = append(append([]interface{}(nil), l.fields...), kv...)
+	}
+
+	now := l.nowFn()
+	var line []byte
+	if l.json {
+		record := map[string]interface{}{
+			"time":       now.Format(time.RFC3339Nano),
+			"level":      levelNames[level],
+			"middleware": l.name,
+			"msg":        msg,
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			record[fmt.Sprint(kv[i])] = jsonValue(kv[i+1])
+		}
+		var err error
+		line, err = json.Marshal(record)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"level":"error","msg":"fail to marshal log record: %s"}`, err.Error()))
+		}
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(levelNames[level]))
+		b.WriteString(" ")
+		b.WriteString(msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %v=%s", kv[i], textValue(kv[i+1]))
+		}
+		line = []byte(b.String())
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// jsonValue makes values that do not marshal to something meaningful, such as errors, printable.
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return v
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(jsonValue(v))
+	if s == "" || strings.ContainsAny(s, " \t\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Levels(t *testing.T) {
+	var out bytes.Buffer
+	l, err := newLogger(&out, "warn", "text", "waf")
+	assert.NoError(t, err)
+	l.nowFn = func() time.Time { return time.Date(2024, 6, 9, 9, 6, 0, 0, time.UTC) }
+
+	l.Debug("debug message")
+	l.Info("info message")
+	l.Warn("client reached threshold", "clientIP", "10.0.0.1", "error", errors.New("some error"))
+
+	assert.Equal(t, "2024/06/09 09:06:00 WARN client reached threshold clientIP=10.0.0.1 error=\"some error\"\n", out.String())
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var out bytes.Buffer
+	l, err := newLogger(&out, "debug", "json", "waf")
+	assert.NoError(t, err)
+	l.nowFn = func() time.Time { return time.Date(2024, 6, 9, 9, 6, 0, 0, time.UTC) }
+
+	l.Debug("detection only, not blocking", "status", 403, "error", errors.New("boom"))
+
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, map[string]interface{}{
+		"time":       "2024-06-09T09:06:00Z",
+		"level":      "debug",
+		"middleware": "waf",
+		"msg":        "detection only, not blocking",
+		"status":     float64(403),
+		"error":      "boom",
+	}, record)
+}
+
+func TestLogger_InvalidConfig(t *testing.T) {
+	_, err := newLogger(&bytes.Buffer{}, "verbose", "text", "waf")
+	assert.Error(t, err)
+
+	_, err = newLogger(&bytes.Buffer{}, "info", "xml", "waf")
+	assert.Error(t, err)
+
+	l, err := newLogger(&bytes.Buffer{}, "", "", "waf")
+	assert.NoError(t, err)
+	assert.Equal(t, levelInfo, l.level)
+	assert.False(t, l.json)
+}
+
+func TestLogger_With(t *testing.T) {
+	var out bytes.Buffer
+	l, err := newLogger(&out, "info", "text", "waf")
+	assert.NoError(t, err)
+	l.nowFn = func() time.Time { return time.Date(2024, 6, 9, 9, 6, 0, 0, time.UTC) }
+
+	l.with("requestID", "abc").Info("request blocked", "status", 403)
+	l.Info("not tagged")
+
+	assert.Equal(t, "2024/06/09 09:06:00 INFO request blocked requestID=abc status=403\n2024/06/09 09:06:00 INFO not tagged\n", out.String())
+}
@@ -0,0 +1,130 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets upper bounds, in seconds, of the modsecurity round-trip histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics counters of the decisions taken by the plugin, exposed in the Prometheus text format.
+type metrics struct {
+	name string
+
+	requests       int64
+	modsecRequests int64
+	modsecErrors   int64
+	blocked        int64
+	jailed         int64
+	jailRejected   int64
+	cacheHits      int64
+	cacheMisses    int64
+	denied         int64
+	overloaded     int64
+	shadowMismatch int64
+	rateLimited    int64
+	wafRateLimited int64
+	budgetExceeded int64
+	localDenied    int64
+
+	// cacheEntries returns the size of the in-memory verdict cache, nil with any other cache
+	cacheEntries func() int
+	// jailEntries and jailEvictions return the occupancy of the in-memory jail, nil with any other jail
+	jailEntries   func() int
+	jailEvictions func() int64
+
+	latencyCounts []int64
+	latencyCount  int64
+	latencySumNs  int64
+}
+
+func newMetrics(name string) *metrics {
+	return &metrics{
+		name:          name,
+		latencyCounts: make([]int64, len(latencyBuckets)),
+	}
+}
+
+func (m *metrics) incRequests()         { atomic.AddInt64(&m.requests, 1) }
+func (m *metrics) incModsecRequests()   { atomic.AddInt64(&m.modsecRequests, 1) }
+func (m *metrics) incModsecErrors()     { atomic.AddInt64(&m.modsecErrors, 1) }
+func (m *metrics) incBlocked()          { atomic.AddInt64(&m.blocked, 1) }
+func (m *metrics) incJailed()           { atomic.AddInt64(&m.jailed, 1) }
+func (m *metrics) incJailRejected()     { atomic.AddInt64(&m.jailRejected, 1) }
+func (m *metrics) incCacheHits()        { atomic.AddInt64(&m.cacheHits, 1) }
+func (m *metrics) incCacheMisses()      { atomic.AddInt64(&m.cacheMisses, 1) }
+func (m *metrics) incDenied()           { atomic.AddInt64(&m.denied, 1) }
+func (m *metrics) incOverloaded()       { atomic.AddInt64(&m.overloaded, 1) }
+func (m *metrics) incShadowMismatches() { atomic.AddInt64(&m.shadowMismatch, 1) }
+func (m *metrics) incRateLimited()      { atomic.AddInt64(&m.rateLimited, 1) }
+func (m *metrics) incWafRateLimited()   { atomic.AddInt64(&m.wafRateLimited, 1) }
+func (m *metrics) incBudgetExceeded()   { atomic.AddInt64(&m.budgetExceeded, 1) }
+func (m *metrics) incLocalDenied()      { atomic.AddInt64(&m.localDenied, 1) }
+
+// observeLatency records the duration of a modsecurity round trip.
+func (m *metrics) observeLatency(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			atomic.AddInt64(&m.latencyCounts[i], 1)
+		}
+	}
+	atomic.AddInt64(&m.latencyCount, 1)
+	atomic.AddInt64(&m.latencySumNs, int64(d))
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(rw)
+}
+
+func (m *metrics) write(w io.Writer) {
+	label := fmt.Sprintf("middleware=%q", m.name)
+
+	counter := func(name, help string, value *int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s{%s} %d\n", name, help, name, name, label, atomic.LoadInt64(value))
+	}
+	counter("traefik_modsecurity_requests_total", "Requests handled by the middleware.", &m.requests)
+	counter("traefik_modsecurity_modsec_requests_total", "Requests forwarded to modsecurity.", &m.modsecRequests)
+	counter("traefik_modsecurity_modsec_errors_total", "Modsecurity calls that failed to give a verdict.", &m.modsecErrors)
+	counter("traefik_modsecurity_blocked_total", "Requests blocked by modsecurity.", &m.blocked)
+	counter("traefik_modsecurity_jailed_total", "Clients put in jail.", &m.jailed)
+	counter("traefik_modsecurity_jail_rejected_total", "Requests rejected because the client is in jail.", &m.jailRejected)
+	counter("traefik_modsecurity_cache_hits_total", "Verdicts served from the cache.", &m.cacheHits)
+	counter("traefik_modsecurity_cache_misses_total", "Cacheable requests whose verdict was not cached.", &m.cacheMisses)
+	counter("traefik_modsecurity_denied_total", "Requests rejected because of their source range.", &m.denied)
+	counter("traefik_modsecurity_overloaded_total", "Requests turned away because too many modsecurity calls were in flight.", &m.overloaded)
+	counter("traefik_modsecurity_shadow_mismatches_total", "Requests the shadow modsecurity would have decided differently.", &m.shadowMismatch)
+	counter("traefik_modsecurity_rate_limited_total", "Requests rejected because the client exceeded the rate limit.", &m.rateLimited)
+	counter("traefik_modsecurity_waf_rate_limited_total", "Requests bypassed or turned away because modsecurity calls were over wafRequestsPerSecond.", &m.wafRateLimited)
+	counter("traefik_modsecurity_buffer_budget_exceeded_total", "Requests turned away because the buffered bodies were over maxTotalBufferedBytes.", &m.budgetExceeded)
+	counter("traefik_modsecurity_local_denied_total", "Requests blocked by localDenyRules or blockedUserAgents without calling modsecurity.", &m.localDenied)
+
+	if m.cacheEntries != nil {
+		name := "traefik_modsecurity_cache_entries"
+		fmt.Fprintf(w, "# HELP %s Verdicts held by the in-memory cache.\n# TYPE %s gauge\n%s{%s} %d\n", name, name, name, label, m.cacheEntries())
+	}
+	if m.jailEntries != nil {
+		name := "traefik_modsecurity_jail_entries"
+		fmt.Fprintf(w, "# HELP %s Clients tracked by the in-memory jail.\n# TYPE %s gauge\n%s{%s} %d\n", name, name, name, label, m.jailEntries())
+		name = "traefik_modsecurity_jail_evictions_total"
+		fmt.Fprintf(w, "# HELP %s Clients evicted from the in-memory jail because it was full.\n# TYPE %s counter\n%s{%s} %d\n", name, name, name, label, m.jailEvictions())
+	}
+
+	name := "traefik_modsecurity_modsec_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Modsecurity round-trip latency.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range latencyBuckets {
+		le := strconv.FormatFloat(bound, 'f', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, label, le, atomic.LoadInt64(&m.latencyCounts[i]))
+	}
+	count := atomic.LoadInt64(&m.latencyCount)
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, label, strconv.FormatFloat(time.Duration(atomic.LoadInt64(&m.latencySumNs)).Seconds(), 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, label, count)
+}
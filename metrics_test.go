@@ -0,0 +1,90 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_Write(t *testing.T) {
+	m := newMetrics("waf")
+	m.incRequests()
+	m.incRequests()
+	m.incBlocked()
+	m.observeLatency(20 * time.Millisecond)
+	m.observeLatency(3 * time.Second)
+
+	var out strings.Builder
+	m.write(&out)
+
+	assert.Contains(t, out.String(), "traefik_modsecurity_requests_total{middleware=\"waf\"} 2\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_blocked_total{middleware=\"waf\"} 1\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_modsec_duration_seconds_bucket{middleware=\"waf\",le=\"0.01\"} 0\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_modsec_duration_seconds_bucket{middleware=\"waf\",le=\"0.025\"} 1\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_modsec_duration_seconds_bucket{middleware=\"waf\",le=\"5\"} 2\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_modsec_duration_seconds_bucket{middleware=\"waf\",le=\"+Inf\"} 2\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_modsec_duration_seconds_sum{middleware=\"waf\"} 3.02\n")
+	assert.Contains(t, out.String(), "traefik_modsecurity_modsec_duration_seconds_count{middleware=\"waf\"} 2\n")
+	assert.NotContains(t, out.String(), "traefik_modsecurity_cache_entries")
+
+	m.cacheEntries = func() int { return 42 }
+	out.Reset()
+	m.write(&out)
+	assert.Contains(t, out.String(), "# TYPE traefik_modsecurity_cache_entries gauge\ntraefik_modsecurity_cache_entries{middleware=\"waf\"} 42\n")
+	assert.NotContains(t, out.String(), "traefik_modsecurity_jail_entries")
+
+	m.jailEntries = func() int { return 7 }
+	m.jailEvictions = func() int64 { return 3 }
+	out.Reset()
+	m.write(&out)
+	assert.Contains(t, out.String(), "traefik_modsecurity_jail_entries{middleware=\"waf\"} 7\n")
+	assert.Contains(t, out.String(), "# TYPE traefik_modsecurity_jail_evictions_total counter\ntraefik_modsecurity_jail_evictions_total{middleware=\"waf\"} 3\n")
+}
+
+func TestModsecurity_MetricsPath(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.MetricsPath = "/.well-known/traefik-modsec/metrics"
+
+	_, err := New(context.Background(), httpServiceHandler, config, "waf")
+	assert.EqualError(t, err, "adminToken cannot be empty when metricsPath is set")
+
+	config.AdminToken = "secret"
+	middleware, err := New(context.Background(), httpServiceHandler, config, "waf")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	// The metrics aren't public
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/.well-known/traefik-modsec/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/traefik-modsec/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	middleware.ServeHTTP(rw, req)
+	resp := rw.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), "traefik_modsecurity_requests_total{middleware=\"waf\"} 1\n")
+	assert.Contains(t, string(body), "traefik_modsecurity_modsec_requests_total{middleware=\"waf\"} 1\n")
+	assert.Contains(t, string(body), "traefik_modsecurity_blocked_total{middleware=\"waf\"} 1\n")
+}
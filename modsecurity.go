@@ -4,167 +4,2087 @@ package traefik_modsecurity_plugin
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
-	"sync"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	TimeoutMillis                  int64  `json:"timeoutMillis,omitempty"`
-	ModSecurityUrl                 string `json:"modSecurityUrl,omitempty"`
-	JailEnabled                    bool   `json:"jailEnabled,omitempty"`
-	BadRequestsThresholdCount      int    `json:"badRequestsThresholdCount,omitempty"`
-	BadRequestsThresholdPeriodSecs int    `json:"badRequestsThresholdPeriodSecs,omitempty"` // Period in seconds to track attempts
-	JailTimeDurationSecs           int    `json:"jailTimeDurationSecs,omitempty"`                     // How long a client spends in Jail in seconds
+	TimeoutMillis                  int64             `json:"timeoutMillis,omitempty"`
+	TimeoutPerMbMillis             int64             `json:"timeoutPerMbMillis,omitempty"`          // Added to timeoutMillis for every MB of request body
+	ClientCertFile                 string            `json:"clientCertFile,omitempty"`              // Client certificate presented to modsecurity over TLS
+	ClientKeyFile                  string            `json:"clientKeyFile,omitempty"`               // Key of clientCertFile
+	CaFile                         string            `json:"caFile,omitempty"`                      // CA certificates the modsecurity certificate is verified against
+	RootCAFile                     string            `json:"rootCAFile,omitempty"`                  // Alias of caFile, only one of them can be set
+	InsecureSkipVerify             bool              `json:"insecureSkipVerify,omitempty"`          // Do not verify the modsecurity certificate, for development only
+	DialTimeoutMillis              int64             `json:"dialTimeoutMillis,omitempty"`           // Timeout to connect to modsecurity
+	TlsHandshakeTimeoutMillis      int64             `json:"tlsHandshakeTimeoutMillis,omitempty"`   // Timeout of the TLS handshake with modsecurity
+	ResponseHeaderTimeoutMillis    int64             `json:"responseHeaderTimeoutMillis,omitempty"` // Timeout to get the modsecurity response headers once the request is sent, 0 means none
+	MaxIdleConns                   int               `json:"maxIdleConns,omitempty"`                // Idle connections kept open to modsecurity
+	MaxIdleConnsPerHost            int               `json:"maxIdleConnsPerHost,omitempty"`         // Idle connections kept open to each modsecurity instance
+	MaxConnsPerHost                int               `json:"maxConnsPerHost,omitempty"`             // Connections to each modsecurity instance, 0 means no limit
+	KeepAliveSecs                  int64             `json:"keepAliveSecs,omitempty"`               // Interval of the TCP keep-alive probes to modsecurity
+	ForceHTTP2                     bool              `json:"forceHTTP2,omitempty"`                  // Attempt HTTP/2 with modsecurity
+	IdleConnTimeoutMillis          int64             `json:"idleConnTimeoutMillis,omitempty"`       // How long an idle connection to modsecurity is kept open
+	ModSecurityUrl                 string            `json:"modSecurityUrl,omitempty"`
+	ModSecurityUrls                []string          `json:"modSecurityUrls,omitempty"`              // Additional modsecurity instances
+	ShadowModSecurityUrl           string            `json:"shadowModSecurityUrl,omitempty"`         // Modsecurity URL every request is also sent to, whose verdict differences are logged
+	HostBackendMap                 map[string]string `json:"hostBackendMap,omitempty"`               // Modsecurity URLs of the requests to a host, instead of modSecurityUrl
+	BackendLoadBalancing           string            `json:"backendLoadBalancing,omitempty"`         // One of failover, roundRobin or leastConn
+	BackendMaxFailures             int               `json:"backendMaxFailures,omitempty"`           // Consecutive failures before a modsecurity instance is ejected
+	BackendCooldownSecs            int               `json:"backendCooldownSecs,omitempty"`          // How long an ejected modsecurity instance is skipped in seconds
+	ConnectFailureCacheMillis      int64             `json:"connectFailureCacheMillis,omitempty"`    // How long a modsecurity instance that could not be connected to is not tried again, 0 means always try
+	HealthCheckPath                string            `json:"healthCheckPath,omitempty"`              // Path requested on every modsecurity instance to check its health, empty disables health checks
+	HealthCheckIntervalSecs        int               `json:"healthCheckIntervalSecs,omitempty"`      // How often modsecurity instances are health checked in seconds
+	HealthCheckFailOnStartup       bool              `json:"healthCheckFailOnStartup,omitempty"`     // Fail to start when a modsecurity instance fails its first health check
+	WafExtraHeaders                map[string]string `json:"wafExtraHeaders,omitempty"`              // Static headers set on every request to modsecurity, e.g. a tenant ID
+	WafModeHeader                  string            `json:"wafModeHeader,omitempty"`                // Header telling modsecurity which rule engine mode to run for the requests of this middleware
+	WafModeValue                   string            `json:"wafModeValue,omitempty"`                 // One of On or DetectionOnly, for wafModeHeader
+	WafAuthHeader                  string            `json:"wafAuthHeader,omitempty"`                // Header attached to every request to modsecurity, as Name: value
+	WafBearerToken                 string            `json:"wafBearerToken,omitempty"`               // Bearer token attached to every request to modsecurity
+	WafBasicAuth                   string            `json:"wafBasicAuth,omitempty"`                 // Basic auth credentials attached to every request to modsecurity, as user:password
+	WafSigningSecret               string            `json:"wafSigningSecret,omitempty"`             // Secret requests to modsecurity are signed with, so it can reject spoofed direct calls
+	WafSignatureHeader             string            `json:"wafSignatureHeader,omitempty"`           // Header of the signature of the requests to modsecurity
+	DnsResolver                    string            `json:"dnsResolver,omitempty"`                  // Address of the DNS server resolving the modsecurity hostnames instead of the system resolver
+	DnsRefreshSecs                 int               `json:"dnsRefreshSecs,omitempty"`               // How often modsecurity hostnames are resolved again, connections are recycled once their addresses changed, 0 disables
+	WarmupConnections              int               `json:"warmupConnections,omitempty"`            // Connections opened to every modsecurity instance at startup and kept warm, 0 disables
+	MaxConcurrentWafRequests       int               `json:"maxConcurrentWafRequests,omitempty"`     // Maximum modsecurity calls in flight, 0 means no limit
+	WafQueueSize                   int               `json:"wafQueueSize,omitempty"`                 // Requests waiting for a modsecurity call slot, beyond that they are turned away
+	WafQueueTimeoutMillis          int64             `json:"wafQueueTimeoutMillis,omitempty"`        // How long a request waits for a modsecurity call slot
+	OverloadStatusCode             int               `json:"overloadStatusCode,omitempty"`           // Status returned to requests turned away
+	OverloadRetryAfterSecs         int               `json:"overloadRetryAfterSecs,omitempty"`       // Retry-After returned to requests turned away
+	AdaptiveConcurrency            bool              `json:"adaptiveConcurrency,omitempty"`          // Adjust the modsecurity calls allowed in flight to the modsecurity latency
+	AdaptiveLatencyTargetMillis    int64             `json:"adaptiveLatencyTargetMillis,omitempty"`  // Modsecurity latency above which fewer calls are allowed in flight
+	AdaptiveMinConcurrency         int               `json:"adaptiveMinConcurrency,omitempty"`       // Modsecurity calls always allowed in flight
+	AdaptiveMaxConcurrency         int               `json:"adaptiveMaxConcurrency,omitempty"`       // Modsecurity calls allowed in flight at most
+	RedactRequestHeaders           []string          `json:"redactRequestHeaders,omitempty"`         // Request headers stripped or masked on the copy sent to modsecurity
+	RedactBodyPatterns             []string          `json:"redactBodyPatterns,omitempty"`           // Regular expressions masked in the body sent to modsecurity
+	InspectBodyBytes               int64             `json:"inspectBodyBytes,omitempty"`             // Only the first bytes of request bodies are sent to modsecurity, 0 means the whole body
+	DecompressBodies               bool              `json:"decompressBodies,omitempty"`             // Decompress gzip and deflate request bodies sent to modsecurity
+	MaxDecompressedBodySize        int64             `json:"maxDecompressedBodySize,omitempty"`      // Maximum size in bytes of a decompressed request body
+	ForwardOnlyHeaders             []string          `json:"forwardOnlyHeaders,omitempty"`           // Request headers sent to modsecurity, all of them when empty
+	RedactMode                     string            `json:"redactMode,omitempty"`                   // One of mask or strip, for redactRequestHeaders
+	LatencyBypassThresholdMillis   int64             `json:"latencyBypassThresholdMillis,omitempty"` // Modsecurity p95 latency above which inspection is degraded, 0 disables it
+	LatencyBypassAction            string            `json:"latencyBypassAction,omitempty"`          // One of bypass or headersOnly, while the modsecurity latency is over the threshold
+	WafRequestsPerSecond           int               `json:"wafRequestsPerSecond,omitempty"`         // Maximum modsecurity calls per second across all clients, 0 means no limit
+	WafRequestsBurst               int               `json:"wafRequestsBurst,omitempty"`             // Modsecurity calls allowed at once over wafRequestsPerSecond, wafRequestsPerSecond when 0
+	WafRateLimitAction             string            `json:"wafRateLimitAction,omitempty"`           // One of reject, bypass or queue, for requests over wafRequestsPerSecond
+	RateLimitAverage               int               `json:"rateLimitAverage,omitempty"`             // Requests a client may send per rateLimitPeriodSecs, 0 disables rate limiting
+	RateLimitPeriodSecs            int               `json:"rateLimitPeriodSecs,omitempty"`          // Period of rateLimitAverage in seconds
+	RateLimitBurst                 int               `json:"rateLimitBurst,omitempty"`               // Requests a client may send at once, rateLimitAverage when 0
+	CircuitBreakerEnabled          bool              `json:"circuitBreakerEnabled,omitempty"`        // Stop calling modsecurity while it keeps failing
+	CircuitBreakerThreshold        int               `json:"circuitBreakerThreshold,omitempty"`      // Consecutive failures that open the circuit
+	CircuitBreakerOpenSecs         int               `json:"circuitBreakerOpenSecs,omitempty"`       // How long the circuit stays open before a probe in seconds
+	JailEnabled                    bool              `json:"jailEnabled,omitempty"`
+	BadRequestsThresholdCount      int               `json:"badRequestsThresholdCount,omitempty"`
+	BadRequestsThresholdPeriodSecs int               `json:"badRequestsThresholdPeriodSecs,omitempty"` // Period in seconds to track attempts
+	JailTimeDurationSecs           int               `json:"jailTimeDurationSecs,omitempty"`           // How long a client spends in Jail in seconds
+	JailPersistencePath            string            `json:"jailPersistencePath,omitempty"`            // File the jail is saved to, and restored from on startup
+	JailBackend                    string            `json:"jailBackend,omitempty"`                    // One of memory or redis
+	JailMaxEntries                 int               `json:"jailMaxEntries,omitempty"`                 // Clients tracked by the memory jail, the oldest ones are evicted beyond
+	JailSubnetThresholdCount       int               `json:"jailSubnetThresholdCount,omitempty"`       // Offenses of a whole subnet before it is jailed, 0 disables subnet jailing
+	JailSubnetIPv4Prefix           int               `json:"jailSubnetIPv4Prefix,omitempty"`           // Prefix length of IPv4 subnets
+	JailSubnetIPv6Prefix           int               `json:"jailSubnetIPv6Prefix,omitempty"`           // Prefix length of IPv6 subnets
+	JailAnomalyScoreThreshold      int               `json:"jailAnomalyScoreThreshold,omitempty"`      // Anomaly score a client totals over badRequestsThresholdPeriodSecs before it is jailed, 0 disables
+	JailOnStatusCodes              []int             `json:"jailOnStatusCodes,omitempty"`              // Modsecurity status codes that count toward jailing
+	JailKeyCookie                  string            `json:"jailKeyCookie,omitempty"`                  // Cookie, e.g. a session ID, clients are jailed by instead of their address when they send it
+	JailKeyHeader                  string            `json:"jailKeyHeader,omitempty"`                  // Header, e.g. an API key, clients are jailed by instead of their address when they send it
+	JailLoginPaths                 []string          `json:"jailLoginPaths,omitempty"`                 // Regular expressions of login paths whose failed authentications count toward jailing
+	JailOnLoginStatusCodes         []int             `json:"jailOnLoginStatusCodes,omitempty"`         // Backend status codes of jailLoginPaths that count toward jailing
+	JailExemptSourceRanges         []string          `json:"jailExemptSourceRanges,omitempty"`         // CIDRs of clients that are never jailed
+	JailEscalationFactor           int               `json:"jailEscalationFactor,omitempty"`           // Multiplier of the jail time of clients jailed again
+	JailEscalationResetSecs        int               `json:"jailEscalationResetSecs,omitempty"`        // How long a jailing is remembered for escalation in seconds
+	JailMaxDurationSecs            int               `json:"jailMaxDurationSecs,omitempty"`            // Maximum escalated jail time in seconds
+	FailOpen                       bool              `json:"failOpen,omitempty"`                       // Forward requests to the backend when modsecurity is unreachable
+	DetectionOnly                  bool              `json:"detectionOnly,omitempty"`                  // Log modsecurity verdicts but never block
+	AnomalyScoreThreshold          int               `json:"anomalyScoreThreshold,omitempty"`          // Block requests scoring at least this much, whatever the modsecurity status
+	AnomalyScoreHeader             string            `json:"anomalyScoreHeader,omitempty"`             // Response header modsecurity returns the anomaly score in
+	BlockStatusCodes               []int             `json:"blockStatusCodes,omitempty"`               // Modsecurity status codes that count as a block
+	BlockStatusRanges              []string          `json:"blockStatusRanges,omitempty"`              // Modsecurity status ranges that count as a block, e.g. "400-499"
+	InspectWebsocketHandshake      bool              `json:"inspectWebsocketHandshake,omitempty"`      // Check websocket upgrade requests instead of bypassing them
+	HeadersOnly                    bool              `json:"headersOnly,omitempty"`                    // Send the request line and headers only to modsecurity, never the body
+	HeadersOnlyAboveSize           int64             `json:"headersOnlyAboveSize,omitempty"`           // Send headers only for bodies bigger than this, in bytes
+	InspectContentTypes            []string          `json:"inspectContentTypes,omitempty"`            // Content types whose bodies are sent to modsecurity, any when empty
+	BypassContentTypes             []string          `json:"bypassContentTypes,omitempty"`             // Content types whose bodies are not sent to modsecurity
+	GrpcPolicy                     string            `json:"grpcPolicy,omitempty"`                     // One of inspect, headersOnly or bypass
+	H2cUpgradePolicy               string            `json:"h2cUpgradePolicy,omitempty"`               // One of strip, reject or allow, for requests asking to upgrade to h2c
+	ExcludedPaths                  []string          `json:"excludedPaths,omitempty"`                  // Regular expressions of request paths that skip modsecurity
+	LocalDenyRules                 []string          `json:"localDenyRules,omitempty"`                 // Rules such as path:^/\.env blocking requests before modsecurity is called
+	BlockedUserAgents              []string          `json:"blockedUserAgents,omitempty"`              // Regular expressions of User-Agents rejected before reaching modsecurity
+	AllowedUserAgents              []string          `json:"allowedUserAgents,omitempty"`              // Regular expressions of User-Agents that skip modsecurity
+	JailBlockedUserAgents          bool              `json:"jailBlockedUserAgents,omitempty"`          // Count requests rejected by blockedUserAgents toward jailing
+	BypassSourceRanges             []string          `json:"bypassSourceRanges,omitempty"`             // CIDRs of trusted clients that skip modsecurity
+	DenySourceRanges               []string          `json:"denySourceRanges,omitempty"`               // CIDRs of clients rejected before reaching modsecurity
+	CrowdsecLapiUrl                string            `json:"crowdsecLapiUrl,omitempty"`                // URL of the CrowdSec local API
+	CrowdsecApiKey                 string            `json:"crowdsecApiKey,omitempty"`                 // Bouncer API key, to reject the clients CrowdSec bans
+	CrowdsecMachineId              string            `json:"crowdsecMachineId,omitempty"`              // Machine login, to push alerts about blocked requests and jailed clients
+	CrowdsecMachinePassword        string            `json:"crowdsecMachinePassword,omitempty"`        // Machine password
+	CrowdsecDecisionCacheSecs      int               `json:"crowdsecDecisionCacheSecs,omitempty"`      // How long CrowdSec decisions on a client are cached in seconds
+	GeoipDatabasePath              string            `json:"geoipDatabasePath,omitempty"`              // MaxMind DB file, e.g. GeoLite2-Country.mmdb, client countries are looked up in
+	BlockCountries                 []string          `json:"blockCountries,omitempty"`                 // ISO codes of the countries whose clients are rejected before reaching modsecurity
+	BypassCountries                []string          `json:"bypassCountries,omitempty"`                // ISO codes of the countries whose clients bypass modsecurity
+	DenyStatusCode                 int               `json:"denyStatusCode,omitempty"`                 // Status returned to clients in denySourceRanges
+	RequestIdHeader                string            `json:"requestIdHeader,omitempty"`                // Header of the request ID, reused or generated, e.g. X-Request-ID
+	PreserveHost                   bool              `json:"preserveHost,omitempty"`                   // Send the original Host header to modsecurity instead of its own
+	ForwardClientHeaders           bool              `json:"forwardClientHeaders,omitempty"`           // Send X-Forwarded-* headers about the original client to modsecurity
+	TrustedProxies                 []string          `json:"trustedProxies,omitempty"`                 // CIDRs of the proxies whose clientIPHeader is trusted
+	ClientIPHeader                 string            `json:"clientIPHeader,omitempty"`                 // Header holding the client address, e.g. X-Forwarded-For, X-Real-IP or CF-Connecting-IP
+	MetricsPath                    string            `json:"metricsPath,omitempty"`                    // Path answered with Prometheus metrics instead of being proxied
+	EventWebhookUrl                string            `json:"eventWebhookUrl,omitempty"`                // URL events are posted to when a request is blocked or a client jailed
+	AdminPath                      string            `json:"adminPath,omitempty"`                      // Path prefix of the admin API, which is not proxied
+	AdminToken                     string            `json:"adminToken,omitempty"`                     // Bearer token required by the admin API and metricsPath
+	LogLevel                       string            `json:"logLevel,omitempty"`                       // One of debug, info, warn or error
+	AuditLog                       bool              `json:"auditLog,omitempty"`                       // Write a JSON audit record of every blocked request and jailed client
+	AuditLogPath                   string            `json:"auditLogPath,omitempty"`                   // File the audit log is appended to, stdout when empty
+	AuditLogHeaders                []string          `json:"auditLogHeaders,omitempty"`                // Request headers included in audit records
+	BanLogPath                     string            `json:"banLogPath,omitempty"`                     // File jailed clients are appended to, in a format fail2ban can parse
+	LogFormat                      string            `json:"logFormat,omitempty"`                      // One of text or json
+	LogSpans                       bool              `json:"logSpans,omitempty"`                       // Log a span record of every modsecurity call, a child of the trace of the request
+	BlockResponseStatusCode        int               `json:"blockResponseStatusCode,omitempty"`        // Status returned to blocked clients instead of the modsecurity one
+	BlockResponseBody              string            `json:"blockResponseBody,omitempty"`              // Body returned to blocked clients instead of the modsecurity one
+	BlockResponseContentType       string            `json:"blockResponseContentType,omitempty"`       // Content-Type of blockResponseBody
+	JailResponseStatusCode         int               `json:"jailResponseStatusCode,omitempty"`         // Status returned to jailed clients
+	JailResponseBody               string            `json:"jailResponseBody,omitempty"`               // Body returned to jailed clients
+	JailResponseContentType        string            `json:"jailResponseContentType,omitempty"`        // Content-Type of jailResponseBody
+	JailResponseHeaders            map[string]string `json:"jailResponseHeaders,omitempty"`            // Extra headers returned to jailed clients
+	InspectResponses               bool              `json:"inspectResponses,omitempty"`               // Submit backend responses to modsecurity too
+	ResponseInspectionUrl          string            `json:"responseInspectionUrl,omitempty"`          // Modsecurity URL inspecting responses, required by inspectResponses
+	SpoeApplication                string            `json:"spoeApplication,omitempty"`                // Application name sent to spoe:// agents, selecting their rules
+	MaxResponseBodySize            int64             `json:"maxResponseBodySize,omitempty"`            // Bigger responses are not inspected
+	BodyMemoryLimit                int64             `json:"bodyMemoryLimit,omitempty"`                // Bodies bigger than this, in bytes, are spilled to a temporary file, 0 means never
+	BodyTempDir                    string            `json:"bodyTempDir,omitempty"`                    // Directory of the spilled bodies, the system one when empty
+	OverLimitAction                string            `json:"overLimitAction,omitempty"`                // One of reject, bypass or headersOnly, for bodies bigger than maxBodySize
+	MaxBodySize                    int64             `json:"maxBodySize,omitempty"`                    // Maximum request body size in bytes, 0 means no limit
+	MaxTotalBufferedBytes          int64             `json:"maxTotalBufferedBytes,omitempty"`          // Maximum bytes of request bodies buffered across requests in flight, 0 means no limit
+	BufferBudgetAction             string            `json:"bufferBudgetAction,omitempty"`             // One of reject or queue, for requests with a body over maxTotalBufferedBytes
+	CacheEnabled                   bool              `json:"cacheEnabled,omitempty"`                   // Cache modsecurity verdicts of requests without body
+	CacheBackend                   string            `json:"cacheBackend,omitempty"`                   // One of memory or redis
+	CacheTtlSecs                   int               `json:"cacheTtlSecs,omitempty"`                   // How long a verdict stays cached in seconds
+	CacheTtlJitterPercent          int               `json:"cacheTtlJitterPercent,omitempty"`          // Verdicts are cached for up to this percentage less than cacheTtlSecs, at random
+	CacheStaleWhileRevalidateSecs  int               `json:"cacheStaleWhileRevalidateSecs,omitempty"`  // How long an expired verdict is still served while it is refreshed in the background
+	CacheMaxEntries                int               `json:"cacheMaxEntries,omitempty"`                // Verdicts kept by the memory cache, the least recently used ones are evicted beyond
+	CacheConditionsMethods         []string          `json:"cacheConditionsMethods,omitempty"`         // Methods of the requests whose verdicts are cached
+	CacheKeyIncludeHost            bool              `json:"cacheKeyIncludeHost,omitempty"`            // Include the Host in the cache key
+	ForwardWafHeaders              []string          `json:"forwardWafHeaders,omitempty"`              // Modsecurity response headers forwarded, e.g. the transaction ID
+	ForwardWafHeadersTo            string            `json:"forwardWafHeadersTo,omitempty"`            // One of client, upstream or both
+	CacheKeyHeaders                []string          `json:"cacheKeyHeaders,omitempty"`                // Request headers included in the cache key
+	CacheKeyCookies                []string          `json:"cacheKeyCookies,omitempty"`                // Request cookies included in the cache key, e.g. a session or tenant cookie
+	CacheKeyIncludeRemoteAddress   bool              `json:"cacheKeyIncludeRemoteAddress,omitempty"`   // Include the client address in the cache key
+	CacheKeyIPv4Prefix             int               `json:"cacheKeyIPv4Prefix,omitempty"`             // Prefix length of the IPv4 subnets sharing verdicts with cacheKeyIncludeRemoteAddress, 32 when 0
+	CacheKeyIPv6Prefix             int               `json:"cacheKeyIPv6Prefix,omitempty"`             // Prefix length of the IPv6 subnets sharing verdicts with cacheKeyIncludeRemoteAddress, 128 when 0
+	CacheKeyIgnoredParams          []string          `json:"cacheKeyIgnoredParams,omitempty"`          // Query parameters left out of the cache key, e.g. utm_*
+	CacheKeySortParams             bool              `json:"cacheKeySortParams,omitempty"`             // Sort the query parameters of the cache key
+	CacheKeyLowercasePath          bool              `json:"cacheKeyLowercasePath,omitempty"`          // Lowercase the path of the cache key
+	CacheWhichVerdicts             string            `json:"cacheWhichVerdicts,omitempty"`             // One of all, blocks or allows
+	CacheControlHeader             string            `json:"cacheControlHeader,omitempty"`             // Request header set to bypass or refresh by cacheControlSourceRanges to skip or renew the cached verdict
+	CacheControlSourceRanges       []string          `json:"cacheControlSourceRanges,omitempty"`       // CIDRs of the clients allowed to use cacheControlHeader
+	CacheServerErrors              bool              `json:"cacheServerErrors,omitempty"`              // Cache 5xx modsecurity answers too, which are usually transient failures
+	RedisAddress                   string            `json:"redisAddress,omitempty"`                   // host:port of the redis server
+	RedisPassword                  string            `json:"redisPassword,omitempty"`                  // Password of the redis server
+	RedisDb                        int               `json:"redisDb,omitempty"`                        // Redis database number
+	Scope                          string            `json:"scope,omitempty"`                          // One of global or perRouter, whether jail and cache entries are shared across hosts
+	RedisKeyPrefix                 string            `json:"redisKeyPrefix,omitempty"`                 // Prefix of every key written to redis
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
 		TimeoutMillis:                  2000,
+		DialTimeoutMillis:              30000,
+		TlsHandshakeTimeoutMillis:      10000,
+		IdleConnTimeoutMillis:          90000,
+		MaxIdleConns:                   100,
+		MaxIdleConnsPerHost:            100,
+		KeepAliveSecs:                  30,
+		ForceHTTP2:                     true,
+		ForwardClientHeaders:           true,
+		BackendLoadBalancing:           "failover",
+		BackendMaxFailures:             1,
+		BackendCooldownSecs:            10,
+		HealthCheckIntervalSecs:        10,
+		CircuitBreakerEnabled:          false,
+		WafQueueTimeoutMillis:          1000,
+		RateLimitPeriodSecs:            1,
+		WafRateLimitAction:             "reject",
+		AdaptiveLatencyTargetMillis:    100,
+		LatencyBypassAction:            "bypass",
+		RedactMode:                     "mask",
+		MaxDecompressedBodySize:        10 << 20,
+		AdaptiveMinConcurrency:         1,
+		AdaptiveMaxConcurrency:         100,
+		OverloadStatusCode:             http.StatusServiceUnavailable,
+		OverloadRetryAfterSecs:         1,
+		CircuitBreakerThreshold:        5,
+		CircuitBreakerOpenSecs:         30,
 		JailEnabled:                    false,
 		BadRequestsThresholdCount:      25,
 		BadRequestsThresholdPeriodSecs: 600,
 		JailTimeDurationSecs:           600,
+		CrowdsecDecisionCacheSecs:      60,
+		JailResponseStatusCode:         http.StatusTooManyRequests,
+		JailOnStatusCodes:              []int{http.StatusForbidden},
+		JailSubnetThresholdCount:       0,
+		JailSubnetIPv4Prefix:           24,
+		JailSubnetIPv6Prefix:           64,
+		JailBackend:                    "memory",
+		JailEscalationFactor:           1,
+		JailEscalationResetSecs:        86400,
+		JailMaxDurationSecs:            86400,
+		FailOpen:                       false,
+		DetectionOnly:                  false,
+		DenyStatusCode:                 http.StatusForbidden,
+		AnomalyScoreHeader:             "X-Anomaly-Score",
+		WafSignatureHeader:             "X-Waf-Signature",
+		ClientIPHeader:                 "X-Forwarded-For",
+		MaxResponseBodySize:            1 << 20,
+		SpoeApplication:                "default",
+		LogLevel:                       "info",
+		LogFormat:                      "text",
+		CacheEnabled:                   false,
+		CacheBackend:                   "memory",
+		CacheTtlSecs:                   300,
+		CacheMaxEntries:                10000,
+		JailMaxEntries:                 100000,
+		CacheConditionsMethods:         []string{http.MethodGet, http.MethodHead},
+		CacheKeyIncludeHost:            true,
+		CacheKeyIncludeRemoteAddress:   false,
+		CacheWhichVerdicts:             "all",
+		ForwardWafHeadersTo:            "client",
+		GrpcPolicy:                     "inspect",
+		H2cUpgradePolicy:               "strip",
+		OverLimitAction:                "reject",
+		RedisKeyPrefix:                 "traefik-modsecurity:",
 	}
 }
 
 // Modsecurity a Modsecurity plugin.
 type Modsecurity struct {
-	next                           http.Handler
-	modSecurityUrl                 string
-	name                           string
-	httpClient                     *http.Client
-	logger                         *log.Logger
-	jailEnabled                    bool
-	badRequestsThresholdCount      int
-	badRequestsThresholdPeriodSecs int
-	jailTimeDurationSecs           int
-	jail                           map[string][]time.Time
-	jailRelease                    map[string]time.Time
-	jailMutex                      sync.RWMutex
+	next                         http.Handler
+	backends                     *backendPool
+	hostBackends                 map[string]*backendPool
+	connectFailureTTL            time.Duration
+	healthCheckPath              string
+	resolver                     *net.Resolver
+	wafExtraHeaders              map[string]string
+	wafModeHeader                string
+	wafModeValue                 string
+	wafAuthName                  string
+	wafAuthValue                 string
+	wafSigningSecret             []byte
+	wafSignatureHeader           string
+	shadow                       verdictBackend
+	shadowSlots                  chan struct{}
+	name                         string
+	httpClient                   *http.Client
+	timeout                      time.Duration
+	timeoutPerMb                 time.Duration
+	breaker                      *circuitBreaker
+	limiter                      *limiter
+	rateLimiter                  *rateLimiter
+	wafRateLimiter               *wafRateLimiter
+	bufferBudget                 *bufferBudget
+	adaptiveLimiter              *adaptiveLimiter
+	latencyGuard                 *latencyGuard
+	redactRequestHeaders         []string
+	forwardOnlyHeaders           map[string]bool
+	redactMode                   string
+	redactBodyPatterns           []*regexp.Regexp
+	decompressBodies             bool
+	inspectBodyBytes             int64
+	maxDecompressedBodySize      int64
+	latencyBypassAction          string
+	wafRateLimitAction           string
+	flights                      *flightGroup
+	overloadStatusCode           int
+	overloadRetryAfterSecs       int
+	logger                       *logger
+	jail                         *jail
+	jailOnStatusCodes            map[int]bool
+	scope                        string
+	jailKeyCookie                string
+	jailKeyHeader                string
+	jailLoginPaths               []*regexp.Regexp
+	jailOnLoginStatusCodes       map[int]bool
+	failOpen                     bool
+	detectionOnly                bool
+	blockStatusCodes             map[int]bool
+	blockStatusRanges            []statusRange
+	excludedPaths                []*regexp.Regexp
+	localDenyRules               []*denyRule
+	blockedUserAgents            []*regexp.Regexp
+	allowedUserAgents            []*regexp.Regexp
+	jailBlockedUserAgents        bool
+	inspectWebsocketHandshake    bool
+	grpcPolicy                   string
+	h2cUpgradePolicy             string
+	headersOnly                  bool
+	headersOnlyAboveSize         int64
+	inspectContentTypes          []string
+	bypassContentTypes           []string
+	bypassSourceRanges           []*net.IPNet
+	denySourceRanges             []*net.IPNet
+	geoip                        *geoipDB
+	crowdsec                     *crowdsec
+	blockCountries               map[string]bool
+	bypassCountries              map[string]bool
+	denyStatusCode               int
+	anomalyScoreThreshold        int
+	anomalyScoreHeader           string
+	trustedProxies               []*net.IPNet
+	clientIPHeader               string
+	forwardClientHeaders         bool
+	preserveHost                 bool
+	requestIDHeader              string
+	logSpans                     bool
+	metricsPath                  string
+	adminPath                    string
+	webhook                      *webhook
+	auditLog                     *auditLog
+	banLog                       *banLog
+	adminToken                   string
+	metrics                      *metrics
+	blockResponseStatusCode      int
+	blockResponseBody            string
+	blockResponseContentType     string
+	jailResponseStatusCode       int
+	jailResponseBody             string
+	jailResponseContentType      string
+	jailResponseHeaders          map[string]string
+	maxBodySize                  int64
+	overLimitAction              string
+	bodyMemoryLimit              int64
+	bodyTempDir                  string
+	inspectResponses             bool
+	responseInspector            verdictBackend
+	maxResponseBodySize          int64
+	cache                        verdictCache
+	cacheTTL                     time.Duration
+	cacheTTLJitter               float64
+	cacheStaleTTL                time.Duration
+	cacheConditionsMethods       []string
+	cacheKeyIncludeHost          bool
+	cacheKeyHeaders              []string
+	cacheKeyCookies              []string
+	forwardWafHeaders            []string
+	forwardWafHeadersTo          string
+	cacheKeyIncludeRemoteAddress bool
+	cacheKeyIPv4Prefix           int
+	cacheKeyIPv6Prefix           int
+	cacheKeyIgnoredParams        []string
+	cacheKeySortParams           bool
+	cacheKeyLowercasePath        bool
+	cacheWhichVerdicts           string
+	cacheServerErrors            bool
+	cacheControlHeader           string
+	cacheControlSourceRanges     []*net.IPNet
 }
 
 // New creates a new Modsecurity plugin with the given configuration.
 // It returns an HTTP handler that can be integrated into the Traefik middleware chain.
-func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.ModSecurityUrl) == 0 {
+func New(ctx context.Context, next http.Handler, config *Config, name string) (_ http.Handler, err error) {
+	// The background work and the log files of a rejected configuration, e.g. one failing healthCheckFailOnStartup,
+	// are stopped and closed along with the error
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	urls := modSecurityUrls(config)
+	if len(urls) == 0 {
 		return nil, fmt.Errorf("modSecurityUrl cannot be empty")
 	}
 
-	// Use a custom client with predefined timeout of 2 seconds
-	var timeout time.Duration
-	if config.TimeoutMillis == 0 {
-		timeout = 2 * time.Second
+	backendCooldown := time.Duration(config.BackendCooldownSecs) * time.Second
+	if backendCooldown <= 0 {
+		backendCooldown = 10 * time.Second
+	}
+
+	backends, err := newBackendPool(urls, config.BackendLoadBalancing, config.BackendMaxFailures, backendCooldown)
+	if err != nil {
+		return nil, err
+	}
+	hostBackends := make(map[string]*backendPool)
+	for host, value := range config.HostBackendMap {
+		hostUrls := splitUrls([]string{value})
+		if len(hostUrls) == 0 {
+			return nil, fmt.Errorf("hostBackendMap has no modsecurity URL for host %q", host)
+		}
+		if hostBackends[strings.ToLower(host)], err = newBackendPool(hostUrls, config.BackendLoadBalancing, config.BackendMaxFailures, backendCooldown); err != nil {
+			return nil, err
+		}
+	}
+	// Only HTTP replay understands response inspection requests
+	if config.InspectResponses && config.ResponseInspectionUrl == "" {
+		return nil, fmt.Errorf("responseInspectionUrl must be set when inspectResponses is set")
+	}
+	if config.InspectResponses && strings.HasPrefix(config.ResponseInspectionUrl, spoeScheme) {
+		return nil, fmt.Errorf("responses can't be inspected by spoe agents, responseInspectionUrl must be an http one")
+	}
+	sockets := make(unixSockets)
+
+	// Every modsecurity call is bounded by a timeout of 2 seconds by default
+	var timeout time.Duration
+	if config.TimeoutMillis == 0 {
+		timeout = 2 * time.Second
+	} else {
+		timeout = time.Duration(config.TimeoutMillis) * time.Millisecond
+	}
+
+	logger, err := newLogger(os.Stdout, config.LogLevel, config.LogFormat, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cache and the jail share the same redis connections
+	var redis *redisClient
+	if (config.CacheEnabled && config.CacheBackend == "redis") || (config.JailEnabled && config.JailBackend == "redis") {
+		if config.RedisAddress == "" {
+			return nil, fmt.Errorf("redisAddress cannot be empty when cacheBackend or jailBackend is redis")
+		}
+		redis = newRedisClient(config.RedisAddress, config.RedisPassword, config.RedisDb, timeout)
+	}
+
+	jailResponseStatusCode := config.JailResponseStatusCode
+	if jailResponseStatusCode == 0 {
+		jailResponseStatusCode = http.StatusTooManyRequests
+	}
+	jailResponseBody := config.JailResponseBody
+	jailResponseContentType := config.JailResponseContentType
+	if jailResponseBody == "" {
+		jailResponseBody = "Too Many Requests\n"
+		jailResponseContentType = "text/plain; charset=utf-8"
+	}
+	if jailResponseContentType == "" {
+		jailResponseContentType = "text/plain; charset=utf-8"
+	}
+
+	jailOnStatusCodes := map[int]bool{http.StatusForbidden: true}
+	if len(config.JailOnStatusCodes) > 0 {
+		jailOnStatusCodes = make(map[int]bool)
+		for _, code := range config.JailOnStatusCodes {
+			jailOnStatusCodes[code] = true
+		}
+	}
+
+	var jailLoginPaths []*regexp.Regexp
+	for _, pattern := range config.JailLoginPaths {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jail login path %q: %s", pattern, err.Error())
+		}
+		jailLoginPaths = append(jailLoginPaths, re)
+	}
+	if len(jailLoginPaths) > 0 && !config.JailEnabled {
+		return nil, fmt.Errorf("jailEnabled must be set when jailLoginPaths is set")
+	}
+	scope := config.Scope
+	switch scope {
+	case "":
+		scope = scopeGlobal
+	case scopeGlobal, scopePerRouter:
+	default:
+		return nil, fmt.Errorf("invalid scope %q, must be global or perRouter", config.Scope)
+	}
+	if scope == scopePerRouter && config.JailSubnetThresholdCount > 0 {
+		return nil, fmt.Errorf("jailSubnetThresholdCount cannot be set when scope is perRouter")
+	}
+
+	if config.JailAnomalyScoreThreshold > 0 && !config.JailEnabled {
+		return nil, fmt.Errorf("jailEnabled must be set when jailAnomalyScoreThreshold is set")
+	}
+	if (config.JailKeyCookie != "" || config.JailKeyHeader != "") && !config.JailEnabled {
+		return nil, fmt.Errorf("jailEnabled must be set when jailKeyCookie or jailKeyHeader is set")
+	}
+	jailOnLoginStatusCodes := map[int]bool{http.StatusUnauthorized: true, http.StatusForbidden: true}
+	if len(config.JailOnLoginStatusCodes) > 0 {
+		jailOnLoginStatusCodes = make(map[int]bool)
+		for _, code := range config.JailOnLoginStatusCodes {
+			jailOnLoginStatusCodes[code] = true
+		}
+	}
+
+	jailExemptRanges, err := parseSourceRanges("jailExemptSourceRanges", config.JailExemptSourceRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	var jail *jail
+	if config.JailEnabled {
+		period := time.Duration(config.BadRequestsThresholdPeriodSecs) * time.Second
+
+		var store jailStore
+		switch config.JailBackend {
+		case "", "memory":
+			maxEntries := config.JailMaxEntries
+			if maxEntries <= 0 {
+				maxEntries = 100000
+			}
+			memoryStore := newMemoryJailStore(config.JailPersistencePath, maxEntries, logger)
+			if err := memoryStore.load(time.Now(), period); err != nil {
+				logger.Warn("fail to restore jail", "path", config.JailPersistencePath, "error", err)
+			}
+			go memoryStore.runReaper(ctx, period)
+			store = memoryStore
+		case "redis":
+			store = newRedisJailStore(redis, config.RedisKeyPrefix)
+		default:
+			return nil, fmt.Errorf("invalid jailBackend %q, must be memory or redis", config.JailBackend)
+		}
+
+		jail = newJail(store, config.BadRequestsThresholdCount, period, time.Duration(config.JailTimeDurationSecs)*time.Second, logger)
+		jail.exemptRanges = jailExemptRanges
+		jail.scoreThreshold = config.JailAnomalyScoreThreshold
+		if config.JailSubnetThresholdCount > 0 {
+			jail.subnetThreshold = config.JailSubnetThresholdCount
+			jail.subnetIPv4Prefix = config.JailSubnetIPv4Prefix
+			if jail.subnetIPv4Prefix <= 0 || jail.subnetIPv4Prefix > 32 {
+				return nil, fmt.Errorf("invalid jailSubnetIPv4Prefix %d, must be between 1 and 32", config.JailSubnetIPv4Prefix)
+			}
+			jail.subnetIPv6Prefix = config.JailSubnetIPv6Prefix
+			if jail.subnetIPv6Prefix <= 0 || jail.subnetIPv6Prefix > 128 {
+				return nil, fmt.Errorf("invalid jailSubnetIPv6Prefix %d, must be between 1 and 128", config.JailSubnetIPv6Prefix)
+			}
+		}
+		if config.JailEscalationFactor > 1 {
+			jail.escalationFactor = config.JailEscalationFactor
+			jail.escalationReset = time.Duration(config.JailEscalationResetSecs) * time.Second
+			if jail.escalationReset <= 0 {
+				jail.escalationReset = 24 * time.Hour
+			}
+			jail.maxDuration = time.Duration(config.JailMaxDurationSecs) * time.Second
+			if jail.maxDuration <= 0 {
+				jail.maxDuration = 24 * time.Hour
+			}
+		}
+	}
+
+	var breaker *circuitBreaker
+	if config.CircuitBreakerEnabled {
+		threshold := config.CircuitBreakerThreshold
+		if threshold <= 0 {
+			threshold = 5
+		}
+		openDuration := time.Duration(config.CircuitBreakerOpenSecs) * time.Second
+		if openDuration <= 0 {
+			openDuration = 30 * time.Second
+		}
+		breaker = newCircuitBreaker(threshold, openDuration, logger)
+	}
+
+	var limiter *limiter
+	if config.MaxConcurrentWafRequests > 0 {
+		queueTimeout := time.Duration(config.WafQueueTimeoutMillis) * time.Millisecond
+		if queueTimeout <= 0 {
+			queueTimeout = time.Second
+		}
+		limiter = newLimiter(config.MaxConcurrentWafRequests, config.WafQueueSize, queueTimeout)
+	}
+	var adaptiveLimiter *adaptiveLimiter
+	if config.AdaptiveConcurrency {
+		minConcurrency, maxConcurrency := config.AdaptiveMinConcurrency, config.AdaptiveMaxConcurrency
+		if minConcurrency <= 0 {
+			minConcurrency = 1
+		}
+		if maxConcurrency <= 0 {
+			maxConcurrency = 100
+		}
+		if minConcurrency > maxConcurrency {
+			return nil, fmt.Errorf("adaptiveMinConcurrency %d cannot be greater than adaptiveMaxConcurrency %d", minConcurrency, maxConcurrency)
+		}
+		target := time.Duration(config.AdaptiveLatencyTargetMillis) * time.Millisecond
+		if target <= 0 {
+			target = 100 * time.Millisecond
+		}
+		adaptiveLimiter = newAdaptiveLimiter(minConcurrency, maxConcurrency, target, logger)
+	}
+
+	var forwardOnlyHeaders map[string]bool
+	if len(config.ForwardOnlyHeaders) > 0 {
+		forwardOnlyHeaders = make(map[string]bool)
+		for _, name := range config.ForwardOnlyHeaders {
+			forwardOnlyHeaders[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	redactRequestHeaders := make([]string, 0, len(config.RedactRequestHeaders))
+	for _, name := range config.RedactRequestHeaders {
+		redactRequestHeaders = append(redactRequestHeaders, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+	}
+	redactMode := strings.ToLower(config.RedactMode)
+	switch redactMode {
+	case "":
+		redactMode = "mask"
+	case "mask", "strip":
+	default:
+		return nil, fmt.Errorf("invalid redactMode %q, must be mask or strip", config.RedactMode)
+	}
+
+	redactBodyPatterns := make([]*regexp.Regexp, 0, len(config.RedactBodyPatterns))
+	for _, pattern := range config.RedactBodyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redactBodyPatterns %q: %w", pattern, err)
+		}
+		redactBodyPatterns = append(redactBodyPatterns, re)
+	}
+
+	maxDecompressedBodySize := config.MaxDecompressedBodySize
+	if maxDecompressedBodySize <= 0 {
+		maxDecompressedBodySize = 10 << 20
+	}
+
+	var latencyGuard *latencyGuard
+	var latencyBypassAction string
+	if config.LatencyBypassThresholdMillis > 0 {
+		switch strings.ToLower(config.LatencyBypassAction) {
+		case "", "bypass":
+			latencyBypassAction = "bypass"
+		case "headersonly":
+			latencyBypassAction = "headersOnly"
+		default:
+			return nil, fmt.Errorf("invalid latencyBypassAction %q, must be bypass or headersOnly", config.LatencyBypassAction)
+		}
+		latencyGuard = newLatencyGuard(time.Duration(config.LatencyBypassThresholdMillis)*time.Millisecond, logger)
+	}
+
+	var wafRateLimiter *wafRateLimiter
+	wafRateLimitAction := strings.ToLower(config.WafRateLimitAction)
+	if config.WafRequestsPerSecond > 0 {
+		burst := config.WafRequestsBurst
+		if burst <= 0 {
+			burst = config.WafRequestsPerSecond
+		}
+		var maxWait time.Duration
+		switch wafRateLimitAction {
+		case "", "reject":
+			wafRateLimitAction = "reject"
+		case "bypass":
+		case "queue":
+			maxWait = time.Duration(config.WafQueueTimeoutMillis) * time.Millisecond
+			if maxWait <= 0 {
+				maxWait = time.Second
+			}
+		default:
+			return nil, fmt.Errorf("invalid wafRateLimitAction %q, must be reject, bypass or queue", config.WafRateLimitAction)
+		}
+		wafRateLimiter = newWafRateLimiter(config.WafRequestsPerSecond, burst, maxWait)
+	}
+
+	var bufferBudget *bufferBudget
+	bufferBudgetAction := strings.ToLower(config.BufferBudgetAction)
+	if config.MaxTotalBufferedBytes > 0 {
+		var maxWait time.Duration
+		switch bufferBudgetAction {
+		case "", "reject":
+			bufferBudgetAction = "reject"
+		case "queue":
+			maxWait = time.Duration(config.WafQueueTimeoutMillis) * time.Millisecond
+			if maxWait <= 0 {
+				maxWait = time.Second
+			}
+		default:
+			return nil, fmt.Errorf("invalid bufferBudgetAction %q, must be reject or queue", config.BufferBudgetAction)
+		}
+		bufferBudget = newBufferBudget(config.MaxTotalBufferedBytes, maxWait)
+	}
+
+	var rateLimiter *rateLimiter
+	if config.RateLimitAverage > 0 {
+		burst := config.RateLimitBurst
+		if burst <= 0 {
+			burst = config.RateLimitAverage
+		}
+		rateLimiter = newRateLimiter(config.RateLimitAverage, secsOrDefault(int64(config.RateLimitPeriodSecs), time.Second), burst)
+		go rateLimiter.runReaper(ctx)
+	}
+
+	overloadStatusCode := config.OverloadStatusCode
+	if overloadStatusCode == 0 {
+		overloadStatusCode = http.StatusServiceUnavailable
+	}
+	overloadRetryAfterSecs := config.OverloadRetryAfterSecs
+	if overloadRetryAfterSecs <= 0 {
+		overloadRetryAfterSecs = 1
+	}
+
+	blockStatusCodes := make(map[int]bool)
+	for _, code := range config.BlockStatusCodes {
+		blockStatusCodes[code] = true
+	}
+
+	var blockStatusRanges []statusRange
+	for _, value := range config.BlockStatusRanges {
+		r, err := parseStatusRange(value)
+		if err != nil {
+			return nil, err
+		}
+		blockStatusRanges = append(blockStatusRanges, r)
+	}
+
+	var excludedPaths []*regexp.Regexp
+	for _, pattern := range config.ExcludedPaths {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded path %q: %s", pattern, err.Error())
+		}
+		excludedPaths = append(excludedPaths, re)
+	}
+
+	var localDenyRules []*denyRule
+	for _, value := range config.LocalDenyRules {
+		r, err := parseDenyRule(value)
+		if err != nil {
+			return nil, err
+		}
+		localDenyRules = append(localDenyRules, r)
+	}
+
+	blockedUserAgents, err := compileUserAgents("blockedUserAgents", config.BlockedUserAgents)
+	if err != nil {
+		return nil, err
+	}
+	allowedUserAgents, err := compileUserAgents("allowedUserAgents", config.AllowedUserAgents)
+	if err != nil {
+		return nil, err
+	}
+	if config.JailBlockedUserAgents && !config.JailEnabled {
+		return nil, fmt.Errorf("jailEnabled must be set when jailBlockedUserAgents is set")
+	}
+
+	bypassSourceRanges, err := parseSourceRanges("bypassSourceRanges", config.BypassSourceRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	var geoip *geoipDB
+	if config.GeoipDatabasePath != "" {
+		if geoip, err = openGeoipDB(config.GeoipDatabasePath); err != nil {
+			return nil, fmt.Errorf("fail to open geoipDatabasePath: %w", err)
+		}
+	} else if len(config.BlockCountries) > 0 || len(config.BypassCountries) > 0 {
+		return nil, fmt.Errorf("geoipDatabasePath cannot be empty when blockCountries or bypassCountries is set")
+	}
+
+	denySourceRanges, err := parseSourceRanges("denySourceRanges", config.DenySourceRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AdminPath != "" && config.AdminToken == "" {
+		return nil, fmt.Errorf("adminToken cannot be empty when adminPath is set")
+	}
+	if config.MetricsPath != "" && config.AdminToken == "" {
+		return nil, fmt.Errorf("adminToken cannot be empty when metricsPath is set")
+	}
+
+	// The rule engine mode defaults to the one of the plugin itself
+	wafModeValue := config.WafModeValue
+	if wafModeValue == "" && config.DetectionOnly {
+		wafModeValue = "DetectionOnly"
+	} else if wafModeValue == "" {
+		wafModeValue = "On"
+	}
+	switch strings.ToLower(wafModeValue) {
+	case "on":
+		wafModeValue = "On"
+	case "detectiononly":
+		wafModeValue = "DetectionOnly"
+	default:
+		return nil, fmt.Errorf("invalid wafModeValue %q, must be On or DetectionOnly", config.WafModeValue)
+	}
+	if config.WafModeValue != "" && config.WafModeHeader == "" {
+		return nil, fmt.Errorf("wafModeHeader must be set when wafModeValue is set")
+	}
+
+	wafAuthName, wafAuthValue, err := wafAuthHeader(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.HealthCheckPath != "" && !strings.HasPrefix(config.HealthCheckPath, "/") {
+		return nil, fmt.Errorf("invalid healthCheckPath %q, must start with /", config.HealthCheckPath)
+	}
+	if config.HealthCheckFailOnStartup && config.HealthCheckPath == "" {
+		return nil, fmt.Errorf("healthCheckPath must be set when healthCheckFailOnStartup is set")
+	}
+	healthCheckInterval := time.Duration(config.HealthCheckIntervalSecs) * time.Second
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = 10 * time.Second
+	}
+
+	maxResponseBodySize := config.MaxResponseBodySize
+	if maxResponseBodySize <= 0 {
+		maxResponseBodySize = 1 << 20
+	}
+
+	var webhook *webhook
+	if config.EventWebhookUrl != "" {
+		webhook = newWebhook(ctx, config.EventWebhookUrl, timeout, logger)
+	}
+
+	if config.CrowdsecLapiUrl == "" && (config.CrowdsecApiKey != "" || config.CrowdsecMachineId != "") {
+		return nil, fmt.Errorf("crowdsecLapiUrl cannot be empty when crowdsecApiKey or crowdsecMachineId is set")
+	}
+	var crowdsec *crowdsec
+	if config.CrowdsecLapiUrl != "" {
+		if config.CrowdsecApiKey == "" && config.CrowdsecMachineId == "" {
+			return nil, fmt.Errorf("crowdsecApiKey or crowdsecMachineId must be set when crowdsecLapiUrl is set")
+		}
+		decisionTTL := secsOrDefault(int64(config.CrowdsecDecisionCacheSecs), time.Minute)
+		crowdsec = newCrowdsec(ctx, strings.TrimSuffix(config.CrowdsecLapiUrl, "/"), config.CrowdsecApiKey, config.CrowdsecMachineId,
+			config.CrowdsecMachinePassword, decisionTTL, timeout, logger)
+	}
+
+	var auditLog *auditLog
+	if config.AuditLog {
+		if auditLog, err = newAuditLog(ctx, config.AuditLogPath, config.AuditLogHeaders); err != nil {
+			return nil, fmt.Errorf("fail to open audit log: %w", err)
+		}
+	}
+
+	var banLog *banLog
+	if config.BanLogPath != "" {
+		if !config.JailEnabled {
+			return nil, fmt.Errorf("jailEnabled must be set when banLogPath is set")
+		}
+		if banLog, err = newBanLog(ctx, config.BanLogPath, name); err != nil {
+			return nil, fmt.Errorf("fail to open ban log: %w", err)
+		}
+	}
+
+	trustedProxies, err := parseSourceRanges("trustedProxies", config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	clientIPHeader := config.ClientIPHeader
+	if clientIPHeader == "" {
+		clientIPHeader = "X-Forwarded-For"
+	}
+
+	anomalyScoreHeader := config.AnomalyScoreHeader
+	if anomalyScoreHeader == "" {
+		anomalyScoreHeader = "X-Anomaly-Score"
+	}
+
+	var wafSigningSecret []byte
+	if config.WafSigningSecret != "" {
+		wafSigningSecret = []byte(config.WafSigningSecret)
+	}
+	wafSignatureHeader := config.WafSignatureHeader
+	if wafSignatureHeader == "" {
+		wafSignatureHeader = "X-Waf-Signature"
+	}
+
+	denyStatusCode := config.DenyStatusCode
+	if denyStatusCode == 0 {
+		denyStatusCode = http.StatusForbidden
+	}
+
+	var cache verdictCache
+	if config.CacheEnabled {
+		switch config.CacheBackend {
+		case "", "memory":
+			maxEntries := config.CacheMaxEntries
+			if maxEntries <= 0 {
+				maxEntries = 10000
+			}
+			cache = newMemoryCache(maxEntries)
+		case "redis":
+			cache = newRedisCache(redis, config.RedisKeyPrefix)
+		default:
+			return nil, fmt.Errorf("invalid cacheBackend %q, must be memory or redis", config.CacheBackend)
+		}
+	}
+
+	cacheWhichVerdicts := strings.ToLower(config.CacheWhichVerdicts)
+	switch cacheWhichVerdicts {
+	case "":
+		cacheWhichVerdicts = "all"
+	case "all", "blocks", "allows":
+	default:
+		return nil, fmt.Errorf("invalid cacheWhichVerdicts %q, must be all, blocks or allows", config.CacheWhichVerdicts)
+	}
+
+	cacheControlSourceRanges, err := parseSourceRanges("cacheControlSourceRanges", config.CacheControlSourceRanges)
+	if err != nil {
+		return nil, err
+	}
+	if config.CacheControlHeader != "" && len(cacheControlSourceRanges) == 0 {
+		return nil, fmt.Errorf("cacheControlSourceRanges cannot be empty when cacheControlHeader is set")
+	}
+
+	if config.CacheTtlJitterPercent < 0 || config.CacheTtlJitterPercent > 100 {
+		return nil, fmt.Errorf("invalid cacheTtlJitterPercent %d, must be between 0 and 100", config.CacheTtlJitterPercent)
+	}
+
+	if config.CacheKeyIPv4Prefix < 0 || config.CacheKeyIPv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid cacheKeyIPv4Prefix %d, must be between 1 and 32", config.CacheKeyIPv4Prefix)
+	}
+	if config.CacheKeyIPv6Prefix < 0 || config.CacheKeyIPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid cacheKeyIPv6Prefix %d, must be between 1 and 128", config.CacheKeyIPv6Prefix)
+	}
+
+	var grpcPolicy string
+	switch strings.ToLower(config.GrpcPolicy) {
+	case "", "inspect":
+		grpcPolicy = "inspect"
+	case "headersonly":
+		grpcPolicy = "headersOnly"
+	case "bypass":
+		grpcPolicy = "bypass"
+	default:
+		return nil, fmt.Errorf("invalid grpcPolicy %q, must be inspect, headersOnly or bypass", config.GrpcPolicy)
+	}
+
+	h2cUpgradePolicy := strings.ToLower(config.H2cUpgradePolicy)
+	switch h2cUpgradePolicy {
+	case "":
+		h2cUpgradePolicy = "strip"
+	case "strip", "reject", "allow":
+	default:
+		return nil, fmt.Errorf("invalid h2cUpgradePolicy %q, must be strip, reject or allow", config.H2cUpgradePolicy)
+	}
+
+	var overLimitAction string
+	switch strings.ToLower(config.OverLimitAction) {
+	case "", "reject":
+		overLimitAction = "reject"
+	case "bypass":
+		overLimitAction = "bypass"
+	case "headersonly":
+		overLimitAction = "headersOnly"
+	default:
+		return nil, fmt.Errorf("invalid overLimitAction %q, must be reject, bypass or headersOnly", config.OverLimitAction)
+	}
+
+	forwardWafHeaders := make([]string, 0, len(config.ForwardWafHeaders))
+	for _, h := range config.ForwardWafHeaders {
+		forwardWafHeaders = append(forwardWafHeaders, http.CanonicalHeaderKey(h))
+	}
+	forwardWafHeadersTo := strings.ToLower(config.ForwardWafHeadersTo)
+	switch forwardWafHeadersTo {
+	case "":
+		forwardWafHeadersTo = "client"
+	case "client", "upstream", "both":
+	default:
+		return nil, fmt.Errorf("invalid forwardWafHeadersTo %q, must be client, upstream or both", config.ForwardWafHeadersTo)
+	}
+
+	cacheTTL := time.Duration(config.CacheTtlSecs) * time.Second
+	if cacheTTL <= 0 {
+		cacheTTL = 5 * time.Minute
+	}
+
+	if config.CaFile != "" && config.RootCAFile != "" {
+		return nil, fmt.Errorf("caFile and rootCAFile cannot both be set, rootCAFile is an alias of caFile")
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.InsecureSkipVerify {
+		logger.Warn("insecureSkipVerify is set, the modsecurity certificate is not verified")
+	}
+
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = 100
+	}
+
+	// dialer is a custom net.Dialer with a specified timeout and keep-alive duration.
+	dialer := &net.Dialer{
+		Timeout:   millisOrDefault(config.DialTimeoutMillis, 30*time.Second),
+		KeepAlive: secsOrDefault(config.KeepAliveSecs, 30*time.Second),
+	}
+	if config.DnsResolver != "" {
+		if _, _, err := net.SplitHostPort(config.DnsResolver); err != nil {
+			return nil, fmt.Errorf("invalid dnsResolver %q, must be host:port", config.DnsResolver)
+		}
+		dialer.Resolver = newDnsResolver(config.DnsResolver, dialer.Timeout)
+	}
+
+	// transport is a custom http.Transport with various timeouts and configurations for optimal performance.
+	// The overall timeout of a modsecurity call is timeoutMillis, these only bound its stages.
+	transport := &http.Transport{
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       millisOrDefault(config.IdleConnTimeoutMillis, 90*time.Second),
+		TLSHandshakeTimeout:   millisOrDefault(config.TlsHandshakeTimeoutMillis, 10*time.Second),
+		ResponseHeaderTimeout: millisOrDefault(config.ResponseHeaderTimeoutMillis, 0),
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     config.ForceHTTP2,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if socket, ok := sockets.socket(addr); ok {
+				return dialer.DialContext(ctx, "unix", socket)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	a := &Modsecurity{
+		backends:                  backends,
+		connectFailureTTL:         millisOrDefault(config.ConnectFailureCacheMillis, 0),
+		healthCheckPath:           config.HealthCheckPath,
+		resolver:                  dialer.Resolver,
+		wafExtraHeaders:           config.WafExtraHeaders,
+		wafModeHeader:             config.WafModeHeader,
+		wafModeValue:              wafModeValue,
+		wafAuthName:               wafAuthName,
+		wafAuthValue:              wafAuthValue,
+		wafSigningSecret:          wafSigningSecret,
+		wafSignatureHeader:        wafSignatureHeader,
+		hostBackends:              hostBackends,
+		next:                      next,
+		name:                      name,
+		httpClient:                &http.Client{Transport: transport},
+		timeoutPerMb:              millisOrDefault(config.TimeoutPerMbMillis, 0),
+		timeout:                   timeout,
+		breaker:                   breaker,
+		limiter:                   limiter,
+		rateLimiter:               rateLimiter,
+		wafRateLimiter:            wafRateLimiter,
+		bufferBudget:              bufferBudget,
+		adaptiveLimiter:           adaptiveLimiter,
+		latencyGuard:              latencyGuard,
+		redactRequestHeaders:      redactRequestHeaders,
+		forwardOnlyHeaders:        forwardOnlyHeaders,
+		redactMode:                redactMode,
+		redactBodyPatterns:        redactBodyPatterns,
+		decompressBodies:          config.DecompressBodies,
+		inspectBodyBytes:          config.InspectBodyBytes,
+		maxDecompressedBodySize:   maxDecompressedBodySize,
+		latencyBypassAction:       latencyBypassAction,
+		wafRateLimitAction:        wafRateLimitAction,
+		flights:                   newFlightGroup(),
+		overloadStatusCode:        overloadStatusCode,
+		overloadRetryAfterSecs:    overloadRetryAfterSecs,
+		logger:                    logger,
+		jail:                      jail,
+		jailOnStatusCodes:         jailOnStatusCodes,
+		scope:                     scope,
+		jailKeyCookie:             config.JailKeyCookie,
+		jailKeyHeader:             http.CanonicalHeaderKey(config.JailKeyHeader),
+		jailLoginPaths:            jailLoginPaths,
+		jailOnLoginStatusCodes:    jailOnLoginStatusCodes,
+		failOpen:                  config.FailOpen,
+		detectionOnly:             config.DetectionOnly,
+		blockStatusCodes:          blockStatusCodes,
+		blockStatusRanges:         blockStatusRanges,
+		excludedPaths:             excludedPaths,
+		localDenyRules:            localDenyRules,
+		blockedUserAgents:         blockedUserAgents,
+		allowedUserAgents:         allowedUserAgents,
+		jailBlockedUserAgents:     config.JailBlockedUserAgents,
+		inspectWebsocketHandshake: config.InspectWebsocketHandshake,
+		grpcPolicy:                grpcPolicy,
+		h2cUpgradePolicy:          h2cUpgradePolicy,
+		headersOnly:               config.HeadersOnly,
+		headersOnlyAboveSize:      config.HeadersOnlyAboveSize,
+		inspectContentTypes:       normalizeContentTypes(config.InspectContentTypes),
+		bypassContentTypes:        normalizeContentTypes(config.BypassContentTypes),
+		bypassSourceRanges:        bypassSourceRanges,
+		denySourceRanges:          denySourceRanges,
+		geoip:                     geoip,
+		crowdsec:                  crowdsec,
+		blockCountries:            normalizeCountries(config.BlockCountries),
+		bypassCountries:           normalizeCountries(config.BypassCountries),
+		denyStatusCode:            denyStatusCode,
+		anomalyScoreThreshold:     config.AnomalyScoreThreshold,
+		anomalyScoreHeader:        anomalyScoreHeader,
+		trustedProxies:            trustedProxies,
+		clientIPHeader:            clientIPHeader,
+		forwardClientHeaders:      config.ForwardClientHeaders,
+		preserveHost:              config.PreserveHost,
+		requestIDHeader:           config.RequestIdHeader,
+		logSpans:                  config.LogSpans,
+		metricsPath:               config.MetricsPath,
+		adminPath:                 strings.TrimSuffix(config.AdminPath, "/"),
+		webhook:                   webhook,
+		auditLog:                  auditLog,
+		banLog:                    banLog,
+		adminToken:                config.AdminToken,
+		metrics:                   newMetrics(name),
+		blockResponseStatusCode:   config.BlockResponseStatusCode,
+		blockResponseBody:         config.BlockResponseBody,
+		blockResponseContentType:  config.BlockResponseContentType,
+		jailResponseStatusCode:    jailResponseStatusCode,
+		jailResponseBody:          jailResponseBody,
+		jailResponseContentType:   jailResponseContentType,
+		jailResponseHeaders:       config.JailResponseHeaders,
+		maxBodySize:               config.MaxBodySize,
+		overLimitAction:           overLimitAction,
+		bodyMemoryLimit:           config.BodyMemoryLimit,
+		bodyTempDir:               config.BodyTempDir,
+		inspectResponses:          config.InspectResponses,
+		maxResponseBodySize:       maxResponseBodySize,
+		cache:                     cache,
+		cacheTTL:                  cacheTTL,
+		cacheTTLJitter:            float64(config.CacheTtlJitterPercent) / 100,
+		cacheStaleTTL:             time.Duration(config.CacheStaleWhileRevalidateSecs) * time.Second,
+		cacheConditionsMethods:    config.CacheConditionsMethods,
+		// Hosts checked by their own modsecurity instances don't share verdicts
+		cacheKeyIncludeHost:          config.CacheKeyIncludeHost || len(hostBackends) > 0 || scope == scopePerRouter,
+		cacheKeyHeaders:              config.CacheKeyHeaders,
+		cacheKeyCookies:              config.CacheKeyCookies,
+		forwardWafHeaders:            forwardWafHeaders,
+		forwardWafHeadersTo:          forwardWafHeadersTo,
+		cacheKeyIncludeRemoteAddress: config.CacheKeyIncludeRemoteAddress,
+		cacheKeyIPv4Prefix:           config.CacheKeyIPv4Prefix,
+		cacheKeyIPv6Prefix:           config.CacheKeyIPv6Prefix,
+		cacheKeyIgnoredParams:        config.CacheKeyIgnoredParams,
+		cacheKeySortParams:           config.CacheKeySortParams,
+		cacheKeyLowercasePath:        config.CacheKeyLowercasePath,
+		cacheWhichVerdicts:           cacheWhichVerdicts,
+		cacheServerErrors:            config.CacheServerErrors,
+		cacheControlHeader:           config.CacheControlHeader,
+		cacheControlSourceRanges:     cacheControlSourceRanges,
+	}
+
+	for _, pool := range a.backendPools() {
+		for _, b := range pool.backends {
+			if b.verdicts, err = a.newVerdictBackend(b.url, sockets, config); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.ResponseInspectionUrl != "" {
+		if a.responseInspector, err = a.newVerdictBackend(config.ResponseInspectionUrl, sockets, config); err != nil {
+			return nil, err
+		}
+	}
+	if config.ShadowModSecurityUrl != "" {
+		if a.shadow, err = a.newVerdictBackend(config.ShadowModSecurityUrl, sockets, config); err != nil {
+			return nil, err
+		}
+		a.shadowSlots = make(chan struct{}, shadowMaxInFlight)
+	}
+	if a.healthCheckPath != "" {
+		// The first health check doubles as a startup probe, catching misconfigured URLs right away
+		if config.HealthCheckFailOnStartup {
+			if err := a.checkHealth(ctx); err != nil {
+				return nil, err
+			}
+			go a.runHealthChecks(ctx, healthCheckInterval)
+		} else {
+			go func() {
+				a.checkHealth(ctx)
+				a.runHealthChecks(ctx, healthCheckInterval)
+			}()
+		}
+	}
+	if config.DnsRefreshSecs > 0 {
+		var urls []string
+		var spoeClients []*spoeClient
+		for _, pool := range a.backendPools() {
+			for _, b := range pool.backends {
+				urls = append(urls, b.url)
+				if spoe, ok := b.verdicts.(*spoeBackend); ok {
+					spoeClients = append(spoeClients, spoe.client)
+				}
+			}
+		}
+		// Connections in use are left alone, those to a gone instance fail and are dropped anyway
+		recycle := func() {
+			transport.CloseIdleConnections()
+			for _, client := range spoeClients {
+				client.closeIdle()
+			}
+		}
+		watcher := newDnsWatcher(a.resolver, modsecHostnames(urls), recycle, logger)
+		go watcher.run(ctx, time.Duration(config.DnsRefreshSecs)*time.Second)
+	}
+	if config.WarmupConnections > 0 {
+		// Idle connections are used again before they time out
+		go a.runWarmUp(ctx, config.WarmupConnections, transport.IdleConnTimeout/2)
+	}
+	if a.jail != nil {
+		if memory, ok := a.jail.store.(*memoryJailStore); ok {
+			a.metrics.jailEntries = memory.entries
+			a.metrics.jailEvictions = memory.evictions
+		}
+	}
+	if a.cache != nil {
+		if memory, ok := a.cache.(*memoryCache); ok {
+			a.metrics.cacheEntries = memory.len
+		}
+		go a.runCacheStats(ctx)
+	}
+	return a, nil
+}
+
+// secsOrDefault converts a duration in seconds from the configuration, fallback when it is not set.
+func secsOrDefault(secs int64, fallback time.Duration) time.Duration {
+	if secs <= 0 {
+		return fallback
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// millisOrDefault converts a duration in milliseconds from the configuration, fallback when it is not set.
+func millisOrDefault(millis int64, fallback time.Duration) time.Duration {
+	if millis <= 0 {
+		return fallback
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if a.metricsPath != "" && req.URL.Path == a.metricsPath {
+		a.serveMetrics(rw, req)
+		return
+	}
+
+	if a.adminPath != "" && strings.HasPrefix(req.URL.Path, a.adminPath+"/") {
+		a.serveAdmin(rw, req)
+		return
+	}
+
+	a.metrics.incRequests()
+
+	if a.requestIDHeader != "" {
+		a.assignRequestID(rw, req)
+	}
+
+	clientIP := a.clientIP(req)
+
+	// Once upgraded, the connection would carry requests modsecurity never sees
+	if isH2cUpgrade(req) {
+		switch a.h2cUpgradePolicy {
+		case "strip":
+			stripH2cUpgrade(req.Header)
+		case "reject":
+			a.log(req).Info("h2c upgrade rejected", "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if a.isDeniedSource(req, clientIP) {
+		a.log(req).Info("client is in a denied source range", "remoteAddr", req.RemoteAddr, "clientIP", clientIP)
+		a.metrics.incDenied()
+		http.Error(rw, http.StatusText(a.denyStatusCode), a.denyStatusCode)
+		return
+	}
+
+	if a.isBypassedSource(clientIP) {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if a.geoip != nil {
+		country := a.country(clientIP)
+		if a.blockCountries[country] {
+			a.log(req).Info("client country is blocked", "clientIP", clientIP, "country", country)
+			a.metrics.incDenied()
+			http.Error(rw, http.StatusText(a.denyStatusCode), a.denyStatusCode)
+			return
+		}
+		if a.bypassCountries[country] {
+			a.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+
+	// Check if the client is in jail, if jail is enabled
+	if a.jail != nil {
+		if until := a.jailReleaseTime(req, clientIP); !until.IsZero() {
+			a.log(req).Info("client is jailed", "clientIP", clientIP)
+			a.metrics.incJailRejected()
+			a.writeJailResponse(rw, until)
+			return
+		}
+	}
+
+	if a.crowdsec != nil && a.crowdsec.apiKey != "" {
+		until, err := a.crowdsec.banTime(req.Context(), clientIP)
+		if err != nil {
+			a.log(req).Warn("fail to get crowdsec decisions", "clientIP", clientIP, "error", err)
+		} else if !until.IsZero() {
+			a.log(req).Info("client is banned by crowdsec", "clientIP", clientIP)
+			a.metrics.incJailRejected()
+			a.writeJailResponse(rw, until)
+			return
+		}
+	}
+
+	if a.rateLimiter != nil {
+		if ok, wait := a.rateLimiter.allow(clientIP); !ok {
+			a.log(req).Info("client is rate limited", "clientIP", clientIP)
+			a.metrics.incRateLimited()
+			rw.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if matchesUserAgent(req, a.blockedUserAgents) {
+		a.log(req).Info("user agent is blocked", "userAgent", req.UserAgent(), "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+		a.metrics.incLocalDenied()
+		if a.jailBlockedUserAgents && a.jail != nil {
+			a.recordOffense(req, clientIP, &verdict{StatusCode: a.denyStatusCode})
+		}
+		http.Error(rw, http.StatusText(a.denyStatusCode), a.denyStatusCode)
+		return
+	}
+
+	if r := a.matchDenyRule(req); r != nil {
+		a.log(req).Info("request blocked by local deny rule", "rule", r.rule, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+		a.metrics.incLocalDenied()
+		http.Error(rw, http.StatusText(a.denyStatusCode), a.denyStatusCode)
+		return
+	}
+
+	// Websocket upgrades only skip modsecurity, the client checks above still apply to them
+	if isWebsocket(req) && !a.inspectWebsocketHandshake {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if a.isExcludedPath(req.URL.Path) || matchesUserAgent(req, a.allowedUserAgents) {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if isGrpc(req) && a.grpcPolicy == "bypass" {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	overLimit := a.maxBodySize > 0 && req.ContentLength > a.maxBodySize
+	if overLimit {
+		a.log(req).Info("request body too large", "clientIP", clientIP, "contentLength", req.ContentLength, "action", a.overLimitAction)
+		switch a.overLimitAction {
+		case "reject":
+			http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		case "bypass":
+			a.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+
+	// While modsecurity is too slow, requests bypass it or only their headers are inspected
+	degraded := a.latencyGuard != nil && a.latencyGuard.isDegraded()
+	if degraded && a.latencyBypassAction == "bypass" {
+		if !a.latencyGuard.probe() {
+			a.next.ServeHTTP(rw, req)
+			return
+		}
+		degraded = false
+	}
+
+	var cacheKey string
+	if a.cache != nil && a.isCacheable(req) {
+		cacheKey = a.cacheKey(req, clientIP)
+		switch a.cacheControl(req, clientIP) {
+		case "bypass":
+			cacheKey = ""
+		case "refresh":
+			// The cached verdict is skipped, and overwritten by the fresh one
+		default:
+			if v := a.getCachedVerdict(cacheKey); v != nil {
+				if isStale(v) {
+					a.revalidate(req, cacheKey)
+				}
+				if a.shadow != nil {
+					a.compareWithShadow(req, nil, v, clientIP)
+				}
+				a.handleVerdict(rw, req, v, clientIP)
+				return
+			}
+		}
+	}
+
+	if a.breaker != nil && !a.breaker.allow() {
+		a.handleUnavailable(rw, req, errCircuitOpen)
+		return
+	}
+
+	// Stream the body to modsecurity while capturing it, the next handler replays it once the verdict is known.
+	var body *bodyBuffer
+	if req.Body != nil && req.Body != http.NoBody && !overLimit && !degraded && a.inspectsBody(req) {
+		if a.bufferBudget != nil {
+			size := a.bufferedSize(req)
+			if !a.bufferBudget.reserve(req.Context(), size) {
+				a.handleBufferBudgetExceeded(rw, req, clientIP)
+				return
+			}
+			defer a.bufferBudget.release(size)
+		}
+		body = newSizedBodyBuffer(req.Body, a.maxBodySize, req.ContentLength)
+		if a.bodyMemoryLimit > 0 {
+			body.spillAbove(a.bodyMemoryLimit, a.bodyTempDir)
+		}
+		defer body.release()
+		// The next handler may never close the body, its reference is released once the request is served anyway
+		reader := body.NewReader()
+		defer reader.Close()
+		req.Body = reader
+	}
+
+	a.check(rw, req, clientIP, cacheKey, body)
+}
+
+// check gets the modsecurity verdict of the request, caches it under cacheKey if there is one, and acts on it.
+// Identical cacheable requests arriving together share a single modsecurity call.
+func (a *Modsecurity) check(rw http.ResponseWriter, req *http.Request, clientIP string, cacheKey string, body *bodyBuffer) {
+	var v *verdict
+	var err error
+	if cacheKey != "" {
+		var shared bool
+		v, err, shared = a.flights.do(cacheKey, func() (*verdict, error) {
+			v, err := a.fetchVerdict(req, body, cacheKey)
+			if err != nil && req.Context().Err() != nil {
+				return nil, errCallerGone
+			}
+			return v, err
+		})
+		// The request that made the call went away, this one still needs a verdict of its own
+		if shared && errors.Is(err, errCallerGone) {
+			v, err = a.fetchVerdict(req, body, cacheKey)
+		}
 	} else {
-		timeout = time.Duration(config.TimeoutMillis) * time.Millisecond
+		v, err = a.fetchVerdict(req, body, cacheKey)
 	}
 
-	// dialer is a custom net.Dialer with a specified timeout and keep-alive duration.
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+	if err != nil {
+		var readErr *requestBodyError
+		switch {
+		case req.Context().Err() != nil:
+			a.log(req).Debug("client went away before modsec answered", "clientIP", clientIP, "error", req.Context().Err())
+		case errors.Is(err, errOverloaded):
+			a.handleOverload(rw, req, clientIP)
+		case errors.Is(err, errWafRateLimited):
+			a.handleWafRateLimited(rw, req, clientIP)
+		case errors.Is(err, errBodyTooLarge):
+			a.handleOverLimit(rw, req, clientIP, body)
+		case errors.Is(err, errDecompressedBodyTooLarge):
+			a.log(req).Info("decompressed request body too large", "clientIP", clientIP)
+			http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errBodyEncoding):
+			a.log(req).Info("fail to decompress request body", "clientIP", clientIP, "error", err)
+			http.Error(rw, "Bad Request", http.StatusBadRequest)
+		case errors.As(err, &readErr):
+			a.log(req).Warn("fail to read incoming request", "clientIP", clientIP, "error", readErr.err)
+			http.Error(rw, "", http.StatusBadGateway)
+		default:
+			a.handleUnavailable(rw, req, err)
+		}
+		return
 	}
+	if a.shadow != nil {
+		a.compareWithShadow(req, body, v, clientIP)
+	}
+	a.handleVerdict(rw, req, v, clientIP)
+}
 
-	// transport is a custom http.Transport with various timeouts and configurations for optimal performance.
-	transport := &http.Transport{
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
-		ForceAttemptHTTP2: true,
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.DialContext(ctx, network, addr)
-		},
+// fetchVerdict calls modsecurity within the rate and concurrency limits, tells the circuit breaker how it went,
+// and caches the verdict under cacheKey if there is one.
+func (a *Modsecurity) fetchVerdict(req *http.Request, body *bodyBuffer, cacheKey string) (*verdict, error) {
+	v, err := a.limitedCheck(req, body, a.checkModsec)
+	if err == nil && cacheKey != "" && a.shouldCacheVerdict(v) {
+		a.setCachedVerdict(cacheKey, req, v)
+	}
+	return v, err
+}
+
+// limitedCheck gets a verdict from check within the rate and concurrency limits, and tells the circuit breaker
+// and the latency guard how it went. The caller already got the breaker to allow the call.
+func (a *Modsecurity) limitedCheck(req *http.Request, body *bodyBuffer, check func(*http.Request, *bodyBuffer) (*verdict, error)) (*verdict, error) {
+	if a.wafRateLimiter != nil && !a.wafRateLimiter.wait(req.Context()) {
+		if a.breaker != nil {
+			a.breaker.abort()
+		}
+		return nil, errWafRateLimited
+	}
+	if a.limiter != nil {
+		if !a.limiter.acquire(req.Context()) {
+			// The call the breaker allowed never happens
+			if a.breaker != nil {
+				a.breaker.abort()
+			}
+			return nil, errOverloaded
+		}
+		defer a.limiter.release()
+	}
+	if a.adaptiveLimiter != nil {
+		if !a.adaptiveLimiter.acquire() {
+			if a.breaker != nil {
+				a.breaker.abort()
+			}
+			return nil, errOverloaded
+		}
 	}
 
-	return &Modsecurity{
-		modSecurityUrl:                 config.ModSecurityUrl,
-		next:                           next,
-		name:                           name,
-		httpClient:                     &http.Client{Timeout: timeout, Transport: transport},
-		logger:                         log.New(os.Stdout, "", log.LstdFlags),
-		jailEnabled:                    config.JailEnabled,
-		badRequestsThresholdCount:      config.BadRequestsThresholdCount,
-		badRequestsThresholdPeriodSecs: config.BadRequestsThresholdPeriodSecs,
-		jailTimeDurationSecs:           config.JailTimeDurationSecs,
-		jail:                           make(map[string][]time.Time),
-		jailRelease:                    make(map[string]time.Time),
-	}, nil
+	start := time.Now()
+	v, err := check(req, body)
+	latency := time.Since(start)
+	if a.adaptiveLimiter != nil {
+		a.adaptiveLimiter.release(latency)
+	}
+	if a.latencyGuard != nil && req.Context().Err() == nil {
+		a.latencyGuard.observe(latency)
+	}
+	if a.breaker != nil {
+		a.reportToBreaker(v, err)
+	}
+	return v, err
 }
 
-func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if isWebsocket(req) {
+// handleOverLimit acts according to overLimitAction on a body that exceeded maxBodySize while it was
+// streamed to modsecurity. The next handler still gets the whole body, replayed from what was read so far.
+func (a *Modsecurity) handleOverLimit(rw http.ResponseWriter, req *http.Request, clientIP string, body *bodyBuffer) {
+	a.log(req).Info("request body too large", "clientIP", clientIP, "action", a.overLimitAction)
+	if a.overLimitAction == "reject" {
+		http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	req.Body.Close()
+	req.Body = body.overflowReader()
+	if a.overLimitAction == "bypass" {
 		a.next.ServeHTTP(rw, req)
 		return
 	}
 
-	clientIP := req.RemoteAddr
+	if a.breaker != nil && !a.breaker.allow() {
+		a.handleUnavailable(rw, req, errCircuitOpen)
+		return
+	}
+	a.check(rw, req, clientIP, "", nil)
+}
 
-	// Check if the client is in jail, if jail is enabled
-	if a.jailEnabled {
-		a.jailMutex.RLock()
-		if a.isClientInJail(clientIP) {
-			a.jailMutex.RUnlock()
-			a.logger.Printf("client %s is jailed", clientIP)
-			http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
-			return
-		}
-		a.jailMutex.RUnlock()
+// handleOverload either fails open to the next handler or turns the request away, asking the client to retry
+// later, when too many modsecurity calls are in flight.
+func (a *Modsecurity) handleOverload(rw http.ResponseWriter, req *http.Request, clientIP string) {
+	a.metrics.incOverloaded()
+	if a.failOpen {
+		a.log(req).Warn("too many modsec calls in flight, failing open", "clientIP", clientIP)
+		a.next.ServeHTTP(rw, req)
+		return
 	}
+	a.log(req).Warn("too many modsec calls in flight", "clientIP", clientIP)
+	rw.Header().Set("Retry-After", strconv.Itoa(a.overloadRetryAfterSecs))
+	http.Error(rw, http.StatusText(a.overloadStatusCode), a.overloadStatusCode)
+}
 
-	// Buffer the body if we want to read it here and send it in the request.
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		a.logger.Printf("fail to read incoming request: %s", err.Error())
-		http.Error(rw, "", http.StatusBadGateway)
+// handleWafRateLimited bypasses modsecurity or turns the request away, according to wafRateLimitAction, when
+// modsecurity calls are over wafRequestsPerSecond.
+func (a *Modsecurity) handleWafRateLimited(rw http.ResponseWriter, req *http.Request, clientIP string) {
+	a.metrics.incWafRateLimited()
+	if a.wafRateLimitAction == "bypass" {
+		a.log(req).Info("modsec calls over rate limit, bypassing modsec", "clientIP", clientIP)
+		a.next.ServeHTTP(rw, req)
 		return
 	}
-	req.Body = io.NopCloser(bytes.NewReader(body))
+	a.log(req).Warn("modsec calls over rate limit", "clientIP", clientIP)
+	rw.Header().Set("Retry-After", strconv.Itoa(a.overloadRetryAfterSecs))
+	http.Error(rw, http.StatusText(a.overloadStatusCode), a.overloadStatusCode)
+}
+
+// handleBufferBudgetExceeded turns the request away, asking the client to retry later, when the bodies buffered
+// by the requests in flight leave no room for its body.
+func (a *Modsecurity) handleBufferBudgetExceeded(rw http.ResponseWriter, req *http.Request, clientIP string) {
+	a.metrics.incBudgetExceeded()
+	a.log(req).Warn("buffered bodies over maxTotalBufferedBytes", "clientIP", clientIP, "contentLength", req.ContentLength)
+	rw.Header().Set("Retry-After", strconv.Itoa(a.overloadRetryAfterSecs))
+	http.Error(rw, http.StatusText(a.overloadStatusCode), a.overloadStatusCode)
+}
+
+var (
+	// errWafRateLimited modsecurity calls are over wafRequestsPerSecond.
+	errWafRateLimited = errors.New("modsec calls over rate limit")
+	// errOverloaded too many modsecurity calls are in flight.
+	errOverloaded = errors.New("too many modsec calls in flight")
+	// errCallerGone the request a shared modsecurity call was made for went away before it completed.
+	errCallerGone = errors.New("client went away before modsec answered")
+)
+
+// requestBodyError an error met while reading the body sent by the client.
+type requestBodyError struct {
+	err error
+}
+
+func (e *requestBodyError) Error() string {
+	return "fail to read incoming request: " + e.err.Error()
+}
+
+func (e *requestBodyError) Unwrap() error {
+	return e.err
+}
+
+// reportToBreaker tells the circuit breaker how the modsecurity call went. Errors that are not modsecurity's
+// fault, a broken request body or a client that went away, count neither as a success nor as a failure.
+func (a *Modsecurity) reportToBreaker(v *verdict, err error) {
+	var readErr *requestBodyError
+	switch {
+	case err == nil && v.StatusCode >= 500 && !a.isBlocked(v):
+		a.breaker.failure()
+	case err == nil:
+		a.breaker.success()
+	case errors.Is(err, context.Canceled), errors.Is(err, errBodyTooLarge), errors.As(err, &readErr):
+		a.breaker.abort()
+	default:
+		a.breaker.failure()
+	}
+}
+
+// checkModsec forwards the request to modsecurity and returns its verdict. Backends are tried in turn
+// until one of them answers. The request body, if any, is streamed to modsecurity from body.
+func (a *Modsecurity) checkModsec(req *http.Request, body *bodyBuffer) (*verdict, error) {
+	var lastErr error
+	pool := a.backendsFor(req)
+	for _, b := range pool.candidates() {
+		// Don't wait out the dial timeout again for a backend that just could not be connected to
+		if err := pool.unreachable(b); err != nil {
+			lastErr = err
+			continue
+		}
+
+		b.begin()
+		v, err := b.verdicts.check(req, body)
+		b.end()
+		if err == nil {
+			pool.reportSuccess(b)
+			return v, nil
+		}
+
+		// Neither a broken request body nor a client that went away are the backend's fault
+		var readErr *requestBodyError
+		if errors.As(err, &readErr) || req.Context().Err() != nil {
+			return nil, err
+		}
+
+		pool.reportFailure(b)
+		if a.connectFailureTTL > 0 && isConnectFailure(err) {
+			pool.reportUnreachable(b, err, a.connectFailureTTL)
+		}
+		a.log(req).Warn("modsec backend failed", "backend", b.url, "error", err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// callTimeout returns the timeout of a modsecurity call: timeoutMillis, plus timeoutPerMbMillis for every MB
+// of body sent along. A body of unknown length is assumed as big as maxBodySize.
+func (a *Modsecurity) callTimeout(req *http.Request, body *bodyBuffer) time.Duration {
+	if a.timeoutPerMb <= 0 || body == nil {
+		return a.timeout
+	}
+	size := req.ContentLength
+	if size < 0 {
+		size = a.maxBodySize
+	}
+	return a.timeout + time.Duration(float64(a.timeoutPerMb)*float64(size)/(1<<20))
+}
+
+// escapedRequestURI returns the path and query of the request as the client escaped them, so that semicolons,
+// encoded slashes and other encodings attacks rely on reach modsecurity unnormalized. Unlike RequestURI, it never
+// holds the scheme and host of a request sent in absolute form.
+func escapedRequestURI(req *http.Request) string {
+	uri := req.URL.EscapedPath()
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	if req.URL.ForceQuery || req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+	return uri
+}
+
+// checkBackend forwards the request to one modsecurity instance and returns its verdict.
+func (a *Modsecurity) checkBackend(req *http.Request, body *bodyBuffer, backendUrl string) (*verdict, error) {
+	url := backendUrl + escapedRequestURI(req)
 
-	// Create a new URL from the raw RequestURI sent by the client
-	url := fmt.Sprintf("%s%s", a.modSecurityUrl, req.RequestURI)
+	// The modsecurity call is cancelled when the client goes away, and bounded by our own timeout
+	ctx, cancel := context.WithTimeout(req.Context(), a.callTimeout(req, body))
+	defer cancel()
 
-	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
+	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, url, nil)
 	if err != nil {
-		a.logger.Printf("fail to prepare forwarded request: %s", err.Error())
-		http.Error(rw, "", http.StatusBadGateway)
-		return
+		return nil, fmt.Errorf("fail to prepare forwarded request: %s", err.Error())
+	}
+
+	if body != nil && a.rewritesBody(req) {
+		data, err := a.rewriteBody(req, body)
+		if err != nil {
+			return nil, err
+		}
+		proxyReq.ContentLength = int64(len(data))
+		proxyReq.Body = io.NopCloser(bytes.NewReader(data))
+		proxyReq.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	} else if body != nil {
+		proxyReq.ContentLength = req.ContentLength
+		// gRPC calls come without a Content-Length, the whole call is read so modsecurity gets a plain sized body
+		if req.ContentLength < 0 && isGrpc(req) {
+			n, err := body.fill()
+			if err != nil {
+				return nil, &requestBodyError{err: err}
+			}
+			proxyReq.ContentLength = n
+		}
+		if a.inspectBodyBytes > 0 && proxyReq.ContentLength > a.inspectBodyBytes {
+			proxyReq.ContentLength = a.inspectBodyBytes
+		}
+		proxyReq.Body = body.newReaderUpTo(a.inspectBodyBytes)
+		proxyReq.GetBody = func() (io.ReadCloser, error) {
+			return body.newReaderUpTo(a.inspectBodyBytes), nil
+		}
 	}
 
-	// We may want to filter some headers, otherwise we could just use a shallow copy
 	proxyReq.Header = make(http.Header)
 	for h, val := range req.Header {
 		proxyReq.Header[h] = val
 	}
+	removeHopHeaders(proxyReq.Header)
+	a.keepForwardOnlyHeaders(proxyReq.Header)
+	// Modsecurity only inspects a websocket handshake, as a plain request, but its rules may look at Upgrade
+	if isWebsocket(req) {
+		proxyReq.Header["Upgrade"] = req.Header["Upgrade"]
+	}
+	// The body, if any, is sent along straight away: the client got its 100 Continue when it was read
+	proxyReq.Header.Del("Expect")
+	a.redact(proxyReq.Header)
+	if body != nil && a.decompresses(req) {
+		proxyReq.Header.Del("Content-Encoding")
+	}
+	if a.preserveHost {
+		proxyReq.Host = req.Host
+	}
+	if a.forwardClientHeaders {
+		a.setForwardedHeaders(proxyReq, req)
+	}
+	// Set last, so that clients can't spoof them and forwardOnlyHeaders doesn't drop them
+	for k, v := range a.wafExtraHeaders {
+		proxyReq.Header.Set(k, v)
+	}
+	if a.wafModeHeader != "" {
+		proxyReq.Header.Set(a.wafModeHeader, a.wafModeValue)
+	}
+	a.setWafAuth(proxyReq.Header)
+	if err := a.signWafRequest(proxyReq); err != nil {
+		return nil, &requestBodyError{err: err}
+	}
+
+	var s *span
+	if a.logSpans {
+		s = startSpan(proxyReq.Header)
+	}
 
+	a.metrics.incModsecRequests()
+	start := time.Now()
 	resp, err := a.httpClient.Do(proxyReq)
+	a.metrics.observeLatency(time.Since(start))
+	if s != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		a.logSpan(req, s, status, err)
+	}
 	if err != nil {
-		a.logger.Printf("fail to send HTTP request to modsec: %s", err.Error())
-		http.Error(rw, "", http.StatusBadGateway)
-		return
+		if body != nil && body.readErr() != nil {
+			return nil, &requestBodyError{err: body.readErr()}
+		}
+		return nil, fmt.Errorf("fail to send HTTP request to modsec: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		if resp.StatusCode == http.StatusForbidden && a.jailEnabled {
-			a.recordOffense(clientIP)
+	v := &verdict{StatusCode: resp.StatusCode, WafHeader: a.selectWafHeaders(resp.Header)}
+	if a.anomalyScoreThreshold > 0 || (a.jail != nil && a.jail.scoreThreshold > 0) {
+		v.AnomalyScore = a.parseAnomalyScore(resp.Header)
+	}
+	if a.anomalyScoreThreshold > 0 {
+		// A score over the threshold blocks the request even though modsecurity let it through
+		if v.AnomalyScore >= a.anomalyScoreThreshold && !a.isBlockStatus(v.StatusCode) {
+			io.Copy(io.Discard, resp.Body)
+			v.StatusCode = http.StatusForbidden
+			return v, nil
+		}
+	}
+	if !a.isBlocked(v) {
+		io.Copy(io.Discard, resp.Body)
+		return v, nil
+	}
+
+	// Keep the modsecurity response of blocked requests, it is replayed to the client
+	v.Header = resp.Header.Clone()
+	if v.Body, err = io.ReadAll(resp.Body); err != nil {
+		return nil, fmt.Errorf("fail to read modsec response: %s", err.Error())
+	}
+	return v, nil
+}
+
+// handleVerdict blocks the request or passes it to the next handler according to the modsecurity verdict.
+func (a *Modsecurity) handleVerdict(rw http.ResponseWriter, req *http.Request, v *verdict, clientIP string) {
+	// Borderline requests that are let through still add up to a ban with score-based jailing
+	if a.jail != nil && a.jail.scoreThreshold > 0 && v.AnomalyScore > 0 {
+		a.recordAnomalyScore(req, clientIP, v)
+	}
+
+	if !a.isBlocked(v) {
+		// A server error that is not configured as a block means modsecurity itself is failing
+		if v.StatusCode >= 500 {
+			a.handleUnavailable(rw, req, fmt.Errorf("modsec returned %d", v.StatusCode))
+			return
+		}
+		if a.anomalyScoreThreshold > 0 && v.AnomalyScore > 0 {
+			a.log(req).Info("anomaly score below threshold, not blocking", "anomalyScore", v.AnomalyScore, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+		}
+		a.attachWafHeaders(rw, req, v)
+		a.serveNext(rw, req, clientIP)
+		return
+	}
+
+	if a.detectionOnly {
+		a.log(req).Info("detection only, not blocking", "status", v.StatusCode, "anomalyScore", v.AnomalyScore, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+		a.attachWafHeaders(rw, req, v)
+		a.serveNext(rw, req, clientIP)
+		return
+	}
+	a.log(req).Info("request blocked by modsec", "status", v.StatusCode, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+	a.metrics.incBlocked()
+	a.notify(eventBlocked, req, clientIP, v)
+	if a.jail != nil && a.jailOnStatusCodes[v.StatusCode] {
+		a.recordOffense(req, clientIP, v)
+	}
+	a.writeBlockResponse(rw, v)
+}
+
+// selectWafHeaders picks the modsecurity response headers listed in forwardWafHeaders, nil when there are none.
+func (a *Modsecurity) selectWafHeaders(header http.Header) http.Header {
+	var selected http.Header
+	for _, h := range a.forwardWafHeaders {
+		if vv, ok := header[h]; ok {
+			if selected == nil {
+				selected = make(http.Header)
+			}
+			selected[h] = append([]string(nil), vv...)
+		}
+	}
+	return selected
+}
+
+// attachWafHeaders attaches the selected modsecurity response headers of an allowed request to the client
+// response, the upstream request, or both, to correlate them with the modsecurity audit logs.
+func (a *Modsecurity) attachWafHeaders(rw http.ResponseWriter, req *http.Request, v *verdict) {
+	for h, vv := range v.WafHeader {
+		if a.forwardWafHeadersTo != "upstream" {
+			rw.Header()[h] = append([]string(nil), vv...)
+		}
+		if a.forwardWafHeadersTo != "client" {
+			req.Header[h] = append([]string(nil), vv...)
+		}
+	}
+}
+
+// writeJailResponse answers a jailed client, telling it when to come back.
+func (a *Modsecurity) writeJailResponse(rw http.ResponseWriter, until time.Time) {
+	for k, v := range a.jailResponseHeaders {
+		rw.Header().Set(k, v)
+	}
+	retryAfter := int64(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	rw.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	rw.Header().Set("Content-Type", a.jailResponseContentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(a.jailResponseStatusCode)
+	io.WriteString(rw, a.jailResponseBody)
+}
+
+// writeBlockResponse answers a blocked request, either with the configured block response
+// or by forwarding the modsecurity response as is.
+func (a *Modsecurity) writeBlockResponse(rw http.ResponseWriter, v *verdict) {
+	if a.blockResponseStatusCode == 0 && a.blockResponseBody == "" {
+		for k, vv := range v.Header {
+			for _, value := range vv {
+				rw.Header().Add(k, value)
+			}
+		}
+		rw.WriteHeader(v.StatusCode)
+		rw.Write(v.Body)
+		return
+	}
+
+	status := a.blockResponseStatusCode
+	if status == 0 {
+		status = v.StatusCode
+	}
+	contentType := a.blockResponseContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	// The modsecurity response is not replayed, only the headers selected by forwardWafHeaders are
+	if a.forwardWafHeadersTo != "upstream" {
+		for h, vv := range v.WafHeader {
+			rw.Header()[h] = append([]string(nil), vv...)
 		}
-		forwardResponse(resp, rw)
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	io.WriteString(rw, a.blockResponseBody)
+}
+
+// handleUnavailable either fails open to the next handler or answers with a bad gateway
+// when modsecurity could not give a verdict for the request. While the circuit breaker is open,
+// the answer is a service unavailable.
+func (a *Modsecurity) handleUnavailable(rw http.ResponseWriter, req *http.Request, err error) {
+	a.metrics.incModsecErrors()
+	if a.failOpen {
+		a.log(req).Warn("modsec unavailable, failing open", "error", err)
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+	a.log(req).Error("modsec unavailable", "error", err)
+	if errors.Is(err, errCircuitOpen) {
+		http.Error(rw, "", http.StatusServiceUnavailable)
 		return
 	}
+	http.Error(rw, "", http.StatusBadGateway)
+}
+
+// isBlocked reports whether a verdict means the request must be blocked, by its status code or,
+// when anomalyScoreThreshold is set, by its anomaly score.
+func (a *Modsecurity) isBlocked(v *verdict) bool {
+	if a.anomalyScoreThreshold > 0 && v.AnomalyScore >= a.anomalyScoreThreshold {
+		return true
+	}
+	return a.isBlockStatus(v.StatusCode)
+}
+
+// parseAnomalyScore reads the anomaly score modsecurity returned in anomalyScoreHeader, 0 when there is none.
+func (a *Modsecurity) parseAnomalyScore(header http.Header) int {
+	value := header.Get(a.anomalyScoreHeader)
+	if value == "" {
+		return 0
+	}
+	score, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		a.logger.Debug("invalid anomaly score", "header", a.anomalyScoreHeader, "value", value)
+		return 0
+	}
+	return score
+}
+
+// isBlockStatus reports whether a modsecurity status code means the request must be blocked.
+// Without any configured codes or ranges, every status >= 400 is a block.
+func (a *Modsecurity) isBlockStatus(code int) bool {
+	if len(a.blockStatusCodes) == 0 && len(a.blockStatusRanges) == 0 {
+		return code >= 400
+	}
+	if a.blockStatusCodes[code] {
+		return true
+	}
+	for _, r := range a.blockStatusRanges {
+		if r.contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRange an inclusive range of HTTP status codes.
+type statusRange struct {
+	from int
+	to   int
+}
+
+func (r statusRange) contains(code int) bool {
+	return code >= r.from && code <= r.to
+}
+
+// parseStatusRange parses a range such as "400-499", or a single status code such as "403".
+func parseStatusRange(value string) (statusRange, error) {
+	from, to, found := strings.Cut(strings.TrimSpace(value), "-")
+	start, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status range %q: %s", value, err.Error())
+	}
+	if !found {
+		return statusRange{from: start, to: start}, nil
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status range %q: %s", value, err.Error())
+	}
+	if end < start {
+		return statusRange{}, fmt.Errorf("invalid status range %q: end is lower than start", value)
+	}
+	return statusRange{from: start, to: end}, nil
+}
+
+// isDeniedSource reports whether the request comes from a denied network, either directly
+// or through one of the trustedProxies, as reported by clientIP.
+func (a *Modsecurity) isDeniedSource(req *http.Request, clientIP string) bool {
+	if len(a.denySourceRanges) == 0 {
+		return false
+	}
+	return ipInRanges(remoteIP(req), a.denySourceRanges) || ipInRanges(net.ParseIP(clientIP), a.denySourceRanges)
+}
+
+// isBypassedSource reports whether the client is in a trusted network. Only clientIP is matched, which is the
+// peer itself unless it is one of the trustedProxies, so that a proxy inside a bypassed network doesn't get
+// every client behind it bypassed.
+func (a *Modsecurity) isBypassedSource(clientIP string) bool {
+	if len(a.bypassSourceRanges) == 0 {
+		return false
+	}
+	return ipInRanges(net.ParseIP(clientIP), a.bypassSourceRanges)
+}
+
+func (a *Modsecurity) isExcludedPath(path string) bool {
+	for _, re := range a.excludedPaths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// hopHeaders the hop-by-hop headers, which only apply to the connection the request came in on.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	a.next.ServeHTTP(rw, req)
+// removeHopHeaders removes the hop-by-hop headers, along with the ones Connection lists.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
 }
 
 func isWebsocket(req *http.Request) bool {
@@ -176,60 +2096,110 @@ func isWebsocket(req *http.Request) bool {
 	return false
 }
 
-func forwardResponse(resp *http.Response, rw http.ResponseWriter) {
-	// Copy headers
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			rw.Header().Add(k, v)
+// isH2cUpgrade reports whether the request asks to upgrade its connection to HTTP/2 over cleartext.
+func isH2cUpgrade(req *http.Request) bool {
+	for _, value := range req.Header["Upgrade"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "h2c") {
+				return true
+			}
 		}
 	}
-	// Copy status
-	rw.WriteHeader(resp.StatusCode)
-	// Copy body
-	io.Copy(rw, resp.Body)
+	return false
 }
 
-func (a *Modsecurity) recordOffense(clientIP string) {
-	a.jailMutex.Lock()
-	defer a.jailMutex.Unlock()
+// stripH2cUpgrade removes the h2c upgrade from the request headers, which is then served as a plain HTTP/1.1
+// request: a server is free to ignore an upgrade, and clients carry on without it.
+func stripH2cUpgrade(header http.Header) {
+	var upgrades []string
+	for _, value := range header["Upgrade"] {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" && !strings.EqualFold(token, "h2c") {
+				upgrades = append(upgrades, token)
+			}
+		}
+	}
+	header.Del("Upgrade")
+	header.Del("HTTP2-Settings")
+	if len(upgrades) > 0 {
+		header.Set("Upgrade", strings.Join(upgrades, ", "))
+	}
 
-	now := time.Now()
-	// Remove offenses that are older than the threshold period
-	if offenses, exists := a.jail[clientIP]; exists {
-		var newOffenses []time.Time
-		for _, offense := range offenses {
-			if now.Sub(offense) <= time.Duration(a.badRequestsThresholdPeriodSecs)*time.Second {
-				newOffenses = append(newOffenses, offense)
+	var connection []string
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if token == "" || strings.EqualFold(token, "HTTP2-Settings") || (strings.EqualFold(token, "Upgrade") && len(upgrades) == 0) {
+				continue
 			}
+			connection = append(connection, token)
 		}
-		a.jail[clientIP] = newOffenses
 	}
+	header.Del("Connection")
+	if len(connection) > 0 {
+		header.Set("Connection", strings.Join(connection, ", "))
+	}
+}
+
+// inspectsBody reports whether the request body is sent to modsecurity, or only the request line and headers.
+func (a *Modsecurity) inspectsBody(req *http.Request) bool {
+	if a.headersOnly || (a.headersOnlyAboveSize > 0 && req.ContentLength > a.headersOnlyAboveSize) {
+		return false
+	}
+	// Streaming gRPC calls never end before their response starts
+	if isGrpc(req) {
+		return a.grpcPolicy != "headersOnly"
+	}
+	mediaType := requestMediaType(req)
+	if len(a.inspectContentTypes) > 0 && !matchesContentType(mediaType, a.inspectContentTypes) {
+		return false
+	}
+	return !matchesContentType(mediaType, a.bypassContentTypes)
+}
 
-	// Record the new offense
-	a.jail[clientIP] = append(a.jail[clientIP], now)
+// requestMediaType returns the lowercase media type of the request, without its parameters.
+func requestMediaType(req *http.Request) string {
+	mediaType, _, _ := strings.Cut(req.Header.Get("Content-Type"), ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
 
-	// Check if the client should be jailed
-	if len(a.jail[clientIP]) >= a.badRequestsThresholdCount {
-		a.logger.Printf("client %s reached threshold, putting in jail", clientIP)
-		a.jailRelease[clientIP] = now.Add(time.Duration(a.jailTimeDurationSecs) * time.Second)
+// normalizeContentTypes lowercases configured content types, trimming parameters.
+func normalizeContentTypes(contentTypes []string) []string {
+	normalized := make([]string, 0, len(contentTypes))
+	for _, ct := range contentTypes {
+		mediaType, _, _ := strings.Cut(ct, ";")
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(mediaType)))
 	}
+	return normalized
 }
 
-func (a *Modsecurity) isClientInJail(clientIP string) bool {
-	if releaseTime, exists := a.jailRelease[clientIP]; exists {
-		if time.Now().Before(releaseTime) {
+// matchesContentType reports whether a media type is one of contentTypes, which may hold wildcards like image/*.
+func matchesContentType(mediaType string, contentTypes []string) bool {
+	for _, ct := range contentTypes {
+		if ct == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(ct, "*"); ok && strings.HasPrefix(mediaType, prefix) {
 			return true
 		}
-		a.releaseFromJail(clientIP)
 	}
 	return false
 }
 
-func (a *Modsecurity) releaseFromJail(clientIP string) {
-	a.jailMutex.Lock()
-	defer a.jailMutex.Unlock()
+// isGrpc reports whether the request is a gRPC call.
+func isGrpc(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
 
-	delete(a.jail, clientIP)
-	delete(a.jailRelease, clientIP)
-	a.logger.Printf("client %s released from jail", clientIP)
+func forwardResponse(resp *http.Response, rw http.ResponseWriter) {
+	// Copy headers
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			rw.Header().Add(k, v)
+		}
+	}
+	// Copy status
+	rw.WriteHeader(resp.StatusCode)
+	// Copy body
+	io.Copy(rw, resp.Body)
 }
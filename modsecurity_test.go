@@ -8,7 +8,9 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestModsecurity_ServeHTTP(t *testing.T) {
@@ -38,6 +40,7 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 		expectStatus    int
 		jailEnabled     bool
 		jailConfig      *Config
+		detectionOnly   bool
 	}{
 		{
 			name:    "Forward request when WAF found no threats",
@@ -63,6 +66,19 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 			expectStatus:    403,
 			jailEnabled:     false,
 		},
+		{
+			name:    "Forward request when WAF found threats in detection only mode",
+			request: req.Clone(req.Context()),
+			wafResponse: response{
+				StatusCode: 403,
+				Body:       "Response from waf",
+			},
+			serviceResponse: serviceResponse,
+			expectBody:      "Response from service",
+			expectStatus:    200,
+			jailEnabled:     false,
+			detectionOnly:   true,
+		},
 		{
 			name: "Does not forward Websockets",
 			request: &http.Request{
@@ -94,8 +110,8 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 			expectStatus:    http.StatusTooManyRequests,
 			jailEnabled:     true,
 			jailConfig: &Config{
-				JailEnabled:                true,
-				BadRequestsThresholdCount:  3,
+				JailEnabled:                    true,
+				BadRequestsThresholdCount:      3,
 				BadRequestsThresholdPeriodSecs: 10,
 				JailTimeDurationSecs:           10,
 			},
@@ -126,12 +142,13 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 			})
 
 			config := &Config{
-				TimeoutMillis:              2000,
-				ModSecurityUrl:             modsecurityMockServer.URL,
-				JailEnabled:                tt.jailEnabled,
-				BadRequestsThresholdCount:  25,
+				TimeoutMillis:                  2000,
+				ModSecurityUrl:                 modsecurityMockServer.URL,
+				JailEnabled:                    tt.jailEnabled,
+				BadRequestsThresholdCount:      25,
 				BadRequestsThresholdPeriodSecs: 600,
 				JailTimeDurationSecs:           600,
+				DetectionOnly:                  tt.detectionOnly,
 			}
 
 			if tt.jailEnabled && tt.jailConfig != nil {
@@ -147,14 +164,67 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 			rw := httptest.NewRecorder()
 
 			for i := 0; i < config.BadRequestsThresholdCount; i++ {
-				middleware.ServeHTTP(rw, tt.request.Clone(tt.request.Context()))
+				middleware.ServeHTTP(rw, cloneRequest(tt.request))
 				if tt.jailEnabled && i < config.BadRequestsThresholdCount-1 {
 					assert.Equal(t, tt.wafResponse.StatusCode, rw.Result().StatusCode)
 				}
 			}
 
 			rw = httptest.NewRecorder()
-			middleware.ServeHTTP(rw, tt.request.Clone(tt.request.Context()))
+			middleware.ServeHTTP(rw, cloneRequest(tt.request))
+			resp := rw.Result()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.expectBody, string(body))
+			assert.Equal(t, tt.expectStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestModsecurity_FailOpen(t *testing.T) {
+	// A server that is closed straight away gives us an address that refuses connections
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Response from service"))
+	})
+
+	tests := []struct {
+		name         string
+		failOpen     bool
+		expectBody   string
+		expectStatus int
+	}{
+		{
+			name:         "Returns bad gateway when modsecurity is unreachable",
+			failOpen:     false,
+			expectBody:   "\n",
+			expectStatus: http.StatusBadGateway,
+		},
+		{
+			name:         "Forwards request when modsecurity is unreachable and failOpen is enabled",
+			failOpen:     true,
+			expectBody:   "Response from service",
+			expectStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.FailOpen = tt.failOpen
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
 			resp := rw.Result()
 			body, _ := io.ReadAll(resp.Body)
 			assert.Equal(t, tt.expectBody, string(body))
@@ -162,3 +232,820 @@ func TestModsecurity_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestModsecurity_BlockStatus(t *testing.T) {
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Response from service"))
+	})
+
+	tests := []struct {
+		name              string
+		wafStatus         int
+		blockStatusCodes  []int
+		blockStatusRanges []string
+		failOpen          bool
+		expectStatus      int
+	}{
+		{
+			name:         "Blocks any status >= 400 by default",
+			wafStatus:    http.StatusNotFound,
+			expectStatus: http.StatusNotFound,
+		},
+		{
+			name:             "Blocks a configured status code",
+			wafStatus:        http.StatusForbidden,
+			blockStatusCodes: []int{http.StatusForbidden},
+			expectStatus:     http.StatusForbidden,
+		},
+		{
+			name:             "Forwards a client error that is not configured as a block",
+			wafStatus:        http.StatusNotFound,
+			blockStatusCodes: []int{http.StatusForbidden},
+			expectStatus:     http.StatusOK,
+		},
+		{
+			name:              "Blocks a status within a configured range",
+			wafStatus:         http.StatusNotAcceptable,
+			blockStatusRanges: []string{"403-406"},
+			expectStatus:      http.StatusNotAcceptable,
+		},
+		{
+			name:             "Treats an unconfigured server error as modsecurity failure",
+			wafStatus:        http.StatusInternalServerError,
+			blockStatusCodes: []int{http.StatusForbidden},
+			expectStatus:     http.StatusBadGateway,
+		},
+		{
+			name:             "Fails open on an unconfigured server error",
+			wafStatus:        http.StatusInternalServerError,
+			blockStatusCodes: []int{http.StatusForbidden},
+			failOpen:         true,
+			expectStatus:     http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.wafStatus)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.BlockStatusCodes = tt.blockStatusCodes
+			config.BlockStatusRanges = tt.blockStatusRanges
+			config.FailOpen = tt.failOpen
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			assert.Equal(t, tt.expectStatus, rw.Result().StatusCode)
+		})
+	}
+}
+
+func TestModsecurity_AnomalyScoreThreshold(t *testing.T) {
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name         string
+		wafStatus    int
+		score        string
+		threshold    int
+		expectStatus int
+	}{
+		{name: "Blocks a score reaching the threshold", wafStatus: http.StatusOK, score: "10", threshold: 10, expectStatus: http.StatusForbidden},
+		{name: "Allows a score below the threshold", wafStatus: http.StatusOK, score: "5", threshold: 10, expectStatus: http.StatusOK},
+		{name: "Ignores the score without a threshold", wafStatus: http.StatusOK, score: "50", threshold: 0, expectStatus: http.StatusOK},
+		{name: "Ignores an invalid score", wafStatus: http.StatusOK, score: "high", threshold: 10, expectStatus: http.StatusOK},
+		{name: "Still blocks on a modsecurity block", wafStatus: http.StatusForbidden, score: "5", threshold: 10, expectStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Anomaly-Score", tt.score)
+				w.WriteHeader(tt.wafStatus)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.AnomalyScoreThreshold = tt.threshold
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			assert.Equal(t, tt.expectStatus, rw.Result().StatusCode)
+		})
+	}
+}
+
+func TestModsecurity_ForwardWafHeaders(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Unique-Id", "txn-42")
+		w.Header().Set("X-Other", "secret")
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name           string
+		path           string
+		to             string
+		blockBody      string
+		expectClient   string
+		expectUpstream string
+	}{
+		{name: "Forwards to the client", path: "/website", to: "client", expectClient: "txn-42"},
+		{name: "Forwards upstream", path: "/website", to: "upstream", expectUpstream: "txn-42"},
+		{name: "Forwards to both", path: "/website", to: "both", expectClient: "txn-42", expectUpstream: "txn-42"},
+		{name: "Forwards with a custom block response", path: "/attack", to: "client", blockBody: "Blocked", expectClient: "txn-42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r.Header.Get("X-Unique-Id")
+				assert.Empty(t, r.Header.Get("X-Other"))
+			})
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.ForwardWafHeaders = []string{"x-unique-id"}
+			config.ForwardWafHeadersTo = tt.to
+			config.BlockResponseBody = tt.blockBody
+
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.expectClient, rw.Header().Get("X-Unique-Id"))
+			assert.Empty(t, rw.Header().Get("X-Other"))
+			assert.Equal(t, tt.expectUpstream, upstream)
+		})
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	r, err := parseStatusRange("400-499")
+	assert.NoError(t, err)
+	assert.Equal(t, statusRange{from: 400, to: 499}, r)
+
+	r, err = parseStatusRange(" 403 ")
+	assert.NoError(t, err)
+	assert.Equal(t, statusRange{from: 403, to: 403}, r)
+
+	_, err = parseStatusRange("499-400")
+	assert.Error(t, err)
+
+	_, err = parseStatusRange("4xx")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_ExcludedPaths(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.ExcludedPaths = []string{"^/remote\\.php/dav/", "\\.ico$"}
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		path         string
+		expectStatus int
+	}{
+		{path: "/remote.php/dav/files/upload", expectStatus: http.StatusOK},
+		{path: "/favicon.ico", expectStatus: http.StatusOK},
+		{path: "/index.php?file=/remote.php/dav/", expectStatus: http.StatusForbidden},
+		{path: "/login", expectStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		assert.Equal(t, tt.expectStatus, rw.Result().StatusCode, tt.path)
+	}
+
+	config.ExcludedPaths = []string{"("}
+	_, err = New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_PreservesEscapedRequestURI(t *testing.T) {
+	var requestURI string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		target    string
+		expectURI string
+	}{
+		{target: "/a;b=c/d", expectURI: "/a;b=c/d"},
+		{target: "/a%2Fb", expectURI: "/a%2Fb"},
+		{target: "/a%252Fb", expectURI: "/a%252Fb"},
+		{target: "/%2e%2e/%2e%2e/etc/passwd", expectURI: "/%2e%2e/%2e%2e/etc/passwd"},
+		{target: "/a/../../etc/passwd", expectURI: "/a/../../etc/passwd"},
+		{target: "//evil.example/a", expectURI: "//evil.example/a"},
+		{target: "/caf%C3%A9%00.php", expectURI: "/caf%C3%A9%00.php"},
+		{target: "/search?q=%27%20OR%201=1;--&x=%00&x=%u0027", expectURI: "/search?q=%27%20OR%201=1;--&x=%00&x=%u0027"},
+		{target: "/search?", expectURI: "/search?"},
+		{target: "http://example.com/a%2Fb?x=1", expectURI: "/a%2Fb?x=1"},
+	}
+
+	for _, tt := range tests {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+		assert.Equal(t, tt.expectURI, requestURI, tt.target)
+	}
+}
+
+func TestModsecurity_RemovesHopHeaders(t *testing.T) {
+	var header http.Header
+	var body string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	var nextBody string
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		nextBody = string(data)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/upload", strings.NewReader("file=data"))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("X-End-To-End", "1")
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, name := range []string{"Expect", "Connection", "X-Hop", "Keep-Alive", "Te", "Proxy-Authorization"} {
+		assert.Empty(t, header.Get(name), name)
+	}
+	assert.Equal(t, "1", header.Get("X-End-To-End"))
+	assert.Equal(t, "file=data", body)
+	assert.Equal(t, "file=data", nextBody)
+}
+
+func TestModsecurity_InspectWebsocketHandshake(t *testing.T) {
+	var connection []string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection = r.Header["Connection"]
+		assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+		if r.URL.Query().Get("token") == "' OR 1=1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Upgrade", r.Header.Get("Connection"))
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.InspectWebsocketHandshake = true
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		path         string
+		expectStatus int
+	}{
+		{path: "/ws?token=abc", expectStatus: http.StatusSwitchingProtocols},
+		{path: "/ws?token=%27%20OR%201%3D1", expectStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		connection = nil
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, tt.expectStatus, rw.Result().StatusCode, tt.path)
+		assert.NotContains(t, connection, "Upgrade", tt.path)
+	}
+}
+
+func TestModsecurity_H2cUpgradePolicy(t *testing.T) {
+	var wafUpgrade string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafUpgrade = r.Header.Get("Upgrade")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name             string
+		policy           string
+		upgrade          string
+		expectStatus     int
+		expectUpgrade    string
+		expectConnection string
+		expectSettings   string
+	}{
+		{name: "strips the upgrade by default", upgrade: "h2c", expectStatus: http.StatusOK, expectConnection: "keep-alive"},
+		{name: "keeps the other upgrades", policy: "strip", upgrade: "h2c, foo/1", expectStatus: http.StatusOK, expectUpgrade: "foo/1", expectConnection: "keep-alive, Upgrade"},
+		{name: "rejects the upgrade", policy: "reject", upgrade: "H2C", expectStatus: http.StatusBadRequest},
+		{name: "allows the upgrade", policy: "allow", upgrade: "h2c", expectStatus: http.StatusOK, expectUpgrade: "h2c", expectConnection: "keep-alive, Upgrade, HTTP2-Settings", expectSettings: "AAMAAABkAAQAAP__"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream http.Header
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r.Header.Clone()
+			})
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			if tt.policy != "" {
+				config.H2cUpgradePolicy = tt.policy
+			}
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			wafUpgrade = ""
+			req := httptest.NewRequest(http.MethodGet, "/website", nil)
+			req.Header.Set("Connection", "keep-alive, Upgrade, HTTP2-Settings")
+			req.Header.Set("Upgrade", tt.upgrade)
+			req.Header.Set("HTTP2-Settings", "AAMAAABkAAQAAP__")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			if tt.expectStatus != http.StatusOK {
+				assert.Nil(t, upstream)
+				return
+			}
+			assert.Equal(t, tt.expectUpgrade, upstream.Get("Upgrade"))
+			assert.Equal(t, tt.expectConnection, upstream.Get("Connection"))
+			assert.Equal(t, tt.expectSettings, upstream.Get("HTTP2-Settings"))
+			assert.Empty(t, wafUpgrade)
+		})
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.H2cUpgradePolicy = "upgrade"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.EqualError(t, err, "invalid h2cUpgradePolicy \"upgrade\", must be strip, reject or allow")
+}
+
+func TestModsecurity_GrpcPolicy(t *testing.T) {
+	var wafContentLength int64
+	var wafBody string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafContentLength = r.ContentLength
+		body, _ := io.ReadAll(r.Body)
+		wafBody = string(body)
+		if strings.Contains(wafBody, "attack") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	var serviceBody string
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		serviceBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		policy              string
+		expectStatus        int
+		expectWafCalled     bool
+		expectWafBody       string
+		expectContentLength int64
+	}{
+		{policy: "inspect", expectStatus: http.StatusForbidden, expectWafCalled: true, expectWafBody: "grpc attack", expectContentLength: 11},
+		{policy: "headersOnly", expectStatus: http.StatusOK, expectWafCalled: true, expectWafBody: "", expectContentLength: 0},
+		{policy: "bypass", expectStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			wafContentLength, wafBody, serviceBody = -2, "", ""
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.GrpcPolicy = tt.policy
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			// gRPC calls are streamed, without a Content-Length
+			req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", io.NopCloser(strings.NewReader("grpc attack")))
+			req.ContentLength = -1
+			req.Header.Set("Content-Type", "application/grpc+proto")
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, tt.expectStatus, rw.Result().StatusCode)
+			if tt.expectWafCalled {
+				assert.Equal(t, tt.expectContentLength, wafContentLength)
+				assert.Equal(t, tt.expectWafBody, wafBody)
+			} else {
+				assert.Equal(t, int64(-2), wafContentLength)
+			}
+			if tt.expectStatus == http.StatusOK {
+				assert.Equal(t, "grpc attack", serviceBody)
+			}
+		})
+	}
+
+	config := CreateConfig()
+	config.GrpcPolicy = "stream"
+	_, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_ContentTypeFilter(t *testing.T) {
+	var wafBody string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wafBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "payload", string(body))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name                string
+		contentType         string
+		inspectContentTypes []string
+		bypassContentTypes  []string
+		expectWafBody       string
+	}{
+		{name: "Inspects any content type by default", contentType: "application/octet-stream", expectWafBody: "payload"},
+		{name: "Skips the body of a bypassed content type", contentType: "multipart/form-data; boundary=x", bypassContentTypes: []string{"Multipart/Form-Data"}, expectWafBody: ""},
+		{name: "Skips the body of a bypassed wildcard", contentType: "image/png", bypassContentTypes: []string{"image/*"}, expectWafBody: ""},
+		{name: "Inspects the body of a listed content type", contentType: "application/json; charset=utf-8", inspectContentTypes: []string{"application/json"}, expectWafBody: "payload"},
+		{name: "Skips the body of an unlisted content type", contentType: "application/octet-stream", inspectContentTypes: []string{"application/json"}, expectWafBody: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafBody = "not called"
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.InspectContentTypes = tt.inspectContentTypes
+			config.BypassContentTypes = tt.bypassContentTypes
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("payload"))
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+			assert.Equal(t, tt.expectWafBody, wafBody)
+		})
+	}
+}
+
+func TestModsecurity_HeadersOnly(t *testing.T) {
+	var wafBody string
+	var wafHeader string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wafBody = string(body)
+		wafHeader = r.Header.Get("X-Custom")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "0123456789", string(body))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name          string
+		headersOnly   bool
+		aboveSize     int64
+		expectWafBody string
+	}{
+		{name: "Sends the body by default", expectWafBody: "0123456789"},
+		{name: "Never sends the body in headers only mode", headersOnly: true, expectWafBody: ""},
+		{name: "Sends headers only for a body above the size", aboveSize: 5, expectWafBody: ""},
+		{name: "Sends a body below the size", aboveSize: 10, expectWafBody: "0123456789"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.HeadersOnly = tt.headersOnly
+			config.HeadersOnlyAboveSize = tt.aboveSize
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("0123456789"))
+			req.Header.Set("X-Custom", "checked")
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusOK, rw.Result().StatusCode)
+			assert.Equal(t, tt.expectWafBody, wafBody)
+			assert.Equal(t, "checked", wafHeader)
+		})
+	}
+}
+
+// cloneRequest clones a test request with a fresh body, so it can be served several times.
+func cloneRequest(req *http.Request) *http.Request {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		clone.Body, _ = req.GetBody()
+	}
+	return clone
+}
+
+func TestModsecurity_CancelsModsecurityCallWithClient(t *testing.T) {
+	wafCancelled := make(chan struct{})
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(wafCancelled)
+	}))
+	defer modsecurityMockServer.Close()
+
+	serviceCalled := false
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceCalled = true
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.TimeoutMillis = 10000
+	config.FailOpen = true
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case <-wafCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("modsecurity call was not cancelled")
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.False(t, serviceCalled, "a request from a client that went away must not be failed open")
+}
+
+func TestModsecurity_Timeout(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.TimeoutMillis = 50
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Result().StatusCode)
+}
+
+func TestModsecurity_CallTimeout(t *testing.T) {
+	a := &Modsecurity{timeout: 2 * time.Second, timeoutPerMb: 500 * time.Millisecond, maxBodySize: 4 << 20}
+	body := newBodyBuffer(strings.NewReader(""), 0)
+	defer body.release()
+
+	tests := []struct {
+		name          string
+		contentLength int64
+		body          *bodyBuffer
+		expect        time.Duration
+	}{
+		{name: "Without a body", contentLength: 0, body: nil, expect: 2 * time.Second},
+		{name: "Small body", contentLength: 1 << 10, body: body, expect: 2*time.Second + 488281},
+		{name: "Large body", contentLength: 10 << 20, body: body, expect: 7 * time.Second},
+		{name: "Body of unknown length", contentLength: -1, body: body, expect: 4 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			req.ContentLength = tt.contentLength
+			assert.Equal(t, tt.expect, a.callTimeout(req, tt.body))
+		})
+	}
+
+	a.timeoutPerMb = 0
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.ContentLength = 10 << 20
+	assert.Equal(t, 2*time.Second, a.callTimeout(req, body))
+}
+
+func TestNew_Transport(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.TlsHandshakeTimeoutMillis = 500
+	config.ResponseHeaderTimeoutMillis = 1500
+	config.MaxConnsPerHost = 64
+	config.ForceHTTP2 = false
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	transport := middleware.(*Modsecurity).httpClient.Transport.(*http.Transport)
+	assert.Equal(t, 500*time.Millisecond, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 1500*time.Millisecond, transport.ResponseHeaderTimeout)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 100, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 64, transport.MaxConnsPerHost)
+	assert.False(t, transport.ForceAttemptHTTP2)
+}
+
+func TestModsecurity_BlockResponse(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.59 (Unix)")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<html>Apache 403 Forbidden</html>"))
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name              string
+		statusCode        int
+		body              string
+		contentType       string
+		expectStatus      int
+		expectBody        string
+		expectContentType string
+		expectServer      string
+	}{
+		{
+			name:              "Forwards the modsecurity response by default",
+			expectStatus:      http.StatusForbidden,
+			expectBody:        "<html>Apache 403 Forbidden</html>",
+			expectContentType: "text/html; charset=utf-8",
+			expectServer:      "Apache/2.4.59 (Unix)",
+		},
+		{
+			name:              "Returns the custom body with the modsecurity status",
+			body:              `{"error":"request blocked"}`,
+			contentType:       "application/json",
+			expectStatus:      http.StatusForbidden,
+			expectBody:        `{"error":"request blocked"}`,
+			expectContentType: "application/json",
+		},
+		{
+			name:              "Returns the custom status code",
+			statusCode:        http.StatusNotFound,
+			expectStatus:      http.StatusNotFound,
+			expectBody:        "",
+			expectContentType: "text/plain; charset=utf-8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.BlockResponseStatusCode = tt.statusCode
+			config.BlockResponseBody = tt.body
+			config.BlockResponseContentType = tt.contentType
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			resp := rw.Result()
+			body, _ := io.ReadAll(resp.Body)
+
+			assert.Equal(t, tt.expectStatus, resp.StatusCode)
+			assert.Equal(t, tt.expectBody, string(body))
+			assert.Equal(t, tt.expectContentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, tt.expectServer, resp.Header.Get("Server"))
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// denyRule a local rule blocking the requests whose method, path, query or header matches a regular expression,
+// without calling modsecurity.
+type denyRule struct {
+	rule   string
+	field  string
+	header string
+	re     *regexp.Regexp
+}
+
+// parseDenyRule parses a rule of the form method:<regexp>, path:<regexp>, query:<regexp> or
+// header:<name>:<regexp>.
+func parseDenyRule(value string) (*denyRule, error) {
+	field, pattern, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid localDenyRules %q, must be method:, path:, query: or header:<name>: followed by a regular expression", value)
+	}
+	r := &denyRule{rule: value, field: strings.ToLower(strings.TrimSpace(field))}
+	switch r.field {
+	case "method", "path", "query":
+	case "header":
+		if r.header, pattern, ok = strings.Cut(pattern, ":"); !ok || r.header == "" {
+			return nil, fmt.Errorf("invalid localDenyRules %q, the header name is missing", value)
+		}
+		r.header = http.CanonicalHeaderKey(r.header)
+	default:
+		return nil, fmt.Errorf("invalid localDenyRules %q, must be method:, path:, query: or header:<name>: followed by a regular expression", value)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid localDenyRules %q: %s", value, err.Error())
+	}
+	r.re = re
+	return r, nil
+}
+
+// matches reports whether the request matches the rule. A header rule matches any of the header values.
+func (r *denyRule) matches(req *http.Request) bool {
+	switch r.field {
+	case "method":
+		return r.re.MatchString(req.Method)
+	case "path":
+		return r.re.MatchString(req.URL.Path)
+	case "query":
+		return r.re.MatchString(req.URL.RawQuery)
+	}
+	for _, value := range req.Header[r.header] {
+		if r.re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileUserAgents compiles the regular expressions of a User-Agent list.
+func compileUserAgents(name string, patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", name, pattern, err.Error())
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// matchesUserAgent reports whether the User-Agent of the request matches any of the regular expressions.
+func matchesUserAgent(req *http.Request, res []*regexp.Regexp) bool {
+	userAgent := req.UserAgent()
+	for _, re := range res {
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDenyRule returns the first local deny rule the request matches, nil when there is none.
+func (a *Modsecurity) matchDenyRule(req *http.Request) *denyRule {
+	for _, r := range a.localDenyRules {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
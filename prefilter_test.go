@@ -0,0 +1,155 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDenyRule(t *testing.T) {
+	tests := []struct {
+		value        string
+		expectField  string
+		expectHeader string
+		expectErr    bool
+	}{
+		{value: "path:^/\\.env", expectField: "path"},
+		{value: "Method:^(TRACE|TRACK)$", expectField: "method"},
+		{value: "query:union.+select", expectField: "query"},
+		{value: "header:user-agent:sqlmap", expectField: "header", expectHeader: "User-Agent"},
+		{value: "header:X-Debug:", expectField: "header", expectHeader: "X-Debug"},
+		{value: "header::sqlmap", expectErr: true},
+		{value: "header:User-Agent", expectErr: true},
+		{value: "body:passwd", expectErr: true},
+		{value: "^/\\.env", expectErr: true},
+		{value: "path:(", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		r, err := parseDenyRule(tt.value)
+		if tt.expectErr {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		if assert.NoError(t, err, tt.value) {
+			assert.Equal(t, tt.expectField, r.field, tt.value)
+			assert.Equal(t, tt.expectHeader, r.header, tt.value)
+		}
+	}
+}
+
+func TestModsecurity_LocalDenyRules(t *testing.T) {
+	var calls int32
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.LocalDenyRules = []string{
+		"method:^TRACE$",
+		"path:^/\\.(env|git)",
+		"path:^/wp-login\\.php$",
+		"query:(?i)union.+select",
+		"header:User-Agent:sqlmap",
+	}
+	config.DenyStatusCode = http.StatusNotFound
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	tests := []struct {
+		method       string
+		target       string
+		userAgent    string
+		expectStatus int
+	}{
+		{method: http.MethodGet, target: "/.env", expectStatus: http.StatusNotFound},
+		{method: http.MethodGet, target: "/.git/config", expectStatus: http.StatusNotFound},
+		{method: http.MethodPost, target: "/wp-login.php", expectStatus: http.StatusNotFound},
+		{method: http.MethodGet, target: "/search?q=1+UNION+SELECT+password", expectStatus: http.StatusNotFound},
+		{method: http.MethodGet, target: "/", userAgent: "sqlmap/1.7", expectStatus: http.StatusNotFound},
+		{method: "TRACE", target: "/", expectStatus: http.StatusNotFound},
+		{method: http.MethodGet, target: "/environment", expectStatus: http.StatusOK},
+		{method: http.MethodGet, target: "/search?q=union", userAgent: "curl/8.0", expectStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.userAgent != "" {
+			req.Header.Set("User-Agent", tt.userAgent)
+		}
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		assert.Equal(t, tt.expectStatus, rw.Code, "%s %s", tt.method, tt.target)
+	}
+
+	// Only the requests no rule matched reached modsecurity
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(6), middleware.(*Modsecurity).metrics.localDenied)
+
+	config.LocalDenyRules = []string{"cookie:session"}
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_UserAgents(t *testing.T) {
+	var calls int32
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.BlockedUserAgents = []string{"(?i)(sqlmap|nikto)"}
+	config.AllowedUserAgents = []string{"^UptimeRobot/"}
+	config.JailEnabled = true
+	config.JailBlockedUserAgents = true
+	config.BadRequestsThresholdCount = 2
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func(userAgent, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/website", nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Allowed agents skip modsecurity, which blocks everything else
+	assert.Equal(t, http.StatusOK, serve("UptimeRobot/2.0", "192.0.2.1:1234"))
+	assert.Equal(t, http.StatusForbidden, serve("Mozilla/5.0", "192.0.2.1:1234"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Blocked agents are rejected locally, and jailed on their second request
+	assert.Equal(t, http.StatusForbidden, serve("sqlmap/1.7", "198.51.100.1:1234"))
+	assert.Equal(t, http.StatusForbidden, serve("Nikto/2.5", "198.51.100.1:1234"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	a := middleware.(*Modsecurity)
+	assert.Equal(t, int64(2), a.metrics.localDenied)
+	assert.True(t, a.jail.isJailed("198.51.100.1"))
+
+	config.JailEnabled = false
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+
+	config.JailBlockedUserAgents = false
+	config.AllowedUserAgents = []string{"("}
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
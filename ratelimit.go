@@ -0,0 +1,169 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// rateLimitShards number of independently locked shards of a rateLimiter.
+const rateLimitShards = 32
+
+// rateLimitReapInterval how often the buckets of clients that stopped sending requests are swept.
+const rateLimitReapInterval = time.Minute
+
+// tokenBucket the requests a client may still send, as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimitShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rateLimiter throttles every client with a token bucket of burst tokens, refilled at rate tokens per second.
+// A client without a bucket has a full one, so buckets are only kept while they are not full.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	shards [rateLimitShards]*rateLimitShard
+	nowFn  func() time.Time
+}
+
+func newRateLimiter(average int, period time.Duration, burst int) *rateLimiter {
+	l := &rateLimiter{
+		rate:  float64(average) / period.Seconds(),
+		burst: float64(burst),
+		nowFn: time.Now,
+	}
+	for i := range l.shards {
+		l.shards[i] = &rateLimitShard{buckets: make(map[string]*tokenBucket)}
+	}
+	return l
+}
+
+func (l *rateLimiter) shard(clientIP string) *rateLimitShard {
+	h := fnv.New32a()
+	h.Write([]byte(clientIP))
+	return l.shards[h.Sum32()%rateLimitShards]
+}
+
+// allow takes a token of the client. When there is none left, it reports false along with how long the client
+// has to wait for the next one.
+func (l *rateLimiter) allow(clientIP string) (bool, time.Duration) {
+	now := l.nowFn()
+	shard := l.shard(clientIP)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	b, ok := shard.buckets[clientIP]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		shard.buckets[clientIP] = b
+	}
+	wait, ok := b.reserve(now, l.rate, l.burst, 0)
+	return ok, wait
+}
+
+// refill returns the tokens of the bucket as of now.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rate
+	if tokens > burst {
+		return burst
+	}
+	return tokens
+}
+
+// reserve takes a token available within maxWait, and returns how long to wait for it. When there is none,
+// it reports false along with how long until the next one.
+func (b *tokenBucket) reserve(now time.Time, rate, burst float64, maxWait time.Duration) (time.Duration, bool) {
+	b.tokens = b.refill(now, rate, burst)
+	b.last = now
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	// Tokens go negative while callers wait for the ones they reserved
+	b.tokens--
+	return wait, true
+}
+
+// reap removes the buckets that are full again.
+func (l *rateLimiter) reap(now time.Time) {
+	for _, shard := range l.shards {
+		shard.mu.Lock()
+		for clientIP, b := range shard.buckets {
+			if b.refill(now, l.rate, l.burst) >= l.burst {
+				delete(shard.buckets, clientIP)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// runReaper reaps the buckets every rateLimitReapInterval until ctx is done.
+func (l *rateLimiter) runReaper(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.reap(now)
+		}
+	}
+}
+
+// wafRateLimiter bounds the aggregate rate of modsecurity calls with a single token bucket.
+type wafRateLimiter struct {
+	mu      sync.Mutex
+	bucket  tokenBucket
+	rate    float64
+	burst   float64
+	maxWait time.Duration
+	nowFn   func() time.Time
+}
+
+// newWafRateLimiter limits modsecurity calls to rate per second, up to burst at once. Calls over the rate wait
+// up to maxWait for a token, 0 turns them away straight away.
+func newWafRateLimiter(rate int, burst int, maxWait time.Duration) *wafRateLimiter {
+	return &wafRateLimiter{
+		bucket:  tokenBucket{tokens: float64(burst), last: time.Now()},
+		rate:    float64(rate),
+		burst:   float64(burst),
+		maxWait: maxWait,
+		nowFn:   time.Now,
+	}
+}
+
+// wait takes a token, waiting for it when it comes within maxWait. It reports false when there is none
+// soon enough or ctx is done first.
+func (l *wafRateLimiter) wait(ctx context.Context) bool {
+	l.mu.Lock()
+	wait, ok := l.bucket.reserve(l.nowFn(), l.rate, l.burst, l.maxWait)
+	l.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		// The reserved token is lost, the rate stays within the limit
+		return false
+	}
+}
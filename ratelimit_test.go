@@ -0,0 +1,156 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, time.Second, 3)
+	l.nowFn = func() time.Time { return now }
+
+	// The burst goes through, then a token every half second
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("192.0.2.1")
+		assert.True(t, ok, "request %d", i)
+	}
+	ok, wait := l.allow("192.0.2.1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other clients have their own bucket
+	ok, _ = l.allow("192.0.2.2")
+	assert.True(t, ok)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, wait = l.allow("192.0.2.1")
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, _ = l.allow("192.0.2.1")
+	assert.True(t, ok)
+
+	// Full buckets are forgotten
+	l.reap(now.Add(2 * time.Second))
+	assert.Len(t, l.shard("192.0.2.1").buckets, 0)
+	assert.Len(t, l.shard("192.0.2.2").buckets, 0)
+}
+
+func TestModsecurity_RateLimit(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.RateLimitAverage = 1
+	config.RateLimitPeriodSecs = 60
+	config.RateLimitBurst = 2
+	config.BypassSourceRanges = []string{"198.51.100.0/24"}
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/website", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234").Code)
+	rw := serve("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	assert.Equal(t, int64(1), middleware.(*Modsecurity).metrics.rateLimited)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve("198.51.100.1:1234").Code)
+	}
+}
+
+func TestWafRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newWafRateLimiter(10, 1, 250*time.Millisecond)
+	l.nowFn = func() time.Time { return now }
+
+	assert.True(t, l.wait(context.Background()))
+
+	// The next tokens come every 100ms, callers wait for the ones they reserved
+	start := time.Now()
+	assert.True(t, l.wait(context.Background()))
+	assert.True(t, l.wait(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// The next one would come in 300ms, past the maximum wait
+	assert.False(t, l.wait(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	now = now.Add(time.Second)
+	assert.True(t, l.wait(ctx))
+	assert.False(t, l.wait(ctx))
+}
+
+func TestModsecurity_WafRequestsPerSecond(t *testing.T) {
+	tests := []struct {
+		action       string
+		expectStatus int
+		expectCalls  int32
+	}{
+		{action: "reject", expectStatus: http.StatusServiceUnavailable, expectCalls: 1},
+		{action: "bypass", expectStatus: http.StatusOK, expectCalls: 1},
+		{action: "queue", expectStatus: http.StatusOK, expectCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			var calls int32
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.WafRequestsPerSecond = 5
+			config.WafRequestsBurst = 1
+			config.WafRateLimitAction = tt.action
+
+			middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+			assert.Equal(t, http.StatusOK, rw.Code)
+
+			rw = httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectCalls, atomic.LoadInt32(&calls))
+		})
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://modsecurity"
+	config.WafRequestsPerSecond = 5
+	config.WafRateLimitAction = "drop"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces the values of the redacted headers sent to modsecurity.
+const redactedValue = "REDACTED"
+
+// redact strips or masks the redactRequestHeaders of a copy of the request headers about to be sent to
+// modsecurity, so that secrets stay out of its audit log. Masking keeps the header, and the names of cookies,
+// so that rules on their presence still match.
+func (a *Modsecurity) redact(header http.Header) {
+	for _, name := range a.redactRequestHeaders {
+		values, ok := header[name]
+		if !ok {
+			continue
+		}
+		if a.redactMode == "strip" {
+			delete(header, name)
+			continue
+		}
+		masked := make([]string, len(values))
+		for i, value := range values {
+			if name == "Cookie" {
+				masked[i] = maskCookies(value)
+			} else {
+				masked[i] = redactedValue
+			}
+		}
+		header[name] = masked
+	}
+}
+
+// keepForwardOnlyHeaders removes from a copy of the request headers about to be sent to modsecurity those that
+// are not in forwardOnlyHeaders, when it is set.
+func (a *Modsecurity) keepForwardOnlyHeaders(header http.Header) {
+	if a.forwardOnlyHeaders == nil {
+		return
+	}
+	for name := range header {
+		if !a.forwardOnlyHeaders[name] {
+			delete(header, name)
+		}
+	}
+}
+
+// maskCookies masks the values of a Cookie header, keeping the cookie names.
+func maskCookies(value string) string {
+	var masked []string
+	for _, cookie := range strings.Split(value, ";") {
+		if name, _, _ := strings.Cut(strings.TrimSpace(cookie), "="); name != "" {
+			masked = append(masked, name+"="+redactedValue)
+		}
+	}
+	return strings.Join(masked, "; ")
+}
+
+// maskBody masks the matches of redactBodyPatterns in a body read whole, patterns can't be matched across the
+// chunks of a stream.
+func (a *Modsecurity) maskBody(data []byte) []byte {
+	for _, re := range a.redactBodyPatterns {
+		data = maskMatches(re, data)
+	}
+	return data
+}
+
+// maskMatches replaces the matches of re with redactedValue. When re has a group, only what the first group
+// matched is replaced, so that e.g. `password=([^&]*)` keeps the argument name rules look for.
+func maskMatches(re *regexp.Regexp, data []byte) []byte {
+	matches := re.FindAllSubmatchIndex(data, -1)
+	if matches == nil {
+		return data
+	}
+
+	masked := make([]byte, 0, len(data))
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		masked = append(masked, data[last:start]...)
+		masked = append(masked, redactedValue...)
+		last = end
+	}
+	return append(masked, data[last:]...)
+}
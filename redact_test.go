@@ -0,0 +1,191 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskCookies(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect string
+	}{
+		{value: "session=abc", expect: "session=REDACTED"},
+		{value: "session=abc; theme=dark;", expect: "session=REDACTED; theme=REDACTED"},
+		{value: "flag", expect: "flag=REDACTED"},
+		{value: "", expect: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, maskCookies(tt.value), tt.value)
+	}
+}
+
+func TestModsecurity_RedactRequestHeaders(t *testing.T) {
+	tests := []struct {
+		mode        string
+		expectWaf   http.Header
+		expectError bool
+	}{
+		{
+			mode: "mask",
+			expectWaf: http.Header{
+				"Authorization": {"REDACTED"},
+				"Cookie":        {"session=REDACTED; theme=REDACTED"},
+				"X-Api-Key":     {"REDACTED", "REDACTED"},
+			},
+		},
+		{
+			mode:      "strip",
+			expectWaf: http.Header{},
+		},
+		{
+			mode:        "hash",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var wafHeader, nextHeader http.Header
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafHeader = r.Header
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.RedactRequestHeaders = []string{"authorization", "Cookie", "X-API-Key", "X-Missing"}
+			config.RedactMode = tt.mode
+
+			middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHeader = r.Header
+			}), config, "modsecurity-middleware")
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/website", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("Cookie", "session=abc; theme=dark")
+			req.Header.Add("X-Api-Key", "key1")
+			req.Header.Add("X-Api-Key", "key2")
+			req.Header.Set("User-Agent", "test")
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			for _, name := range []string{"Authorization", "Cookie", "X-Api-Key", "X-Missing"} {
+				assert.Equal(t, tt.expectWaf[name], wafHeader[name], name)
+			}
+			assert.Equal(t, "test", wafHeader.Get("User-Agent"))
+			assert.Equal(t, "Bearer secret", nextHeader.Get("Authorization"))
+			assert.Equal(t, []string{"key1", "key2"}, nextHeader.Values("X-Api-Key"))
+		})
+	}
+}
+
+func TestModsecurity_ForwardOnlyHeaders(t *testing.T) {
+	var wafHeader, nextHeader http.Header
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafHeader = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.ForwardOnlyHeaders = []string{"user-agent", "Cookie", " Content-Type "}
+	config.RedactRequestHeaders = []string{"Cookie"}
+	config.ForwardClientHeaders = true
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextHeader = r.Header
+	}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("a=1"))
+	req.Header.Set("User-Agent", "test")
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Internal-Trace", "1")
+	req.Header.Set("Authorization", "Bearer secret")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "test", wafHeader.Get("User-Agent"))
+	assert.Equal(t, "application/x-www-form-urlencoded", wafHeader.Get("Content-Type"))
+	// Listed headers are still redacted, and those the plugin adds itself are still sent
+	assert.Equal(t, "session=REDACTED", wafHeader.Get("Cookie"))
+	assert.Equal(t, "192.0.2.1", wafHeader.Get("X-Forwarded-For"))
+	assert.Empty(t, wafHeader.Values("X-Internal-Trace"))
+	assert.Empty(t, wafHeader.Values("Authorization"))
+	assert.Equal(t, "1", nextHeader.Get("X-Internal-Trace"))
+	assert.Equal(t, "Bearer secret", nextHeader.Get("Authorization"))
+}
+
+func TestMaskMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		data    string
+		expect  string
+	}{
+		{pattern: `password=([^&]*)`, data: "user=bob&password=hunter2&x=1", expect: "user=bob&password=REDACTED&x=1"},
+		{pattern: `"password":\s*"([^"]*)"`, data: `{"password": "a", "other": {"password":"b"}}`, expect: `{"password": "REDACTED", "other": {"password":"REDACTED"}}`},
+		{pattern: `\b(?:\d[ -]?){13,16}\b`, data: "card=4111 1111 1111 1111&cvv=123", expect: "card=REDACTED&cvv=123"},
+		{pattern: `secret`, data: "no match", expect: "no match"},
+		// An optional group that didn't take part in the match masks the whole match
+		{pattern: `token(=\w+)?`, data: "token", expect: "REDACTED"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, string(maskMatches(regexp.MustCompile(tt.pattern), []byte(tt.data))), tt.pattern)
+	}
+}
+
+func TestModsecurity_RedactBodyPatterns(t *testing.T) {
+	var wafBody string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wafBody = string(body)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	var nextBody string
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.RedactBodyPatterns = []string{`password=([^&]*)`}
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		nextBody = string(body)
+	}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("user=bob&password=hunter2"))
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "user=bob&password=REDACTED", wafBody)
+	assert.Equal(t, "user=bob&password=hunter2", nextBody)
+
+	config.RedactBodyPatterns = []string{`password=(`}
+	_, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
@@ -0,0 +1,270 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis an in-process server speaking just enough RESP for the plugin tests.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu      sync.Mutex
+	strings map[string]string
+	zsets   map[string]map[string]int64
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	r := &fakeRedis{
+		listener: listener,
+		password: password,
+		strings:  make(map[string]string),
+		zsets:    make(map[string]map[string]int64),
+		expires:  make(map[string]time.Time),
+	}
+	go r.serve()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			if len(args) == 2 && args[1] == r.password {
+				authenticated = true
+				io.WriteString(conn, "+OK\r\n")
+			} else {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+			}
+			continue
+		}
+		if !authenticated {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		io.WriteString(conn, r.exec(command, args[1:]))
+	}
+}
+
+func (r *fakeRedis) exec(command string, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, expires := range r.expires {
+		if !time.Now().Before(expires) {
+			delete(r.strings, key)
+			delete(r.zsets, key)
+			delete(r.expires, key)
+		}
+	}
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := r.strings[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulkString(value)
+	case "SET":
+		r.strings[args[0]] = args[1]
+		delete(r.expires, args[0])
+		if len(args) == 4 && strings.EqualFold(args[2], "PX") {
+			ms, _ := strconv.Atoi(args[3])
+			r.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "INCR":
+		n, _ := strconv.Atoi(r.strings[args[0]])
+		r.strings[args[0]] = strconv.Itoa(n + 1)
+		return ":" + strconv.Itoa(n+1) + "\r\n"
+	case "PEXPIRE":
+		_, isString := r.strings[args[0]]
+		if _, isZset := r.zsets[args[0]]; !isString && !isZset {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[1])
+		r.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "SCAN":
+		// A single page is enough for tests, MATCH patterns are assumed to end with *
+		prefix := ""
+		if len(args) >= 3 && strings.EqualFold(args[1], "MATCH") {
+			prefix = strings.TrimSuffix(args[2], "*")
+		}
+		var keys []string
+		for key := range r.strings {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, bulkString(key))
+			}
+		}
+		return "*2\r\n" + bulkString("0") + "*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")
+	case "ZADD":
+		// Scores are assumed to be integers
+		score, _ := strconv.ParseInt(args[1], 10, 64)
+		if r.zsets[args[0]] == nil {
+			r.zsets[args[0]] = make(map[string]int64)
+		}
+		_, exists := r.zsets[args[0]][args[2]]
+		r.zsets[args[0]][args[2]] = score
+		if exists {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "ZREMRANGEBYSCORE":
+		// Only -inf to an exclusive maximum is supported
+		max, _ := strconv.ParseInt(strings.TrimPrefix(args[2], "("), 10, 64)
+		removed := 0
+		for member, score := range r.zsets[args[0]] {
+			if score < max {
+				delete(r.zsets[args[0]], member)
+				removed++
+			}
+		}
+		return ":" + strconv.Itoa(removed) + "\r\n"
+	case "ZCARD":
+		return ":" + strconv.Itoa(len(r.zsets[args[0]])) + "\r\n"
+	case "ZRANGE":
+		// Only the whole set is supported, in no particular order
+		var members []string
+		for member := range r.zsets[args[0]] {
+			members = append(members, bulkString(member))
+		}
+		return "*" + strconv.Itoa(len(members)) + "\r\n" + strings.Join(members, "")
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			_, isString := r.strings[key]
+			_, isZset := r.zsets[key]
+			if isString || isZset {
+				deleted++
+			}
+			delete(r.strings, key)
+			delete(r.zsets, key)
+			delete(r.expires, key)
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+	}
+	return "-ERR unknown command '" + command + "'\r\n"
+}
+
+func bulkString(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRedisClient_Commands(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	client := newRedisClient(server.Addr(), "secret", 2, time.Second)
+
+	reply, err := client.Do("PING")
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG", reply)
+
+	reply, err = client.Do("GET", "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+
+	_, err = client.Do("SET", "key", "value with\r\nnewline")
+	assert.NoError(t, err)
+
+	reply, err = client.Do("GET", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value with\r\nnewline", reply)
+
+	reply, err = client.Do("DEL", "key", "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), reply)
+
+	_, err = client.Do("UNKNOWN")
+	assert.EqualError(t, err, "redis: ERR unknown command 'UNKNOWN'")
+
+	// The connection is still usable after an error reply
+	reply, err = client.Do("PING")
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG", reply)
+}
+
+func TestRedisClient_WrongPassword(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	client := newRedisClient(server.Addr(), "wrong", 0, time.Second)
+
+	_, err := client.Do("PING")
+	assert.Error(t, err)
+}
+
+func TestRedisClient_Unreachable(t *testing.T) {
+	server := newFakeRedis(t, "")
+	address := server.Addr()
+	server.listener.Close()
+
+	client := newRedisClient(address, "", 0, time.Second)
+	_, err := client.Do("PING")
+	assert.Error(t, err)
+}
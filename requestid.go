@@ -0,0 +1,58 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// maxRequestIDLength incoming request IDs longer than this are replaced by a generated one.
+const maxRequestIDLength = 128
+
+// assignRequestID reuses the request ID the request came with, or generates one. The ID is set on the request,
+// so that modsecurity and the backend service get it too, and on the response.
+func (a *Modsecurity) assignRequestID(rw http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(a.requestIDHeader)
+	if !isValidRequestID(id) {
+		id = newRequestID()
+		req.Header.Set(a.requestIDHeader, id)
+	}
+	rw.Header().Set(a.requestIDHeader, id)
+}
+
+// log returns the logger for messages about the request, tagged with its request ID if there is one.
+func (a *Modsecurity) log(req *http.Request) *logger {
+	if id := a.requestID(req); id != "" {
+		return a.logger.with("requestID", id)
+	}
+	return a.logger
+}
+
+// requestID returns the ID assigned to the request, empty when request IDs are disabled.
+func (a *Modsecurity) requestID(req *http.Request) string {
+	if a.requestIDHeader == "" {
+		return ""
+	}
+	return req.Header.Get(a.requestIDHeader)
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// isValidRequestID reports whether an incoming request ID can be reused as is, in headers and log lines.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
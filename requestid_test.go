@@ -0,0 +1,100 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_RequestID(t *testing.T) {
+	var modsecID string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		modsecID = r.Header.Get("X-Request-ID")
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		incoming   string
+		expectID   string
+		expectNext bool
+	}{
+		{name: "Reuses the incoming ID", path: "/website", incoming: "abc-123", expectID: "abc-123", expectNext: true},
+		{name: "Reuses the incoming ID on blocked requests", path: "/attack", incoming: "abc-123", expectID: "abc-123"},
+		{name: "Generates an ID", path: "/website", expectNext: true},
+		{name: "Replaces an invalid ID", path: "/website", incoming: "bad id\x01", expectNext: true},
+		{name: "Replaces a too long ID", path: "/website", incoming: strings.Repeat("a", maxRequestIDLength+1), expectNext: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecID = ""
+			var nextID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextID = r.Header.Get("X-Request-ID")
+			})
+
+			var logs bytes.Buffer
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.RequestIdHeader = "X-Request-ID"
+			config.LogLevel = "debug"
+
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+			middleware.(*Modsecurity).logger.out = &logs
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			id := rw.Header().Get("X-Request-ID")
+			if tt.expectID != "" {
+				assert.Equal(t, tt.expectID, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+			assert.Equal(t, id, modsecID)
+			if tt.expectNext {
+				assert.Equal(t, id, nextID)
+			} else {
+				assert.Contains(t, logs.String(), "requestID="+id)
+			}
+		})
+	}
+}
+
+func TestModsecurity_RequestIDDisabled(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("X-Request-ID"))
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Empty(t, rw.Header().Get("X-Request-ID"))
+}
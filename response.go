@@ -0,0 +1,210 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// Headers describing the backend response to modsecurity when it is submitted for inspection.
+const (
+	modsecurityPhaseHeader = "X-Modsecurity-Phase"
+	responseStatusHeader   = "X-Response-Status"
+	responseHeaderPrefix   = "X-Response-"
+)
+
+// responseBuffer an http.ResponseWriter holding the backend response back until modsecurity inspected it.
+// Responses bigger than limit, and streamed responses that get flushed, are passed through uninspected.
+type responseBuffer struct {
+	rw          http.ResponseWriter
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	limit       int64
+	passthrough bool
+}
+
+func newResponseBuffer(rw http.ResponseWriter, limit int64) *responseBuffer {
+	return &responseBuffer{rw: rw, header: make(http.Header), limit: limit}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	if b.passthrough {
+		return b.rw.Header()
+	}
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.passthrough {
+		b.rw.WriteHeader(status)
+		return
+	}
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.passthrough {
+		return b.rw.Write(p)
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	if int64(b.body.Len()+len(p)) > b.limit {
+		b.passThrough()
+		return b.rw.Write(p)
+	}
+	return b.body.Write(p)
+}
+
+// Flush gives up on inspecting the response, a streamed response can't be held back.
+func (b *responseBuffer) Flush() {
+	b.passThrough()
+	if flusher, ok := b.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// passThrough writes what was held back to the client, and everything written afterward goes straight to it.
+func (b *responseBuffer) passThrough() {
+	if b.passthrough {
+		return
+	}
+	b.passthrough = true
+
+	for k, vv := range b.header {
+		b.rw.Header()[k] = vv
+	}
+	if b.status != 0 {
+		b.rw.WriteHeader(b.status)
+	}
+	b.rw.Write(b.body.Bytes())
+}
+
+// statusRecorder an http.ResponseWriter remembering the final status of the response written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveBackend passes the request to the next handler. The failed authentications of the requests to
+// jailLoginPaths, answered with one of jailOnLoginStatusCodes, count toward jailing the client.
+func (a *Modsecurity) serveBackend(rw http.ResponseWriter, req *http.Request, clientIP string) {
+	if a.jail == nil || !a.isLoginPath(req.URL.Path) || isWebsocket(req) {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: rw}
+	a.next.ServeHTTP(recorder, req)
+	if !a.jailOnLoginStatusCodes[recorder.status] {
+		return
+	}
+	a.log(req).Info("failed authentication", "status", recorder.status, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+	a.recordOffense(req, clientIP, &verdict{StatusCode: recorder.status})
+}
+
+func (a *Modsecurity) isLoginPath(path string) bool {
+	for _, re := range a.jailLoginPaths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveNext passes an allowed request to the next handler, holding the response back for modsecurity
+// to inspect it when response inspection is enabled.
+func (a *Modsecurity) serveNext(rw http.ResponseWriter, req *http.Request, clientIP string) {
+	// An upgraded connection is hijacked from the response writer, there is no response to hold back
+	if !a.inspectResponses || isWebsocket(req) {
+		a.serveBackend(rw, req, clientIP)
+		return
+	}
+
+	buffer := newResponseBuffer(rw, a.maxResponseBodySize)
+	a.serveBackend(buffer, req, clientIP)
+	if buffer.passthrough {
+		a.log(req).Debug("response too large or streamed, not inspected", "uri", req.RequestURI, "clientIP", clientIP)
+		return
+	}
+
+	v, err := a.inspectResponse(req, buffer)
+	if err != nil {
+		a.metrics.incModsecErrors()
+		if a.failOpen {
+			a.log(req).Warn("modsec unavailable to inspect response, failing open", "error", err)
+			buffer.passThrough()
+			return
+		}
+		a.log(req).Error("modsec unavailable to inspect response", "error", err)
+		http.Error(rw, "", http.StatusBadGateway)
+		return
+	}
+
+	if !a.isBlocked(v) {
+		buffer.passThrough()
+		return
+	}
+	if a.detectionOnly {
+		a.log(req).Info("detection only, not blocking response", "status", v.StatusCode, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+		buffer.passThrough()
+		return
+	}
+	a.log(req).Info("response blocked by modsec", "status", v.StatusCode, "method", req.Method, "uri", req.RequestURI, "clientIP", clientIP)
+	a.metrics.incBlocked()
+	a.notify(eventBlocked, req, clientIP, v)
+	a.writeBlockResponse(rw, v)
+}
+
+// inspectResponse submits the backend response to the responseInspectionUrl modsecurity: the original request
+// line and headers, plus the response status and headers in X-Response-* headers, with the response body as body.
+// The body is described by the response Content-Type and Content-Encoding, not by the request ones.
+func (a *Modsecurity) inspectResponse(req *http.Request, buffer *responseBuffer) (*verdict, error) {
+	if a.breaker != nil && !a.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	inspectReq := req.Clone(req.Context())
+	inspectReq.ContentLength = int64(buffer.body.Len())
+	for _, k := range []string{"Content-Type", "Content-Encoding"} {
+		inspectReq.Header.Del(k)
+		if v := buffer.header.Get(k); v != "" {
+			inspectReq.Header.Set(k, v)
+		}
+	}
+	inspectReq.Header.Set(modsecurityPhaseHeader, "response")
+	inspectReq.Header.Set(responseStatusHeader, strconv.Itoa(buffer.status))
+	for k, vv := range buffer.header {
+		for _, v := range vv {
+			inspectReq.Header.Add(responseHeaderPrefix+k, v)
+		}
+	}
+
+	body := newSizedBodyBuffer(bytes.NewReader(buffer.body.Bytes()), 0, int64(buffer.body.Len()))
+	defer body.release()
+
+	return a.limitedCheck(inspectReq, body, a.responseInspector.check)
+}
@@ -0,0 +1,150 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_InspectResponses(t *testing.T) {
+	var inspected http.Header
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(modsecurityPhaseHeader) != "response" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		inspected = r.Header.Clone()
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "password") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name          string
+		body          string
+		detectionOnly bool
+		maxBodySize   int64
+		expectStatus  int
+		expectBody    string
+		inspected     bool
+	}{
+		{name: "clean response", body: "hello", expectStatus: http.StatusCreated, expectBody: "hello", inspected: true},
+		{name: "leaking response", body: "password=hunter2", expectStatus: http.StatusForbidden, expectBody: "", inspected: true},
+		{name: "leaking response, detection only", body: "password=hunter2", detectionOnly: true, expectStatus: http.StatusCreated, expectBody: "password=hunter2", inspected: true},
+		{name: "too large to inspect", body: "password=hunter2", maxBodySize: 4, expectStatus: http.StatusCreated, expectBody: "password=hunter2", inspected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inspected = nil
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.InspectResponses = true
+			config.ResponseInspectionUrl = modsecurityMockServer.URL
+			config.DetectionOnly = tt.detectionOnly
+			if tt.maxBodySize > 0 {
+				config.MaxResponseBodySize = tt.maxBodySize
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Backend", "app")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(tt.body))
+			})
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/profile", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectBody, rw.Body.String())
+			if tt.inspected {
+				assert.Equal(t, "201", inspected.Get(responseStatusHeader))
+				assert.Equal(t, "app", inspected.Get(responseHeaderPrefix+"X-Backend"))
+			} else {
+				assert.Nil(t, inspected)
+			}
+			if tt.expectStatus != http.StatusForbidden {
+				assert.Equal(t, "app", rw.Header().Get("X-Backend"))
+			}
+		})
+	}
+}
+
+func TestModsecurity_InspectResponsesSeparateWaf(t *testing.T) {
+	// The request WAF blocks a GET with a body, like CRS rule 920170 does
+	var requestCalls int
+	requestWaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCalls++
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodGet && len(body) > 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer requestWaf.Close()
+
+	var inspected http.Header
+	responseWaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inspected = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer responseWaf.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = requestWaf.URL
+	config.InspectResponses = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><script>alert(1)</script></html>"))
+	})
+	_, err := New(context.Background(), next, config, "modsecurity-middleware")
+	assert.EqualError(t, err, "responseInspectionUrl must be set when inspectResponses is set")
+
+	config.ResponseInspectionUrl = responseWaf.URL
+	middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "<html><script>alert(1)</script></html>", rw.Body.String())
+	assert.Equal(t, 1, requestCalls)
+	assert.Equal(t, "text/html", inspected.Get("Content-Type"))
+}
+
+func TestResponseBuffer_FlushPassesThrough(t *testing.T) {
+	rw := httptest.NewRecorder()
+	buffer := newResponseBuffer(rw, 1024)
+
+	buffer.Header().Set("Content-Type", "text/event-stream")
+	buffer.Write([]byte("data: 1\n"))
+	assert.Empty(t, rw.Body.String())
+
+	buffer.Flush()
+	buffer.Write([]byte("data: 2\n"))
+
+	assert.True(t, buffer.passthrough)
+	assert.True(t, rw.Flushed)
+	assert.Equal(t, "text/event-stream", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "data: 1\ndata: 2\n", rw.Body.String())
+}
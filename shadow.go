@@ -0,0 +1,43 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+)
+
+// shadowMaxInFlight shadow calls running at once, requests arriving while that many are in flight are not shadowed.
+const shadowMaxInFlight = 64
+
+// compareWithShadow sends the request to the shadow modsecurity in the background and logs when its verdict differs
+// from v, the verdict acted on. The request is never held up by the shadow call, nor affected by its verdict.
+func (a *Modsecurity) compareWithShadow(req *http.Request, body *bodyBuffer, v *verdict, clientIP string) {
+	select {
+	case a.shadowSlots <- struct{}{}:
+	default:
+		a.log(req).Debug("too many shadow modsec calls in flight, not shadowing", "uri", req.RequestURI, "clientIP", clientIP)
+		return
+	}
+
+	// The request is done with as soon as it is served, the shadow call works on a copy outliving it
+	shadowReq := req.Clone(context.Background())
+	if body != nil {
+		body.retain()
+	}
+
+	go func() {
+		defer func() { <-a.shadowSlots }()
+		if body != nil {
+			defer body.release()
+		}
+
+		sv, err := a.shadow.check(shadowReq, body)
+		if err != nil {
+			a.log(shadowReq).Warn("shadow modsec unavailable", "uri", shadowReq.RequestURI, "error", err)
+			return
+		}
+		if a.isBlocked(sv) != a.isBlocked(v) {
+			a.log(shadowReq).Info("shadow modsec verdict differs", "status", v.StatusCode, "shadowStatus", sv.StatusCode, "method", shadowReq.Method, "uri", shadowReq.RequestURI, "clientIP", clientIP)
+			a.metrics.incShadowMismatches()
+		}
+	}()
+}
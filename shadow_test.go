@@ -0,0 +1,79 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_Shadow(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer modsecurityMockServer.Close()
+
+	shadowBodies := make(chan string, 1)
+	shadowMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- string(body)
+		if strings.Contains(string(body), "attack") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer shadowMockServer.Close()
+
+	var logs bytes.Buffer
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.ShadowModSecurityUrl = shadowMockServer.URL
+
+	var nextBodies []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		nextBodies = append(nextBodies, string(body))
+	})
+	middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	a := middleware.(*Modsecurity)
+	a.logger.out = &logs
+
+	for _, body := range []string{"a=1", "a=attack"} {
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, body, <-shadowBodies)
+	}
+	assert.Equal(t, []string{"a=1", "a=attack"}, nextBodies)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&a.metrics.shadowMismatch) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), "INFO shadow modsec verdict differs status=200 shadowStatus=403 method=POST uri=/form")
+}
+
+func TestModsecurity_ShadowUnavailable(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.ShadowModSecurityUrl = "http://127.0.0.1:1"
+
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// The shadow never affects the verdict acted on
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
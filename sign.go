@@ -0,0 +1,41 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// signWafRequest adds wafSignatureHeader to a request to modsecurity, so that it can tell the requests of the
+// plugin from spoofed direct calls: t=<unix time>,body=<SHA-256 of the body>,sig=<HMAC-SHA256 with
+// wafSigningSecret of the time, method, path and query, and body hash, separated by newlines>, all hex encoded.
+// The body is read once more, from its start, to be hashed.
+func (a *Modsecurity) signWafRequest(req *http.Request) error {
+	if a.wafSigningSecret == nil {
+		return nil
+	}
+
+	hash := sha256.New()
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(hash, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := hex.EncodeToString(hash.Sum(nil))
+	mac := hmac.New(sha256.New, a.wafSigningSecret)
+	mac.Write([]byte(timestamp + "\n" + req.Method + "\n" + req.URL.RequestURI() + "\n" + bodyHash))
+	req.Header.Set(a.wafSignatureHeader, "t="+timestamp+",body="+bodyHash+",sig="+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
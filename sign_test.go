@@ -0,0 +1,86 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyWafSignature checks a signature the way a modsecurity sidecar would.
+func verifyWafSignature(r *http.Request, header, secret string) bool {
+	var timestamp, bodyHash, sig string
+	for _, part := range strings.Split(r.Header.Get(header), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "body":
+			bodyHash = value
+		case "sig":
+			sig = value
+		}
+	}
+	if t, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(t, 0)) > time.Minute {
+		return false
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	hash := sha256.Sum256(body)
+	if hex.EncodeToString(hash[:]) != bodyHash {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + r.Method + "\n" + r.URL.RequestURI() + "\n" + bodyHash))
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(sig))
+}
+
+func TestModsecurity_WafSigningSecret(t *testing.T) {
+	var verified []bool
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = append(verified, verifyWafSignature(r, "X-Signature", "secret"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL + "/waf-check/"
+	config.WafSigningSecret = "secret"
+	config.WafSignatureHeader = "X-Signature"
+
+	var upstreamBody string
+	middleware, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		assert.Empty(t, r.Header.Get("X-Signature"))
+	}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// The body is hashed without being consumed
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/login?next=%2Fhome", strings.NewReader("user=admin")))
+	assert.Equal(t, "user=admin", upstreamBody)
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, []bool{true, true}, verified)
+
+	// A spoofed direct call, or one signed with another secret, fails verification
+	req := httptest.NewRequest(http.MethodGet, "/website", nil)
+	assert.False(t, verifyWafSignature(req, "X-Signature", "secret"))
+	config.WafSigningSecret = "other"
+	middleware, err = New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, []bool{true, true, false}, verified)
+}
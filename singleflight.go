@@ -0,0 +1,63 @@
+package traefik_modsecurity_plugin
+
+import "sync"
+
+// flightGroup coalesces concurrent modsecurity calls for the same cache key into a single call,
+// whose verdict is handed to every caller.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight a call in progress, or completed, for a cache key.
+type flight struct {
+	wg  sync.WaitGroup
+	v   *verdict
+	err error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do calls fn for key, unless a call for key is already in flight, in which case it waits for that call
+// and returns its outcome. shared reports whether the outcome came from another caller's call.
+func (g *flightGroup) do(key string, fn func() (*verdict, error)) (v *verdict, err error, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.v, f.err, true
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	g.run(key, f, fn)
+	return f.v, f.err, false
+}
+
+// goDo calls fn for key in the background, unless a call for key is already in flight. Callers of do for key
+// wait for that call meanwhile.
+func (g *flightGroup) goDo(key string, fn func() (*verdict, error)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.flights[key]; ok {
+		return
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	go g.run(key, f, fn)
+}
+
+func (g *flightGroup) run(key string, f *flight, fn func() (*verdict, error)) {
+	f.v, f.err = fn()
+	f.wg.Done()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	var calls int32
+
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, shared := g.do("key", func() (*verdict, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return &verdict{StatusCode: http.StatusForbidden}, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusForbidden, v.StatusCode)
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, int32(4), sharedCount)
+	assert.Empty(t, g.flights)
+}
+
+func TestFlightGroup_GoDo(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	var calls int32
+
+	for i := 0; i < 3; i++ {
+		g.goDo("key", func() (*verdict, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return &verdict{StatusCode: http.StatusOK}, nil
+		})
+	}
+
+	// Callers of do wait for the background call
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	v, err, shared := g.do("key", func() (*verdict, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, shared)
+	assert.Equal(t, http.StatusOK, v.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestModsecurity_CoalescesIdenticalRequests(t *testing.T) {
+	var wafCalls int32
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&wafCalls, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CacheEnabled = true
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/popular", nil))
+			assert.Equal(t, http.StatusOK, rw.Code)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&wafCalls))
+}
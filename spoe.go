@@ -0,0 +1,593 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const spoeScheme = "spoe://"
+
+// spoeMessage the message the Coraza SPOA agent inspects requests from.
+const spoeMessage = "coraza-req"
+
+// spoeMaxFrameSize the frame size proposed to agents, the HAProxy default. Agents may only lower it.
+const spoeMaxFrameSize = 16380
+
+// spoeMaxFrameOverhead the most bytes a frame takes besides its payload: type, flags, stream and frame IDs.
+const spoeMaxFrameOverhead = 1 + 4 + 10 + 10
+
+// SPOP frame types and flags.
+const (
+	spoeFrameHaproxyHello      = 1
+	spoeFrameHaproxyDisconnect = 2
+	spoeFrameNotify            = 3
+	spoeFrameAgentHello        = 101
+	spoeFrameAgentDisconnect   = 102
+	spoeFrameAck               = 103
+
+	spoeFlagFin = 1
+)
+
+// SPOP data types, the flag of a true boolean is stored along with the type.
+const (
+	spoeTypeNull   = 0
+	spoeTypeBool   = 1
+	spoeTypeInt32  = 2
+	spoeTypeUint32 = 3
+	spoeTypeInt64  = 4
+	spoeTypeUint64 = 5
+	spoeTypeIPv4   = 6
+	spoeTypeIPv6   = 7
+	spoeTypeString = 8
+	spoeTypeBinary = 9
+
+	spoeFlagTrue = 0x10
+)
+
+// SPOP actions an agent replies with.
+const (
+	spoeActionSetVar   = 1
+	spoeActionUnsetVar = 2
+)
+
+// spoeArg a named argument of a message. Values are strings, []byte, int64, net.IP, or nil.
+type spoeArg struct {
+	name  string
+	value interface{}
+}
+
+// spoeClient a minimal SPOP client, the protocol HAProxy talks to its stream processing offload agents such as
+// Coraza SPOA. Every connection carries one message at a time, without pipelining nor fragmentation.
+type spoeClient struct {
+	address     string
+	dialTimeout time.Duration
+	maxIdle     int
+	streamID    uint64
+	// resolver resolves the agent address, the system resolver when nil
+	resolver *net.Resolver
+
+	mu   sync.Mutex
+	idle []*spoeConn
+}
+
+type spoeConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	maxFrameSize int
+}
+
+func newSpoeClient(address string, dialTimeout time.Duration, maxIdle int) *spoeClient {
+	return &spoeClient{address: address, dialTimeout: dialTimeout, maxIdle: maxIdle}
+}
+
+// notify sends a message to the agent and returns the variables it set in its reply, by name. The last argument,
+// when it is binary, is truncated to fit the frame size.
+func (c *spoeClient) notify(ctx context.Context, message string, args []spoeArg) (map[string]interface{}, error) {
+	sc, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := sc.notify(ctx, atomic.AddUint64(&c.streamID, 1), message, args)
+	if err != nil {
+		// The connection is in an unknown state
+		sc.conn.Close()
+		return nil, err
+	}
+	c.put(sc)
+	return vars, nil
+}
+
+func (c *spoeClient) get(ctx context.Context) (*spoeConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		sc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return sc, nil
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+// dial opens a new connection to the agent and says hello.
+func (c *spoeClient) dial(ctx context.Context) (*spoeConn, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout, Resolver: c.resolver}
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	sc := &spoeConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := sc.hello(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (c *spoeClient) put(sc *spoeConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle) >= c.maxIdle {
+		sc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, sc)
+}
+
+// closeIdle closes the idle connections, so that the next messages connect to the agent again.
+func (c *spoeClient) closeIdle() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	for _, sc := range idle {
+		sc.conn.Close()
+	}
+}
+
+// warm opens connections until n of them, at most maxIdle, are idle.
+func (c *spoeClient) warm(ctx context.Context, n int) error {
+	c.mu.Lock()
+	missing := n - len(c.idle)
+	if free := c.maxIdle - len(c.idle); missing > free {
+		missing = free
+	}
+	c.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		sc, err := c.dial(ctx)
+		if err != nil {
+			return err
+		}
+		c.put(sc)
+	}
+	return nil
+}
+
+// hello negotiates the protocol version and the frame size with the agent.
+func (sc *spoeConn) hello(ctx context.Context) error {
+	if err := sc.setDeadline(ctx); err != nil {
+		return err
+	}
+
+	payload := appendSpoeKV(nil, "supported-versions", "2.0")
+	payload = appendSpoeKV(payload, "max-frame-size", int64(spoeMaxFrameSize))
+	payload = appendSpoeKV(payload, "capabilities", "")
+	if err := sc.writeFrame(spoeFrameHaproxyHello, 0, 0, payload); err != nil {
+		return err
+	}
+
+	frameType, _, payload, err := sc.readFrame()
+	if err != nil {
+		return err
+	}
+	if frameType != spoeFrameAgentHello {
+		return unexpectedSpoeFrame(frameType, payload)
+	}
+	kv, err := decodeSpoeKVList(payload)
+	if err != nil {
+		return err
+	}
+	if version, _ := kv["version"].(string); !strings.HasPrefix(version, "2.") {
+		return fmt.Errorf("spoe: unsupported agent version %q", version)
+	}
+	sc.maxFrameSize = spoeMaxFrameSize
+	if size, ok := kv["max-frame-size"].(int64); ok && size > 0 && size < spoeMaxFrameSize {
+		sc.maxFrameSize = int(size)
+	}
+	return nil
+}
+
+func (sc *spoeConn) notify(ctx context.Context, streamID uint64, message string, args []spoeArg) (map[string]interface{}, error) {
+	if err := sc.setDeadline(ctx); err != nil {
+		return nil, err
+	}
+
+	payload := appendSpoeString(nil, message)
+	payload = append(payload, byte(len(args)))
+	for i, arg := range args {
+		if data, ok := arg.value.([]byte); ok && i == len(args)-1 {
+			// Room left once the frame header, the name, the type and the length are accounted for
+			room := sc.maxFrameSize - spoeMaxFrameOverhead - len(appendSpoeString(payload, arg.name)) - 1 - 10
+			if room < 0 {
+				room = 0
+			}
+			if len(data) > room {
+				arg.value = data[:room]
+			}
+		}
+		payload = appendSpoeKV(payload, arg.name, arg.value)
+	}
+	if err := sc.writeFrame(spoeFrameNotify, streamID, 0, payload); err != nil {
+		return nil, err
+	}
+
+	frameType, ackStream, payload, err := sc.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frameType != spoeFrameAck {
+		return nil, unexpectedSpoeFrame(frameType, payload)
+	}
+	if ackStream != streamID {
+		return nil, fmt.Errorf("spoe: ack for stream %d, expected %d", ackStream, streamID)
+	}
+	return decodeSpoeActions(payload)
+}
+
+func (sc *spoeConn) setDeadline(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	return sc.conn.SetDeadline(deadline)
+}
+
+func (sc *spoeConn) writeFrame(frameType byte, streamID, frameID uint64, payload []byte) error {
+	frame := make([]byte, 4, 4+spoeMaxFrameOverhead+len(payload))
+	frame = append(frame, frameType)
+	frame = binary.BigEndian.AppendUint32(frame, spoeFlagFin)
+	frame = appendSpoeVarint(frame, streamID)
+	frame = appendSpoeVarint(frame, frameID)
+	frame = append(frame, payload...)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	_, err := sc.conn.Write(frame)
+	return err
+}
+
+// readFrame reads a frame and returns its type, stream ID and payload.
+func (sc *spoeConn) readFrame() (byte, uint64, []byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(sc.reader, size[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 5 || n > uint32(spoeMaxFrameSize) {
+		return 0, 0, nil, fmt.Errorf("spoe: invalid frame size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(sc.reader, frame); err != nil {
+		return 0, 0, nil, err
+	}
+
+	frameType, flags := frame[0], binary.BigEndian.Uint32(frame[1:5])
+	if flags&spoeFlagFin == 0 {
+		return 0, 0, nil, errors.New("spoe: fragmented frames are not supported")
+	}
+	streamID, rest, err := readSpoeVarint(frame[5:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	// The frame ID, only meaningful with pipelining
+	if _, rest, err = readSpoeVarint(rest); err != nil {
+		return 0, 0, nil, err
+	}
+	return frameType, streamID, rest, nil
+}
+
+// unexpectedSpoeFrame the error of a frame that is not the expected reply, the reason of a disconnection if it is one.
+func unexpectedSpoeFrame(frameType byte, payload []byte) error {
+	if frameType == spoeFrameAgentDisconnect {
+		kv, _ := decodeSpoeKVList(payload)
+		return fmt.Errorf("spoe: agent disconnected with status %v: %v", kv["status-code"], kv["message"])
+	}
+	return fmt.Errorf("spoe: unexpected frame type %d", frameType)
+}
+
+// appendSpoeVarint appends i in the variable-length encoding of SPOP.
+func appendSpoeVarint(b []byte, i uint64) []byte {
+	if i < 240 {
+		return append(b, byte(i))
+	}
+	b = append(b, byte(i)|240)
+	i = (i - 240) >> 4
+	for i >= 128 {
+		b = append(b, byte(i)|128)
+		i = (i - 128) >> 7
+	}
+	return append(b, byte(i))
+}
+
+func readSpoeVarint(b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	i, b := uint64(b[0]), b[1:]
+	if i < 240 {
+		return i, b, nil
+	}
+	for shift := uint(4); ; shift += 7 {
+		if len(b) == 0 || shift > 63 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		c := uint64(b[0])
+		b = b[1:]
+		i += c << shift
+		if c < 128 {
+			return i, b, nil
+		}
+	}
+}
+
+func appendSpoeString(b []byte, s string) []byte {
+	return append(appendSpoeVarint(b, uint64(len(s))), s...)
+}
+
+func readSpoeString(b []byte) (string, []byte, error) {
+	n, b, err := readSpoeVarint(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(b)) < n {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+// appendSpoeKV appends a named typed value.
+func appendSpoeKV(b []byte, name string, value interface{}) []byte {
+	b = appendSpoeString(b, name)
+	switch v := value.(type) {
+	case string:
+		return appendSpoeString(append(b, spoeTypeString), v)
+	case []byte:
+		return append(appendSpoeVarint(append(b, spoeTypeBinary), uint64(len(v))), v...)
+	case int64:
+		return appendSpoeVarint(append(b, spoeTypeInt64), uint64(v))
+	case net.IP:
+		if ip4 := v.To4(); ip4 != nil {
+			return append(append(b, spoeTypeIPv4), ip4...)
+		}
+		if ip16 := v.To16(); ip16 != nil {
+			return append(append(b, spoeTypeIPv6), ip16...)
+		}
+	}
+	return append(b, spoeTypeNull)
+}
+
+// readSpoeValue reads a typed value: a bool, an int64, a net.IP, a string, a []byte, or nil.
+func readSpoeValue(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	kind, b := b[0], b[1:]
+	switch kind & 0x0f {
+	case spoeTypeNull:
+		return nil, b, nil
+	case spoeTypeBool:
+		return kind&spoeFlagTrue != 0, b, nil
+	case spoeTypeInt32, spoeTypeUint32, spoeTypeInt64, spoeTypeUint64:
+		i, b, err := readSpoeVarint(b)
+		return int64(i), b, err
+	case spoeTypeIPv4, spoeTypeIPv6:
+		n := net.IPv4len
+		if kind&0x0f == spoeTypeIPv6 {
+			n = net.IPv6len
+		}
+		if len(b) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return net.IP(append([]byte(nil), b[:n]...)), b[n:], nil
+	case spoeTypeString:
+		return readSpoeString(b)
+	case spoeTypeBinary:
+		s, b, err := readSpoeString(b)
+		return []byte(s), b, err
+	}
+	return nil, nil, fmt.Errorf("spoe: unknown data type %d", kind&0x0f)
+}
+
+func decodeSpoeKVList(b []byte) (map[string]interface{}, error) {
+	kv := make(map[string]interface{})
+	for len(b) > 0 {
+		name, rest, err := readSpoeString(b)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := readSpoeValue(rest)
+		if err != nil {
+			return nil, err
+		}
+		kv[name] = value
+		b = rest
+	}
+	return kv, nil
+}
+
+// decodeSpoeActions returns the variables set by the actions of an ACK, whatever their scope.
+func decodeSpoeActions(b []byte) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		action := b[0]
+		// The number of arguments and the scope of the variable
+		name, rest, err := readSpoeString(b[3:])
+		if err != nil {
+			return nil, err
+		}
+		switch action {
+		case spoeActionSetVar:
+			var value interface{}
+			if value, rest, err = readSpoeValue(rest); err != nil {
+				return nil, err
+			}
+			vars[name] = value
+		case spoeActionUnsetVar:
+			delete(vars, name)
+		default:
+			return nil, fmt.Errorf("spoe: unknown action %d", action)
+		}
+		b = rest
+	}
+	return vars, nil
+}
+
+// spoeBackend asks a Coraza SPOA agent for verdicts. The agent gets the request line, the headers and as much of
+// the body as fits in a frame. A request is blocked when the agent sets the action variable, with the status it
+// sets, 403 by default.
+type spoeBackend struct {
+	m           *Modsecurity
+	client      *spoeClient
+	application string
+}
+
+func (s *spoeBackend) check(req *http.Request, body *bodyBuffer) (*verdict, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), s.m.callTimeout(req, body))
+	defer cancel()
+
+	var data []byte
+	if body != nil && s.m.rewritesBody(req) {
+		var err error
+		if data, err = s.m.rewriteBody(req, body); err != nil {
+			return nil, err
+		}
+		if len(data) > spoeMaxFrameSize {
+			data = data[:spoeMaxFrameSize]
+		}
+	} else if body != nil {
+		r := body.NewReader()
+		defer r.Close()
+
+		// Unless only the start of bodies is inspected, the rest of the body is read all the same, so that a body
+		// over maxBodySize is noticed
+		var err error
+		if s.m.inspectBodyBytes > 0 && s.m.inspectBodyBytes < spoeMaxFrameSize {
+			data, err = io.ReadAll(io.LimitReader(r, s.m.inspectBodyBytes))
+		} else if data, err = io.ReadAll(io.LimitReader(r, spoeMaxFrameSize)); err == nil && s.m.inspectBodyBytes <= 0 {
+			_, err = io.Copy(io.Discard, r)
+		}
+		if err != nil {
+			return nil, &requestBodyError{err: err}
+		}
+	}
+
+	id := s.m.requestID(req)
+	if id == "" {
+		id = newRequestID()
+	}
+	srcIP, srcPort := spoeAddr(req.RemoteAddr)
+	dstIP, dstPort := net.IP(nil), int64(0)
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dstIP, dstPort = spoeAddr(addr.String())
+	}
+	if ip := net.ParseIP(s.m.clientIP(req)); ip != nil {
+		srcIP = ip
+	}
+
+	// The agent gets the headers an HTTP modsecurity would
+	header := req.Header.Clone()
+	removeHopHeaders(header)
+	s.m.keepForwardOnlyHeaders(header)
+	if isWebsocket(req) {
+		header["Upgrade"] = req.Header["Upgrade"]
+	}
+	s.m.redact(header)
+	if body != nil && s.m.decompresses(req) {
+		header.Del("Content-Encoding")
+	}
+	for k, v := range s.m.wafExtraHeaders {
+		header.Set(k, v)
+	}
+	if s.m.wafModeHeader != "" {
+		header.Set(s.m.wafModeHeader, s.m.wafModeValue)
+	}
+
+	args := []spoeArg{
+		{name: "app", value: s.application},
+		{name: "id", value: id},
+		{name: "src-ip", value: srcIP},
+		{name: "src-port", value: srcPort},
+		{name: "dst-ip", value: dstIP},
+		{name: "dst-port", value: dstPort},
+		{name: "method", value: req.Method},
+		{name: "path", value: req.URL.EscapedPath()},
+		{name: "query", value: req.URL.RawQuery},
+		{name: "version", value: fmt.Sprintf("%d.%d", req.ProtoMajor, req.ProtoMinor)},
+		{name: "headers", value: spoeHeaders(req.Host, header)},
+		{name: "body", value: data},
+	}
+
+	s.m.metrics.incModsecRequests()
+	start := time.Now()
+	vars, err := s.client.notify(ctx, spoeMessage, args)
+	s.m.metrics.observeLatency(time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("fail to send message to spoe agent: %w", err)
+	}
+
+	if action, _ := vars["action"].(string); action == "" {
+		return &verdict{StatusCode: http.StatusOK}, nil
+	}
+	status, _ := vars["status"].(int64)
+	if status < 400 || status > 599 {
+		status = http.StatusForbidden
+	}
+	return &verdict{StatusCode: int(status)}, nil
+}
+
+// spoeAddr splits a host:port address into an IP and a port, nil and 0 when it isn't one.
+func spoeAddr(addr string) (net.IP, int64) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.ParseInt(port, 10, 64)
+	return net.ParseIP(host), p
+}
+
+// spoeHeaders returns the request headers as a raw HTTP header block, what HAProxy sends as req.hdrs.
+func spoeHeaders(host string, header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Host: " + host + "\r\n")
+	for _, name := range names {
+		for _, value := range header[name] {
+			b.WriteString(name + ": " + value + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
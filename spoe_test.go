@@ -0,0 +1,253 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoeVarint(t *testing.T) {
+	tests := []struct {
+		value  uint64
+		expect []byte
+	}{
+		{value: 0, expect: []byte{0x00}},
+		{value: 239, expect: []byte{0xef}},
+		{value: 240, expect: []byte{0xf0, 0x00}},
+		{value: 2287, expect: []byte{0xff, 0x7f}},
+		{value: 2288, expect: []byte{0xf0, 0x80, 0x00}},
+		{value: 16380, expect: []byte{0xfc, 0xf0, 0x06}},
+	}
+
+	for _, tt := range tests {
+		encoded := appendSpoeVarint(nil, tt.value)
+		assert.Equal(t, tt.expect, encoded, "value %d", tt.value)
+
+		decoded, rest, err := readSpoeVarint(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.value, decoded)
+		assert.Empty(t, rest)
+	}
+
+	_, _, err := readSpoeVarint([]byte{0xf0})
+	assert.Error(t, err)
+}
+
+func TestSpoeKVList(t *testing.T) {
+	b := appendSpoeKV(nil, "method", "GET")
+	b = appendSpoeKV(b, "body", []byte("a=1"))
+	b = appendSpoeKV(b, "src-port", int64(51234))
+	b = appendSpoeKV(b, "src-ip", net.ParseIP("192.0.2.1"))
+	b = appendSpoeKV(b, "dst-ip", net.ParseIP("2001:db8::1"))
+	b = appendSpoeKV(b, "unknown", net.IP(nil))
+
+	kv, err := decodeSpoeKVList(b)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"method":   "GET",
+		"body":     []byte("a=1"),
+		"src-port": int64(51234),
+		"src-ip":   net.IP(net.ParseIP("192.0.2.1").To4()),
+		"dst-ip":   net.ParseIP("2001:db8::1"),
+		"unknown":  nil,
+	}, kv)
+}
+
+// spoeAgentMock a SPOP agent blocking requests to /attack, it records the arguments of the last message.
+type spoeAgentMock struct {
+	listener net.Listener
+	args     chan map[string]interface{}
+}
+
+func newSpoeAgentMock(t *testing.T, maxFrameSize int64) *spoeAgentMock {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	m := &spoeAgentMock{listener: listener, args: make(chan map[string]interface{}, 16)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn, maxFrameSize)
+		}
+	}()
+	return m
+}
+
+func (m *spoeAgentMock) serve(conn net.Conn, maxFrameSize int64) {
+	defer conn.Close()
+	sc := &spoeConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	for {
+		frameType, streamID, payload, err := sc.readFrame()
+		if err != nil {
+			return
+		}
+		switch frameType {
+		case spoeFrameHaproxyHello:
+			hello := appendSpoeKV(nil, "version", "2.0")
+			hello = appendSpoeKV(hello, "max-frame-size", maxFrameSize)
+			hello = appendSpoeKV(hello, "capabilities", "")
+			sc.writeFrame(spoeFrameAgentHello, 0, 0, hello)
+		case spoeFrameNotify:
+			message, rest, _ := readSpoeString(payload)
+			if message != spoeMessage {
+				return
+			}
+			args, _ := decodeSpoeKVList(rest[1:])
+			m.args <- args
+
+			var ack []byte
+			if args["path"] == "/attack" {
+				ack = append(ack, spoeActionSetVar, 3, 2)
+				ack = appendSpoeKV(ack, "action", "deny")
+				ack = append(ack, spoeActionSetVar, 3, 2)
+				ack = appendSpoeKV(ack, "status", int64(http.StatusNotAcceptable))
+			}
+			sc.writeFrame(spoeFrameAck, streamID, 0, ack)
+		}
+	}
+}
+
+func TestModsecurity_Spoe(t *testing.T) {
+	agent := newSpoeAgentMock(t, 1024)
+	defer agent.listener.Close()
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		expectStatus int
+		expectBody   int
+	}{
+		{name: "Allows a request", method: http.MethodGet, path: "/website?q=1", expectStatus: http.StatusOK},
+		{name: "Blocks with the agent status", method: http.MethodGet, path: "/attack", expectStatus: http.StatusNotAcceptable},
+		{name: "Sends the body", method: http.MethodPost, path: "/form", body: "a=1", expectStatus: http.StatusOK, expectBody: 3},
+		{name: "Truncates the body to the frame size", method: http.MethodPost, path: "/form", body: strings.Repeat("a", 4096), expectStatus: http.StatusOK, expectBody: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nextBody []byte
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextBody, _ = io.ReadAll(r.Body)
+			})
+
+			config := CreateConfig()
+			config.ModSecurityUrl = spoeScheme + agent.listener.Addr().String()
+			config.SpoeApplication = "sample_app"
+			config.RedactRequestHeaders = []string{"Authorization"}
+			config.ForwardOnlyHeaders = []string{"User-Agent", "Authorization", "Keep-Alive"}
+			config.WafExtraHeaders = map[string]string{"X-Tenant": "acme"}
+			config.WafModeHeader = "X-Waf-Mode"
+			config.WafModeValue = "DetectionOnly"
+
+			middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("User-Agent", "test")
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("X-Internal", "1")
+			req.Header.Set("Keep-Alive", "timeout=5")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			args := <-agent.args
+			assert.Equal(t, "sample_app", args["app"])
+			assert.Equal(t, tt.method, args["method"])
+			assert.Equal(t, "1.1", args["version"])
+			assert.Equal(t, net.IP(net.ParseIP("192.0.2.1").To4()), args["src-ip"])
+			assert.Contains(t, args["headers"], "User-Agent: test\r\n")
+			assert.Contains(t, args["headers"], "Authorization: REDACTED\r\n")
+			assert.NotContains(t, args["headers"], "X-Internal")
+			assert.Contains(t, args["headers"], "X-Tenant: acme\r\n")
+			assert.Contains(t, args["headers"], "X-Waf-Mode: DetectionOnly\r\n")
+			assert.NotContains(t, args["headers"], "Keep-Alive")
+			body := args["body"].([]byte)
+			switch {
+			case tt.expectBody > 0:
+				assert.Len(t, body, tt.expectBody)
+			case tt.expectBody < 0:
+				assert.Less(t, len(body), 1024)
+				assert.Greater(t, len(body), 512)
+			}
+			if tt.expectStatus == http.StatusOK {
+				assert.Equal(t, tt.body, string(nextBody))
+			}
+		})
+	}
+}
+
+func TestModsecurity_SpoeAgentDisconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := &spoeConn{conn: conn, reader: bufio.NewReader(conn)}
+		sc.readFrame()
+		disconnect := appendSpoeKV(nil, "status-code", int64(3))
+		disconnect = appendSpoeKV(disconnect, "message", "unsupported version")
+		sc.writeFrame(spoeFrameAgentDisconnect, 0, 0, disconnect)
+	}()
+
+	client := newSpoeClient(listener.Addr().String(), 0, 1)
+	_, err = client.notify(context.Background(), spoeMessage, nil)
+	assert.EqualError(t, err, "spoe: agent disconnected with status 3: unsupported version")
+}
+
+func TestNew_SpoeResponseInspection(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "spoe://coraza:9000"
+	config.InspectResponses = true
+
+	_, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	assert.Error(t, err)
+
+	config.ResponseInspectionUrl = "spoe://coraza:9000"
+	_, err = New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	assert.EqualError(t, err, "responses can't be inspected by spoe agents, responseInspectionUrl must be an http one")
+
+	config.ResponseInspectionUrl = "http://modsecurity"
+	_, err = New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	assert.NoError(t, err)
+}
+
+func TestSpoeFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go (&spoeConn{conn: client}).writeFrame(spoeFrameNotify, 300, 0, []byte("payload"))
+
+	var frame [4 + 1 + 4 + 2 + 1 + 7]byte
+	_, err := io.ReadFull(server, frame[:])
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(len(frame)-4), binary.BigEndian.Uint32(frame[:4]))
+	assert.Equal(t, byte(spoeFrameNotify), frame[4])
+	assert.Equal(t, uint32(spoeFlagFin), binary.BigEndian.Uint32(frame[5:9]))
+	assert.Equal(t, []byte{0xfc, 0x03, 0x00}, frame[9:12])
+	assert.Equal(t, "payload", string(frame[12:]))
+}
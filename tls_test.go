@@ -0,0 +1,146 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to dir, and returns the certificate.
+func writeClientCert(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "traefik"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "client.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(filepath.Join(dir, "client.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestModsecurity_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert := writeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	modsecurityMockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	modsecurityMockServer.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	modsecurityMockServer.StartTLS()
+	defer modsecurityMockServer.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: modsecurityMockServer.Certificate().Raw}), 0o600)
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name               string
+		clientCert         bool
+		caFile             bool
+		rootCAFile         bool
+		insecureSkipVerify bool
+		expectStatus       int
+	}{
+		{name: "Authenticates with the client certificate", clientCert: true, caFile: true, expectStatus: http.StatusOK},
+		{name: "Fails without the client certificate", caFile: true, expectStatus: http.StatusBadGateway},
+		{name: "Fails without the CA", clientCert: true, expectStatus: http.StatusBadGateway},
+		{name: "Trusts the root CA file", clientCert: true, rootCAFile: true, expectStatus: http.StatusOK},
+		{name: "Skips the verification", clientCert: true, insecureSkipVerify: true, expectStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			if tt.clientCert {
+				config.ClientCertFile = filepath.Join(dir, "client.crt")
+				config.ClientKeyFile = filepath.Join(dir, "client.key")
+			}
+			if tt.caFile {
+				config.CaFile = caFile
+			}
+			if tt.rootCAFile {
+				config.RootCAFile = caFile
+			}
+			config.InsecureSkipVerify = tt.insecureSkipVerify
+
+			middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatalf("Failed to create middleware: %v", err)
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+			assert.Equal(t, tt.expectStatus, rw.Code)
+		})
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CaFile = caFile
+	config.RootCAFile = caFile
+	_, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	assert.EqualError(t, err, "caFile and rootCAFile cannot both be set, rootCAFile is an alias of caFile")
+}
+
+func TestNewTLSConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	notPem := filepath.Join(dir, "ca.crt")
+	os.WriteFile(notPem, []byte("not a certificate"), 0o600)
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Missing key file", config: Config{ClientCertFile: filepath.Join(dir, "client.crt")}},
+		{name: "Missing CA file", config: Config{CaFile: filepath.Join(dir, "missing.crt")}},
+		{name: "CA file without certificate", config: Config{CaFile: notPem}},
+		{name: "Root CA file without certificate", config: Config{RootCAFile: notPem}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSConfig(&tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Distributed tracing headers, W3C trace context and B3 in its single and multiple header forms.
+const (
+	traceparentHeader    = "Traceparent"
+	b3Header             = "B3"
+	b3TraceIDHeader      = "X-B3-Traceid"
+	b3SpanIDHeader       = "X-B3-Spanid"
+	b3ParentSpanIDHeader = "X-B3-Parentspanid"
+)
+
+// span the modsecurity call, as a child of the span of the request in its trace.
+type span struct {
+	traceID  string
+	id       string
+	parentID string
+	start    time.Time
+}
+
+// startSpan starts a span for the modsecurity call and rewrites the W3C and B3 headers of the modsecurity request
+// with its ID, so spans modsecurity records are children of it. The span has no trace ID when the request doesn't
+// carry a trace context, the headers are then left alone.
+func startSpan(h http.Header) *span {
+	s := &span{id: newSpanID(), start: time.Now()}
+
+	if parts := strings.Split(h.Get(traceparentHeader), "-"); len(parts) >= 4 && isHex(parts[1], 32) && isHex(parts[2], 16) {
+		s.traceID, s.parentID = parts[1], parts[2]
+		parts[2] = s.id
+		h.Set(traceparentHeader, strings.Join(parts, "-"))
+	}
+
+	// {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}, a parent can only be sent along with the sampling state
+	if parts := strings.Split(h.Get(b3Header), "-"); len(parts) >= 2 && isTraceID(parts[0]) && isHex(parts[1], 16) {
+		s.setTrace(parts[0], parts[1])
+		b3 := []string{parts[0], s.id}
+		if len(parts) >= 3 {
+			b3 = append(b3, parts[2], parts[1])
+		}
+		h.Set(b3Header, strings.Join(b3, "-"))
+	}
+
+	if traceID, spanID := h.Get(b3TraceIDHeader), h.Get(b3SpanIDHeader); isTraceID(traceID) && isHex(spanID, 16) {
+		s.setTrace(traceID, spanID)
+		h.Set(b3SpanIDHeader, s.id)
+		h.Set(b3ParentSpanIDHeader, spanID)
+	}
+
+	return s
+}
+
+// setTrace sets the trace the span belongs to, unless a header that came first already did.
+func (s *span) setTrace(traceID, parentID string) {
+	if s.traceID == "" {
+		s.traceID, s.parentID = traceID, parentID
+	}
+}
+
+// logSpan writes a record of the modsecurity call, with its timing and the trace it belongs to.
+func (a *Modsecurity) logSpan(req *http.Request, s *span, status int, err error) {
+	kv := []interface{}{"name", "modsecurity", "spanID", s.id}
+	if s.traceID != "" {
+		kv = append(kv, "traceID", s.traceID, "parentSpanID", s.parentID)
+	}
+	kv = append(kv, "start", s.start.UTC().Format(time.RFC3339Nano), "durationMs", time.Since(s.start).Milliseconds())
+	if err != nil {
+		kv = append(kv, "error", err)
+	} else {
+		kv = append(kv, "status", status)
+	}
+	a.log(req).Info("span", kv...)
+}
+
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// isTraceID reports whether id is a B3 trace ID, 64 or 128 bits.
+func isTraceID(id string) bool {
+	return isHex(id, 16) || isHex(id, 32)
+}
+
+// isHex reports whether s is n lowercase hex digits, not all zeros, which is an invalid ID in both W3C and B3.
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.Count(s, "0") == n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartSpan(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		expectTrace  string
+		expectHeader func(s *span) map[string]string
+	}{
+		{
+			name:   "W3C trace context",
+			header: map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01"},
+			expectHeader: func(s *span) map[string]string {
+				return map[string]string{"traceparent": "00-" + traceID + "-" + s.id + "-01"}
+			},
+			expectTrace: traceID,
+		},
+		{
+			name:   "B3 single header",
+			header: map[string]string{"b3": traceID + "-" + spanID + "-1"},
+			expectHeader: func(s *span) map[string]string {
+				return map[string]string{"b3": traceID + "-" + s.id + "-1-" + spanID}
+			},
+			expectTrace: traceID,
+		},
+		{
+			name:   "B3 single header without sampling state",
+			header: map[string]string{"b3": traceID + "-" + spanID},
+			expectHeader: func(s *span) map[string]string {
+				return map[string]string{"b3": traceID + "-" + s.id}
+			},
+			expectTrace: traceID,
+		},
+		{
+			name:   "B3 multiple headers",
+			header: map[string]string{"X-B3-TraceId": traceID, "X-B3-SpanId": spanID},
+			expectHeader: func(s *span) map[string]string {
+				return map[string]string{"X-B3-TraceId": traceID, "X-B3-SpanId": s.id, "X-B3-ParentSpanId": spanID}
+			},
+			expectTrace: traceID,
+		},
+		{
+			name:   "Invalid trace context",
+			header: map[string]string{"traceparent": "00-" + traceID + "-0000000000000000-01"},
+			expectHeader: func(s *span) map[string]string {
+				return map[string]string{"traceparent": "00-" + traceID + "-0000000000000000-01"}
+			},
+		},
+		{
+			name:         "No trace context",
+			header:       map[string]string{},
+			expectHeader: func(s *span) map[string]string { return map[string]string{} },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+
+			s := startSpan(h)
+
+			assert.True(t, isHex(s.id, 16))
+			assert.Equal(t, tt.expectTrace, s.traceID)
+			if tt.expectTrace != "" {
+				assert.Equal(t, spanID, s.parentID)
+			}
+			expect := make(http.Header)
+			for k, v := range tt.expectHeader(s) {
+				expect.Set(k, v)
+			}
+			assert.Equal(t, expect, h)
+		})
+	}
+}
+
+func TestModsecurity_LogSpans(t *testing.T) {
+	var traceparent string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer modsecurityMockServer.Close()
+
+	var upstream string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("traceparent")
+	})
+
+	var logs bytes.Buffer
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.LogSpans = true
+
+	middleware, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	middleware.(*Modsecurity).logger.out = &logs
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/website", nil)
+	req.Header.Set("traceparent", incoming)
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, incoming, upstream)
+	assert.NotEqual(t, incoming, traceparent)
+	assert.Contains(t, logs.String(), "INFO span name=modsecurity spanID="+traceparent[36:52]+" traceID=4bf92f3577b34da6a3ce929d0e0e4736 parentSpanID=00f067aa0ba902b7")
+	assert.Contains(t, logs.String(), "status=200")
+}
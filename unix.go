@@ -0,0 +1,43 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const unixSocketScheme = "unix://"
+
+// unixSockets the sockets of the modsecurity instances configured as unix:///path/to/modsec.sock, by the pseudo
+// host their requests are sent to. Requests stay plain http ones, the dialer connects to the socket instead.
+type unixSockets map[string]string
+
+// target returns the base URL requests to a modsecurity URL are sent to, the URL itself unless it is a unix socket.
+func (s unixSockets) target(rawUrl string) (string, error) {
+	path, ok := strings.CutPrefix(rawUrl, unixSocketScheme)
+	if !ok {
+		return rawUrl, nil
+	}
+	if path == "" {
+		return "", fmt.Errorf("invalid modsecurity URL %q, the socket path is missing", rawUrl)
+	}
+
+	for host, socket := range s {
+		if socket == path {
+			return "http://" + host, nil
+		}
+	}
+	host := fmt.Sprintf("modsecurity-unix-%d", len(s))
+	s[host] = path
+	return "http://" + host, nil
+}
+
+// socket returns the socket path of a pseudo host address, ok is false for any other address.
+func (s unixSockets) socket(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	path, ok := s[host]
+	return path, ok
+}
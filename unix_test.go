@@ -0,0 +1,76 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixSockets(t *testing.T) {
+	sockets := make(unixSockets)
+
+	target, err := sockets.target("http://modsecurity:8080")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://modsecurity:8080", target)
+
+	target, err = sockets.target("unix:///var/run/modsec.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://modsecurity-unix-0", target)
+
+	again, err := sockets.target("unix:///var/run/modsec.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, target, again)
+
+	socket, ok := sockets.socket("modsecurity-unix-0:80")
+	assert.True(t, ok)
+	assert.Equal(t, "/var/run/modsec.sock", socket)
+
+	_, ok = sockets.socket("modsecurity:8080")
+	assert.False(t, ok)
+
+	_, err = sockets.target("unix://")
+	assert.Error(t, err)
+}
+
+func TestModsecurity_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "modsec.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	modsecurityMockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	modsecurityMockServer.Listener = listener
+	modsecurityMockServer.Start()
+	defer modsecurityMockServer.Close()
+
+	httpServiceHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "unix://" + socket
+
+	middleware, err := New(context.Background(), httpServiceHandler, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/attack", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
@@ -0,0 +1,89 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// warmUp opens up to n connections to every modsecurity instance, so that the first burst of requests after a
+// deploy doesn't pay for the dial and TLS handshake. Connections are kept idle up to maxIdleConnsPerHost.
+func (a *Modsecurity) warmUp(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for _, pool := range a.backendPools() {
+		for _, b := range pool.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				if err := a.warmBackend(ctx, b, n); err != nil {
+					a.logger.Warn("fail to warm up modsec connections", "backend", b.url, "error", err)
+				}
+			}(b)
+		}
+	}
+	wg.Wait()
+}
+
+// warmBackend opens n connections to a modsecurity instance. HTTP connections are opened by as many concurrent
+// HEAD requests, of healthCheckPath or of the root, whose responses are discarded.
+func (a *Modsecurity) warmBackend(ctx context.Context, b *backend, n int) error {
+	switch verdicts := b.verdicts.(type) {
+	case *spoeBackend:
+		return verdicts.client.warm(ctx, n)
+	case *httpReplay:
+		path := a.healthCheckPath
+		if path == "" {
+			path = "/"
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				req, err := http.NewRequestWithContext(ctx, http.MethodHead, verdicts.url+path, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				a.setWafAuth(req.Header)
+				a.signWafRequest(req)
+				resp, err := a.httpClient.Do(req)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				errs <- err
+			}()
+		}
+		var firstErr error
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	return nil
+}
+
+// runWarmUp warms up the connections to modsecurity right away, then every interval until ctx is done, so that
+// they don't all expire while traffic is idle.
+func (a *Modsecurity) runWarmUp(ctx context.Context, n int, interval time.Duration) {
+	a.warmUp(ctx, n)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.warmUp(ctx, n)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_WarmupConnections(t *testing.T) {
+	var conns, idle int32
+	modsecurityMockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep the warm-up requests in flight together, so that each gets its own connection
+		if r.Method == http.MethodHead {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	modsecurityMockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&conns, 1)
+		case http.StateIdle:
+			atomic.AddInt32(&idle, 1)
+		}
+	}
+	modsecurityMockServer.Start()
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.WarmupConnections = 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	middleware, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&idle) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&conns))
+
+	// Requests go over the warm connections
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&conns))
+}
+
+func TestSpoeClient_Warm(t *testing.T) {
+	agent := newSpoeAgentMock(t, 1024)
+	defer agent.listener.Close()
+
+	c := newSpoeClient(agent.listener.Addr().String(), time.Second, 2)
+	assert.NoError(t, c.warm(context.Background(), 3))
+	assert.Len(t, c.idle, 2)
+
+	// Idle connections are not opened again
+	assert.NoError(t, c.warm(context.Background(), 3))
+	assert.Len(t, c.idle, 2)
+
+	c = newSpoeClient("127.0.0.1:1", time.Second, 2)
+	assert.Error(t, c.warm(context.Background(), 1))
+}
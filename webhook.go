@@ -0,0 +1,138 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// webhookQueueSize events waiting to be posted, further events are dropped until the webhook catches up.
+const webhookQueueSize = 256
+
+// Types of the events posted to the webhook.
+const (
+	eventBlocked = "blocked"
+	eventJailed  = "jailed"
+)
+
+// event a security event posted to the webhook.
+type event struct {
+	Type       string    `json:"type"`
+	Middleware string    `json:"middleware"`
+	ClientIP   string    `json:"clientIP"`
+	Status     int       `json:"status"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	URI        string    `json:"uri"`
+	RequestID  string    `json:"requestID,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// webhook posts events as JSON to an URL, from a background goroutine so that requests never wait for it.
+type webhook struct {
+	url    string
+	client *http.Client
+	events chan event
+	logger *logger
+}
+
+func newWebhook(ctx context.Context, url string, timeout time.Duration, logger *logger) *webhook {
+	w := &webhook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		events: make(chan event, webhookQueueSize),
+		logger: logger,
+	}
+	go w.run(ctx)
+	return w
+}
+
+// send queues an event, or drops it when the queue is full.
+func (w *webhook) send(e event) {
+	select {
+	case w.events <- e:
+	default:
+		w.logger.Warn("webhook queue is full, dropping event", "type", e.Type, "clientIP", e.ClientIP)
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.events:
+			if err := w.post(ctx, e); err != nil {
+				w.logger.Warn("fail to post event to webhook", "type", e.Type, "error", err)
+			}
+		}
+	}
+}
+
+func (w *webhook) post(ctx context.Context, e event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notify reports an event about the request to the audit log, the ban log, CrowdSec and the webhook, if there are.
+func (a *Modsecurity) notify(eventType string, req *http.Request, clientIP string, v *verdict) {
+	if a.auditLog != nil {
+		a.auditLog.write(eventType, a.name, a.requestID(req), req, clientIP, a.country(clientIP), v)
+	}
+	// A client jailed by its session is not banned by address, which would keep out everyone behind its NAT, nor
+	// is a client jailed on a single router
+	bannedByAddress := eventType == eventJailed && a.jailKey(req, clientIP) == clientIP
+	if a.banLog != nil && bannedByAddress {
+		// With subnet jailing, the whole subnet may be the one put in jail
+		banned := clientIP
+		if subnet := a.jail.subnet(clientIP); subnet != "" && !a.jail.bannedUntil(subnet).IsZero() {
+			banned = subnet
+		}
+		a.banLog.write(banned, a.jail.releaseTime(clientIP))
+	}
+	if a.crowdsec != nil {
+		switch {
+		case eventType != eventJailed:
+			a.crowdsec.report("request blocked by modsecurity", req, clientIP, v.StatusCode, 0)
+		case bannedByAddress:
+			a.crowdsec.report("client jailed by modsecurity", req, clientIP, v.StatusCode, time.Until(a.jail.releaseTime(clientIP)))
+		}
+	}
+	if a.webhook == nil {
+		return
+	}
+	a.webhook.send(event{
+		Type:       eventType,
+		Middleware: a.name,
+		ClientIP:   clientIP,
+		Status:     v.StatusCode,
+		Method:     req.Method,
+		Host:       req.Host,
+		URI:        req.RequestURI,
+		RequestID:  a.requestID(req),
+		Timestamp:  time.Now().UTC(),
+	})
+}
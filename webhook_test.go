@@ -0,0 +1,81 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_EventWebhook(t *testing.T) {
+	events := make(chan event, 10)
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e event
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer webhookServer.Close()
+
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/attack" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.EventWebhookUrl = webhookServer.URL
+	config.JailEnabled = true
+	config.BadRequestsThresholdCount = 1
+
+	middleware, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/website", nil))
+	req := httptest.NewRequest(http.MethodGet, "/attack?id=1", nil)
+	req.RemoteAddr = "198.51.100.1:5555"
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	receive := func() event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the webhook")
+			return event{}
+		}
+	}
+
+	blocked := receive()
+	assert.Equal(t, eventBlocked, blocked.Type)
+	assert.Equal(t, "modsecurity-middleware", blocked.Middleware)
+	assert.Equal(t, "198.51.100.1", blocked.ClientIP)
+	assert.Equal(t, http.StatusForbidden, blocked.Status)
+	assert.Equal(t, "/attack?id=1", blocked.URI)
+	assert.False(t, blocked.Timestamp.IsZero())
+
+	assert.Equal(t, eventJailed, receive().Type)
+	assert.Empty(t, events)
+}
+
+func TestWebhook_DropsEventsWhenFull(t *testing.T) {
+	l, _ := newLogger(io.Discard, "info", "text", "waf")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := newWebhook(ctx, "http://127.0.0.1:0", time.Second, l)
+
+	for i := 0; i < webhookQueueSize+10; i++ {
+		w.send(event{Type: eventBlocked})
+	}
+	assert.LessOrEqual(t, len(w.events), webhookQueueSize)
+}